@@ -0,0 +1,307 @@
+// KatWeb by kittyhacker101 - Reverse Proxy Load Balancing
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// healthStop is closed to stop the running health checker.
+	healthStop chan struct{}
+	healthMu   sync.Mutex
+)
+
+// stickyCookie is the name of the cookie used to pin a client to a backend.
+const stickyCookie = "katweb_backend"
+
+// backendKey is the context key for the backend chosen for a proxied request.
+type backendKey struct{}
+
+// backend is an upstream server which requests can be proxied to.
+type backend struct {
+	url   string
+	pool  *upstreams
+	fails int32 // consecutive failed requests
+	down  int64 // unix time in nanoseconds until the backend is used again
+	conns int64 // requests currently being proxied
+	dead  int32 // if the backend failed its active health checks
+	oks   int32 // consecutive passed health checks
+	bads  int32 // consecutive failed health checks
+}
+
+// upstreams contains the backends for a proxy location.
+type upstreams struct {
+	backends []*backend
+	mode     string
+	sticky   bool
+	keep     bool
+	headers  map[string]string
+	rewrite  *strings.Replacer
+	next     uint32
+	key      string // the location's settings, used to keep its backends across reloads when they haven't changed
+}
+
+// newUpstreams creates the backends for a proxy location.
+func newUpstreams(urls []string) *upstreams {
+	u := &upstreams{}
+	for _, url := range urls {
+		u.backends = append(u.backends, &backend{url: url, pool: u})
+	}
+	return u
+}
+
+// healthy checks if a backend should be used for new requests.
+func (b *backend) healthy(now int64) bool {
+	return atomic.LoadInt32(&b.dead) == 0 && atomic.LoadInt64(&b.down) <= now
+}
+
+// fail records a failed request, and takes the backend out of rotation if it has failed too many times in a row.
+func (b *backend) fail() {
+	if conf().ProxyHealth.Fails <= 0 {
+		return
+	}
+	if atomic.AddInt32(&b.fails, 1) >= int32(conf().ProxyHealth.Fails) {
+		atomic.StoreInt32(&b.fails, 0)
+		atomic.StoreInt64(&b.down, time.Now().Add(time.Duration(conf().ProxyHealth.Cooldown)*time.Second).UnixNano())
+		Print("[Warn] : Proxy backend " + b.url + " is unhealthy, removing it from rotation.")
+	}
+}
+
+// succeed records a successful request.
+func (b *backend) succeed() {
+	atomic.StoreInt32(&b.fails, 0)
+}
+
+// start returns the index of the backend to start balancing from.
+// The counter wraps around, so the index is found before converting it to an int, which may only be 32 bits.
+func (u *upstreams) start() int {
+	return int(atomic.AddUint32(&u.next, 1) % uint32(len(u.backends)))
+}
+
+// pick chooses the backend to use for a request, using round-robin or least-connections balancing.
+// Unhealthy backends are skipped, unless every backend is unhealthy.
+func (u *upstreams) pick() *backend {
+	var (
+		now  = time.Now().UnixNano()
+		n    = u.start()
+		best *backend
+	)
+
+	for i := range u.backends {
+		b := u.backends[(n+i)%len(u.backends)]
+		if !b.healthy(now) {
+			continue
+		}
+		if u.mode != "leastconn" {
+			return b
+		}
+		if best == nil || atomic.LoadInt64(&b.conns) < atomic.LoadInt64(&best.conns) {
+			best = b
+		}
+	}
+
+	if best == nil {
+		return u.backends[n]
+	}
+	return best
+}
+
+// pickOther chooses a healthy backend other than the given one, for retrying a request.
+// It returns nil if there are no other healthy backends.
+func (u *upstreams) pickOther(prev *backend) *backend {
+	var (
+		now = time.Now().UnixNano()
+		n   = u.start()
+	)
+	for i := range u.backends {
+		if b := u.backends[(n+i)%len(u.backends)]; b != prev && b.healthy(now) {
+			return b
+		}
+	}
+
+	return nil
+}
+
+// retryTransport is a http.RoundTripper which retries idempotent requests on another backend, if the connection to a backend fails.
+// Only connection failures are retried, as no part of the request has been sent to the backend.
+// Requests use the transport which was current when they started, so it can be replaced by a config reload.
+type retryTransport struct{}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr := currentTransport()
+	resp, err := tr.RoundTrip(req)
+	for i := 0; i < conf().ProxyHealth.Retries && err != nil && canRetry(req, err); i++ {
+		b := requestBackend(req)
+		next := b.pool.pickOther(b)
+		if next == nil || !strings.HasPrefix(req.URL.String(), b.url) {
+			break
+		}
+		u, errp := url.Parse(next.url + strings.TrimPrefix(req.URL.String(), b.url))
+		if errp != nil {
+			break
+		}
+		b.fail()
+
+		req = req.WithContext(context.WithValue(req.Context(), backendKey{}, next))
+		req.URL = u
+		resp, err = tr.RoundTrip(req)
+	}
+
+	if b := requestBackend(req); err != nil && b != nil {
+		err = &attemptError{b, err}
+	}
+	return resp, err
+}
+
+// attemptError is an error from the last backend a request was sent to, which is not the backend first chosen for it if the request was retried.
+type attemptError struct {
+	b   *backend
+	err error
+}
+
+func (e *attemptError) Error() string {
+	return e.err.Error()
+}
+
+func (e *attemptError) Unwrap() error {
+	return e.err
+}
+
+// failedBackend returns the backend which caused a proxied request to fail.
+func failedBackend(r *http.Request, err error) *backend {
+	var ae *attemptError
+	if errors.As(err, &ae) {
+		return ae.b
+	}
+	return requestBackend(r)
+}
+
+// canRetry checks if a failed proxied request can safely be sent to another backend.
+func canRetry(req *http.Request, err error) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	if requestBackend(req) == nil || (req.Body != nil && req.Body != http.NoBody) {
+		return false
+	}
+
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "dial"
+}
+
+// withBackend chooses a backend for a proxied request, and adds it to the request's context.
+// If sticky sessions are enabled, clients are pinned to a backend with a cookie, until that backend becomes unhealthy.
+func withBackend(w http.ResponseWriter, r *http.Request) (*http.Request, *backend) {
+	u, loc := findProxy(r)
+	if u == nil {
+		return r, nil
+	}
+
+	var b *backend
+	if u.sticky {
+		if c, err := r.Cookie(stickyCookie); err == nil {
+			if i, err := strconv.Atoi(c.Value); err == nil && i >= 0 && i < len(u.backends) && u.backends[i].healthy(time.Now().UnixNano()) {
+				b = u.backends[i]
+			}
+		}
+	}
+	if b == nil {
+		b = u.pick()
+		if u.sticky {
+			path := "/"
+			if loc != r.Host {
+				path += loc
+			}
+			for i := range u.backends {
+				if u.backends[i] == b {
+					http.SetCookie(w, &http.Cookie{Name: stickyCookie, Value: strconv.Itoa(i), Path: path, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+				}
+			}
+		}
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), backendKey{}, b)), b
+}
+
+// requestBackend returns the backend chosen for a proxied request.
+func requestBackend(r *http.Request) *backend {
+	b, _ := r.Context().Value(backendKey{}).(*backend)
+	return b
+}
+
+// checkBackend probes the health check path of a backend.
+// The backend is taken out of rotation after failing the unhealthy threshold of checks in a row, and returned after passing the healthy threshold.
+func checkBackend(client *http.Client, b *backend) {
+	resp, err := client.Get(strings.TrimSuffix(b.url, "/") + conf().ProxyHealth.Path)
+	if err == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	if err != nil || resp.StatusCode >= 500 {
+		atomic.StoreInt32(&b.oks, 0)
+		if atomic.AddInt32(&b.bads, 1) >= int32(conf().ProxyHealth.Unhealthy) && atomic.SwapInt32(&b.dead, 1) == 0 {
+			Print("[Warn] : Proxy backend " + b.url + " failed its health checks, removing it from rotation.")
+		}
+		return
+	}
+
+	atomic.StoreInt32(&b.bads, 0)
+	if atomic.AddInt32(&b.oks, 1) >= int32(conf().ProxyHealth.Healthy) && atomic.SwapInt32(&b.dead, 0) == 1 {
+		Print("[Info] : Proxy backend " + b.url + " has recovered, returning it to rotation.")
+	}
+}
+
+// checkAll probes the health check path of every backend of the current proxy locations.
+func checkAll(client *http.Client) {
+	for _, u := range route().proxies {
+		for _, b := range u.backends {
+			go checkBackend(client, b)
+		}
+	}
+}
+
+// StartHealthCheck periodically probes the health check path of every proxy backend.
+// It is called whenever the config is loaded, and stops the previous health checker, so the new settings are used.
+func StartHealthCheck() {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	if healthStop != nil {
+		close(healthStop)
+		healthStop = nil
+	}
+	if conf().ProxyHealth.Path == "" || conf().ProxyHealth.Interval <= 0 {
+		return
+	}
+
+	stop, client := make(chan struct{}), &http.Client{
+		Transport: retryTransport{},
+		Timeout:   time.Duration(conf().ProxyHealth.Timeout) * time.Second,
+	}
+	tick := time.NewTicker(time.Duration(conf().ProxyHealth.Interval) * time.Second)
+	healthStop = stop
+	go func() {
+		defer tick.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+				checkAll(client)
+			}
+		}
+	}()
+}
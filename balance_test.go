@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testUpstreams creates upstreams with the given number of backends.
+func testUpstreams(n int, mode string) *upstreams {
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = "http://backend" + string(rune('a'+i))
+	}
+	u := newUpstreams(urls)
+	u.mode = mode
+	return u
+}
+
+func TestPick(t *testing.T) {
+	tests := []struct {
+		name  string
+		n     int
+		mode  string
+		next  uint32
+		setup func(u *upstreams)
+		want  []int // indexes of the backends chosen by consecutive picks
+	}{
+		{"round robin", 3, "", 0, nil, []int{1, 2, 0, 1}},
+		{"single backend", 1, "", 0, nil, []int{0, 0}},
+		{"counter wraps", 3, "", math.MaxUint32 - 1, nil, []int{0, 0, 1}},
+		{"counter past int32", 3, "", math.MaxInt32, nil, []int{2, 0, 1}},
+		{"skips down", 3, "", 0, func(u *upstreams) { atomic.StoreInt64(&u.backends[2].down, time.Now().Add(time.Hour).UnixNano()) }, []int{1, 0, 0, 1}},
+		{"skips dead", 3, "", 0, func(u *upstreams) { atomic.StoreInt32(&u.backends[1].dead, 1) }, []int{2, 2, 0, 2}},
+		{"all unhealthy", 2, "", 0, func(u *upstreams) {
+			atomic.StoreInt32(&u.backends[0].dead, 1)
+			atomic.StoreInt32(&u.backends[1].dead, 1)
+		}, []int{1, 0}},
+		{"least connections", 3, "leastconn", 0, func(u *upstreams) {
+			atomic.StoreInt64(&u.backends[0].conns, 5)
+			atomic.StoreInt64(&u.backends[1].conns, 1)
+			atomic.StoreInt64(&u.backends[2].conns, 3)
+		}, []int{1, 1, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := testUpstreams(tt.n, tt.mode)
+			u.next = tt.next
+			if tt.setup != nil {
+				tt.setup(u)
+			}
+			for i, want := range tt.want {
+				if got := u.pick(); got != u.backends[want] {
+					t.Errorf("pick %d = %s, want %s", i, got.url, u.backends[want].url)
+				}
+			}
+		})
+	}
+}
+
+func TestPickOther(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		next uint32
+		prev int
+		dead []int
+		want int // -1 if no backend is chosen
+	}{
+		{"next backend", 3, 0, 0, nil, 1},
+		{"skips previous", 3, 0, 1, nil, 2},
+		{"skips dead", 3, 0, 0, []int{1}, 2},
+		{"counter wraps", 3, math.MaxUint32, 0, nil, 1},
+		{"no other backend", 1, 0, 0, nil, -1},
+		{"others dead", 3, 0, 0, []int{1, 2}, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := testUpstreams(tt.n, "")
+			u.next = tt.next
+			for _, d := range tt.dead {
+				u.backends[d].dead = 1
+			}
+			got := u.pickOther(u.backends[tt.prev])
+			if tt.want == -1 {
+				if got != nil {
+					t.Errorf("pickOther() = %s, want nil", got.url)
+				}
+				return
+			}
+			if got != u.backends[tt.want] {
+				t.Errorf("pickOther() = %v, want %s", got, u.backends[tt.want].url)
+			}
+		})
+	}
+}
+
+func TestCheckBackend(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int // responses to consecutive health checks
+		dead      int32 // if the backend starts out dead
+		healthy   int
+		unhealthy int
+		want      int32
+	}{
+		{"stays healthy", []int{200, 200}, 0, 2, 2, 0},
+		{"one failure", []int{500}, 0, 2, 2, 0},
+		{"fails threshold", []int{500, 503}, 0, 2, 2, 1},
+		{"failures not in a row", []int{500, 200, 500}, 0, 2, 2, 0},
+		{"client errors are healthy", []int{404, 404}, 0, 2, 2, 0},
+		{"one pass", []int{200}, 1, 2, 2, 1},
+		{"recovers", []int{200, 200}, 1, 2, 2, 0},
+		{"passes not in a row", []int{200, 500, 200}, 1, 2, 2, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var i int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/health" {
+					t.Errorf("checked path %q, want /health", r.URL.Path)
+				}
+				w.WriteHeader(tt.statuses[atomic.AddInt32(&i, 1)-1])
+			}))
+			defer srv.Close()
+
+			c := &Conf{}
+			c.ProxyHealth.Path, c.ProxyHealth.Healthy, c.ProxyHealth.Unhealthy = "/health", tt.healthy, tt.unhealthy
+			setTestConf(t, c)
+
+			b := &backend{url: srv.URL + "/", dead: tt.dead}
+			for range tt.statuses {
+				checkBackend(srv.Client(), b)
+			}
+			if b.dead != tt.want {
+				t.Errorf("dead = %d, want %d", b.dead, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthCheckReload(t *testing.T) {
+	var hits [2]int32
+	var srvs [2]*httptest.Server
+	for i := range srvs {
+		i := i
+		srvs[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits[i], 1)
+		}))
+		defer srvs[i].Close()
+	}
+	// Every reload checks only the backends in the current config.
+	for i, srv := range srvs {
+		loadTestConf(t, `{"proxy":[{"location":"site`+strconv.Itoa(i)+`","host":"`+srv.URL+`/"}],"proxyHealth":{"checkPath":"/health","checkTimeout":5}}`)
+		atomic.StoreInt32(&hits[0], 0)
+		atomic.StoreInt32(&hits[1], 0)
+
+		checkAll(srv.Client())
+		for start := time.Now(); atomic.LoadInt32(&hits[i]) == 0 && time.Since(start) < 5*time.Second; {
+			time.Sleep(time.Millisecond)
+		}
+		if atomic.LoadInt32(&hits[i]) != 1 || atomic.LoadInt32(&hits[1-i]) != 0 {
+			t.Errorf("reload %d checked backends %v times, want only backend %d", i, hits, i)
+		}
+	}
+	if _, ok := route().proxies["site0"]; ok {
+		t.Error("removed location site0 is still in the proxy map")
+	}
+}
+
+func TestStartHealthCheck(t *testing.T) {
+	t.Cleanup(func() {
+		setConf(&Conf{})
+		StartHealthCheck()
+	})
+
+	tests := []struct {
+		name     string
+		path     string
+		interval int
+		running  bool
+	}{
+		{"enabled", "/health", 60, true},
+		{"restarted", "/health", 30, true},
+		{"no path", "", 60, false},
+		{"no interval", "/health", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.ProxyHealth.Path, c.ProxyHealth.Interval = tt.path, tt.interval
+			setConf(c)
+
+			prev := healthStop
+			StartHealthCheck()
+			if (healthStop != nil) != tt.running {
+				t.Errorf("health checker running = %v, want %v", healthStop != nil, tt.running)
+			}
+			if prev != nil {
+				select {
+				case <-prev:
+				default:
+					t.Error("previous health checker was not stopped")
+				}
+			}
+		})
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer live.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := "http://" + l.Addr().String()
+	l.Close()
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead2 := "http://" + l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		name    string
+		method  string
+		urls    []string
+		retries int
+		ok      bool
+		fails   []int32 // failures recorded against each backend, after the error handler runs
+	}{
+		{"retried on live backend", "GET", []string{dead, live.URL}, 1, true, []int32{1, 0}},
+		{"no retries", "GET", []string{dead, live.URL}, 0, false, []int32{1, 0}},
+		{"post not retried", "POST", []string{dead, live.URL}, 1, false, []int32{1, 0}},
+		{"last attempt failed", "GET", []string{dead, dead2}, 1, false, []int32{1, 1}},
+		{"live backend", "GET", []string{live.URL, dead}, 1, true, []int32{0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.ProxyHealth.Retries, c.ProxyHealth.Fails, c.ProxyHealth.Cooldown = tt.retries, 10, 60
+			setTestConf(t, c)
+
+			u := newUpstreams(tt.urls)
+			b := u.backends[0]
+			r := httptest.NewRequest(tt.method, b.url+"/page", nil)
+			r = r.WithContext(context.WithValue(r.Context(), backendKey{}, b))
+			r.RequestURI = ""
+
+			resp, err := retryTransport{}.RoundTrip(r)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Fatalf("RoundTrip() error = %v, want success %v", err, tt.ok)
+			}
+			if err != nil {
+				route().proxy.ErrorHandler(httptest.NewRecorder(), r, err)
+			}
+			for i, want := range tt.fails {
+				if got := atomic.LoadInt32(&u.backends[i].fails); got != want {
+					t.Errorf("backend %d has %d failures, want %d", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStickyBackend(t *testing.T) {
+	tests := []struct {
+		name, host, cookie string
+		sticky             bool
+		down               int // index of a backend which is out of rotation, or -1
+		want               int
+		setCookie          string
+	}{
+		{"new client", "example.com", "", true, -1, 1, "katweb_backend=1; Path=/app; HttpOnly; SameSite=Lax"},
+		{"pinned client", "example.com", "2", true, -1, 2, ""},
+		{"pinned backend down", "example.com", "2", true, 2, 1, "katweb_backend=1; Path=/app; HttpOnly; SameSite=Lax"},
+		{"out of range", "example.com", "9", true, -1, 1, "katweb_backend=1; Path=/app; HttpOnly; SameSite=Lax"},
+		{"invalid cookie", "example.com", "first", true, -1, 1, "katweb_backend=1; Path=/app; HttpOnly; SameSite=Lax"},
+		{"host location", "app.example.com", "", true, -1, 1, "katweb_backend=1; Path=/; HttpOnly; SameSite=Lax"},
+		{"not sticky", "example.com", "2", false, -1, 1, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sticky := strconv.FormatBool(tt.sticky)
+			loadTestProxies(t, `{"proxy":[
+				{"location":"app","host":"http://backenda","extraHosts":["http://backendb","http://backendc"],"sticky":`+sticky+`},
+				{"location":"app.example.com","host":"http://backenda","extraHosts":["http://backendb","http://backendc"],"sticky":`+sticky+`}]}`)
+			u, _ := findProxy(httptest.NewRequest("GET", "http://"+tt.host+"/app/page", nil))
+			if tt.down >= 0 {
+				atomic.StoreInt64(&u.backends[tt.down].down, time.Now().Add(time.Hour).UnixNano())
+			}
+
+			r := httptest.NewRequest("GET", "http://"+tt.host+"/app/page", nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: stickyCookie, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			r, b := withBackend(w, r)
+			if b != u.backends[tt.want] {
+				t.Errorf("backend = %v, want %s", b, u.backends[tt.want].url)
+			}
+			if requestBackend(r) != b {
+				t.Errorf("request backend = %v, want the chosen backend", requestBackend(r))
+			}
+			if got := w.Header().Get("Set-Cookie"); got != tt.setCookie {
+				t.Errorf("Set-Cookie = %q, want %q", got, tt.setCookie)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+// KatWeb by kittyhacker101 - TLS Certificate Management
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// certPair holds a loaded keypair, along with the keypair it replaced.
+type certPair struct {
+	cur, old *tls.Certificate
+	expire   time.Time
+}
+
+var (
+	certs   atomic.Value
+	hostTLS atomic.Value
+
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	// clientAuths maps the client certificate modes to the TLS client authentication policy used for them.
+	clientAuths = map[string]tls.ClientAuthType{
+		"":        tls.NoClientCert,
+		"none":    tls.NoClientCert,
+		"verify":  tls.VerifyClientCertIfGiven,
+		"require": tls.RequireAndVerifyClientCert,
+	}
+)
+
+// LoadCert loads the server's keypair, and atomically swaps it with the keypair currently in use.
+// Handshakes which have already started will complete with the old keypair.
+func LoadCert(crt, key string) error {
+	cert, err := tls.LoadX509KeyPair(crt, key)
+	if err != nil {
+		return err
+	}
+
+	pair := &certPair{cur: &cert}
+	if prev, ok := certs.Load().(*certPair); ok && conf().Adv.CertOver > 0 {
+		pair.old = prev.cur
+		pair.expire = time.Now().Add(time.Duration(conf().Adv.CertOver) * time.Second)
+	}
+	certs.Store(pair)
+
+	return nil
+}
+
+// getCert provides the current keypair for a TLS handshake.
+// During the overlap window after a reload, the old keypair is used for clients which do not support the new one.
+func getCert(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	pair := certs.Load().(*certPair)
+	if pair.old != nil && time.Now().Before(pair.expire) && hello.SupportsCertificate(pair.cur) != nil && hello.SupportsCertificate(pair.old) == nil {
+		return pair.old, nil
+	}
+
+	return pair.cur, nil
+}
+
+// validALPN checks that a list of ALPN protocols contains at least one HTTP protocol.
+func validALPN(protos []string) bool {
+	for _, p := range protos {
+		if p == "h2" || p == "http/1.1" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadALPN sets the ALPN protocols used by the TLS config, returning false if the configured protocols are invalid.
+// Invalid protocol lists are ignored, and the default protocols are used instead.
+func loadALPN() bool {
+	if len(conf().Adv.ALPN) == 0 {
+		return true
+	}
+	if !validALPN(conf().Adv.ALPN) {
+		return false
+	}
+
+	tlsc.NextProtos = conf().Adv.ALPN
+	return true
+}
+
+// LoadHostTLS creates the TLS configurations for hosts which override the default TLS settings.
+func LoadHostTLS() error {
+	hosts, err := buildHostTLS(conf())
+	if err != nil {
+		return err
+	}
+
+	hostTLS.Store(hosts)
+	return nil
+}
+
+// buildHostTLS creates the per-host TLS configurations for a config, without putting them into use.
+func buildHostTLS(c *Conf) (map[string]*tls.Config, error) {
+	ciphers := make(map[string]uint16)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		ciphers[cs.Name] = cs.ID
+	}
+
+	hosts := make(map[string]*tls.Config)
+	for _, h := range c.HostTLS {
+		cfg := tlsc.Clone()
+		if h.Min != "" {
+			v, ok := tlsVersions[h.Min]
+			if !ok {
+				return nil, errors.New("unknown TLS version " + h.Min)
+			}
+			cfg.MinVersion = v
+		}
+		if len(h.Ciphers) > 0 {
+			cfg.CipherSuites = nil
+			for _, name := range h.Ciphers {
+				id, ok := ciphers[name]
+				if !ok {
+					return nil, errors.New("unknown cipher suite " + name)
+				}
+				cfg.CipherSuites = append(cfg.CipherSuites, id)
+			}
+		}
+		auth, ok := clientAuths[h.Auth]
+		if !ok {
+			return nil, errors.New("unknown client auth mode " + h.Auth)
+		}
+		if auth != tls.NoClientCert {
+			if h.CA == "" {
+				return nil, errors.New("no client CA bundle for " + h.Host)
+			}
+			data, err := ioutil.ReadFile(h.CA)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, errors.New("no certificates found in client CA bundle " + h.CA)
+			}
+			cfg.ClientCAs = pool
+			cfg.ClientAuth = auth
+		}
+		hosts[strings.ToLower(h.Host)] = cfg
+	}
+
+	return hosts, nil
+}
+
+// getHostTLS chooses the TLS configuration for a handshake, based on the SNI server name.
+// Hosts without their own configuration use the default configuration.
+func getHostTLS(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	hosts, ok := hostTLS.Load().(map[string]*tls.Config)
+	if !ok {
+		return nil, nil
+	}
+
+	return hosts[strings.ToLower(hello.ServerName)], nil
+}
+
+// misdirectedAuth checks if a request for a host with client certificate authentication was sent on a connection which wasn't authenticated for it.
+// The client certificate is only requested during the handshake for the SNI server name, so the request's host must match it.
+// Hosts which require a certificate are also refused when none was verified.
+func misdirectedAuth(r *http.Request) bool {
+	hosts, _ := hostTLS.Load().(map[string]*tls.Config)
+	host := strings.ToLower(trimPort(r.Host))
+	cfg, ok := hosts[host]
+	if !ok || cfg.ClientAuth == tls.NoClientCert {
+		return false
+	}
+	if r.TLS == nil || strings.ToLower(r.TLS.ServerName) != host {
+		return true
+	}
+
+	return cfg.ClientAuth == tls.RequireAndVerifyClientCert && clientCert(r) == nil
+}
+
+// clientCert returns a request's verified client certificate, or nil if it did not send one.
+func clientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// clientSubject returns the subject of a request's verified client certificate, or an empty string if it did not send one.
+func clientSubject(r *http.Request) string {
+	if c := clientCert(r); c != nil {
+		return c.Subject.String()
+	}
+	return ""
+}
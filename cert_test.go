@@ -0,0 +1,455 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeEd25519Cert creates a self-signed Ed25519 keypair, returning the paths of the certificate and key.
+func writeEd25519Cert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return writeFile(t, dir, "ed.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		writeFile(t, dir, "ed.key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}))
+}
+
+// restoreCerts puts back the keypair in use before a test.
+func restoreCerts(t *testing.T) {
+	prev := certs.Load()
+	t.Cleanup(func() {
+		if prev != nil {
+			certs.Store(prev)
+		}
+	})
+}
+
+func TestGetCertOverlap(t *testing.T) {
+	restoreCerts(t)
+	edCrt, edKey := writeEd25519Cert(t, t.TempDir())
+
+	var (
+		ecdsaOnly = &tls.ClientHelloInfo{SupportedVersions: []uint16{tls.VersionTLS13}, SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256}}
+		both      = &tls.ClientHelloInfo{SupportedVersions: []uint16{tls.VersionTLS13}, SignatureSchemes: []tls.SignatureScheme{tls.Ed25519, tls.ECDSAWithP256AndSHA256}}
+	)
+	tests := []struct {
+		name    string
+		overlap int
+		hello   *tls.ClientHelloInfo
+		old     bool // if the old keypair should be chosen
+	}{
+		{"new keypair", 60, both, false},
+		{"old keypair in overlap", 60, ecdsaOnly, true},
+		{"no overlap", 0, ecdsaOnly, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.CertOver = tt.overlap
+			setTestConf(t, c)
+			if err := LoadCert("ssl/server.crt", "ssl/server.key"); err != nil {
+				t.Fatal(err)
+			}
+			if err := LoadCert(edCrt, edKey); err != nil {
+				t.Fatal(err)
+			}
+			pair := certs.Load().(*certPair)
+
+			got, err := getCert(tt.hello)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := pair.cur
+			if tt.old {
+				want = pair.old
+			}
+			if got != want {
+				t.Errorf("getCert() chose the old keypair = %v, want %v", got == pair.old, tt.old)
+			}
+		})
+	}
+}
+
+func TestLoadCertConcurrent(t *testing.T) {
+	restoreCerts(t)
+	setTestConf(t, &Conf{})
+	if err := LoadCert("ssl/server.crt", "ssl/server.key"); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: getCert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				c.(*tls.Conn).Handshake()
+				c.Close()
+			}(c)
+		}
+	}()
+
+	// Keypairs are swapped while handshakes are running, and every handshake must still succeed.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if err := LoadCert("ssl/server.crt", "ssl/server.key"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+			if err != nil {
+				t.Error("handshake failed during reload:", err)
+				return
+			}
+			c.Close()
+		}()
+	}
+	wg.Wait()
+	<-done
+}
+
+func TestLoadCertMissing(t *testing.T) {
+	restoreCerts(t)
+	setTestConf(t, &Conf{})
+	if err := LoadCert("ssl/server.crt", "ssl/server.key"); err != nil {
+		t.Fatal(err)
+	}
+	prev := certs.Load()
+
+	if err := LoadCert(filepath.Join(t.TempDir(), "missing.crt"), "ssl/server.key"); err == nil {
+		t.Fatal("LoadCert() with a missing certificate succeeded")
+	}
+	if certs.Load() != prev {
+		t.Error("failed LoadCert() replaced the keypair in use")
+	}
+}
+
+func TestLoadALPN(t *testing.T) {
+	prev := tlsc.NextProtos
+	t.Cleanup(func() { tlsc.NextProtos = prev })
+
+	tests := []struct {
+		name string
+		alpn []string
+		ok   bool
+		want []string
+	}{
+		{"default", nil, true, []string{"h2", "http/1.1"}},
+		{"custom protocol", []string{"acme-tls/1", "http/1.1"}, true, []string{"acme-tls/1", "http/1.1"}},
+		{"reordered", []string{"http/1.1", "h2"}, true, []string{"http/1.1", "h2"}},
+		{"no http protocol", []string{"acme-tls/1"}, false, []string{"h2", "http/1.1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsc.NextProtos = []string{"h2", "http/1.1"}
+			c := &Conf{}
+			c.Adv.ALPN = tt.alpn
+			c.HostTLS = append(c.HostTLS, struct {
+				Host    string   `json:"host"`
+				Min     string   `json:"minVersion"`
+				Ciphers []string `json:"ciphers"`
+				CA      string   `json:"clientCA"`
+				Auth    string   `json:"clientAuth"`
+			}{Host: "example.com"})
+			setTestConf(t, c)
+
+			if ok := loadALPN(); ok != tt.ok {
+				t.Errorf("loadALPN() = %v, want %v", ok, tt.ok)
+			}
+			if !reflect.DeepEqual(tlsc.NextProtos, tt.want) {
+				t.Errorf("NextProtos = %q, want %q", tlsc.NextProtos, tt.want)
+			}
+
+			hosts, err := buildHostTLS(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := hosts["example.com"].NextProtos; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("host NextProtos = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostTLS(t *testing.T) {
+	restoreCerts(t)
+	if err := LoadCert("ssl/server.crt", "ssl/server.key"); err != nil {
+		t.Fatal(err)
+	}
+	prev, _ := hostTLS.Load().(map[string]*tls.Config)
+	t.Cleanup(func() { hostTLS.Store(prev) })
+	loadTestConf(t, `{"hostTLS":[{"host":"Modern.test","minVersion":"1.3"},{"host":"legacy.test","minVersion":"1.2","ciphers":["TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"]}]}`)
+	if err := LoadHostTLS(); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c.(*tls.Conn).Handshake()
+				c.Close()
+			}()
+		}
+	}()
+
+	tests := []struct {
+		name, host string
+		max        uint16
+		ok         bool
+		cipher     uint16
+	}{
+		{"tls 1.3 host with tls 1.3", "modern.test", tls.VersionTLS13, true, 0},
+		{"tls 1.3 host with tls 1.2", "modern.test", tls.VersionTLS12, false, 0},
+		{"tls 1.2 host with tls 1.2", "legacy.test", tls.VersionTLS12, true, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		{"tls 1.2 host with tls 1.3", "legacy.test", tls.VersionTLS13, true, 0},
+		{"default host with tls 1.2", "other.test", tls.VersionTLS12, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: tt.host, InsecureSkipVerify: true, MaxVersion: tt.max})
+			if !tt.ok {
+				if err == nil {
+					c.Close()
+					t.Fatal("handshake succeeded, want it to be refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			state := c.ConnectionState()
+			if state.Version != tt.max {
+				t.Errorf("version = %x, want %x", state.Version, tt.max)
+			}
+			if tt.cipher != 0 && state.CipherSuite != tt.cipher {
+				t.Errorf("cipher suite = %s, want %s", tls.CipherSuiteName(state.CipherSuite), tls.CipherSuiteName(tt.cipher))
+			}
+		})
+	}
+}
+
+func TestBuildHostTLS(t *testing.T) {
+	tests := []struct {
+		name, data, want string
+	}{
+		{"valid", `{"host":"example.com","minVersion":"1.3"}`, ""},
+		{"unknown version", `{"host":"example.com","minVersion":"1.4"}`, "unknown TLS version 1.4"},
+		{"unknown cipher", `{"host":"example.com","ciphers":["TLS_FAKE"]}`, "unknown cipher suite TLS_FAKE"},
+		{"unknown client auth", `{"host":"example.com","clientAuth":"maybe"}`, "unknown client auth mode maybe"},
+		{"client auth without ca", `{"host":"example.com","clientAuth":"require"}`, "no client CA bundle for example.com"},
+		{"client auth", `{"host":"example.com","clientAuth":"verify","clientCA":"CA"}`, ""},
+		{"client ca without certificates", `{"host":"example.com","clientAuth":"verify","clientCA":"EMPTY"}`, "no certificates found in client CA bundle EMPTY"},
+	}
+
+	dir := t.TempDir()
+	ca, _ := writeEd25519Cert(t, dir)
+	empty := writeFile(t, dir, "empty.pem", []byte("not a certificate"))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.data = strings.NewReplacer(`"CA"`, `"`+ca+`"`, `"EMPTY"`, `"`+empty+`"`).Replace(tt.data)
+			tt.want = strings.Replace(tt.want, "EMPTY", empty, 1)
+			c := loadTestConf(t, `{"hostTLS":[`+tt.data+`]}`)
+			_, err := buildHostTLS(c)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("buildHostTLS() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("buildHostTLS() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	restoreCerts(t)
+	if err := LoadCert("ssl/server.crt", "ssl/server.key"); err != nil {
+		t.Fatal(err)
+	}
+	prev, _ := hostTLS.Load().(map[string]*tls.Config)
+	t.Cleanup(func() { hostTLS.Store(prev) })
+
+	dir := t.TempDir()
+	crt, key := writeEd25519Cert(t, dir)
+	loadTestConf(t, `{"hostTLS":[{"host":"require.test","clientAuth":"require","clientCA":"`+crt+`"},
+		{"host":"verify.test","clientAuth":"verify","clientCA":"`+crt+`"},{"host":"none.test"}]}`)
+	if err := LoadHostTLS(); err != nil {
+		t.Fatal(err)
+	}
+	client, err := tls.LoadX509KeyPair(crt, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if misdirectedAuth(r) {
+			w.WriteHeader(http.StatusMisdirectedRequest)
+			return
+		}
+		w.Write([]byte(clientSubject(r) + "|" + strings.Fields(logNCSA(r, http.StatusOK, "/", "html", "common"))[2]))
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	tests := []struct {
+		name, sni, host string
+		cert            bool
+		ok              bool
+		code            int
+		want            string
+	}{
+		{"required with certificate", "require.test", "require.test", true, true, 200, "CN=localhost|localhost"},
+		{"required without certificate", "require.test", "require.test", false, false, 0, ""},
+		{"optional with certificate", "verify.test", "verify.test", true, true, 200, "CN=localhost|localhost"},
+		{"optional without certificate", "verify.test", "verify.test", false, true, 200, "|-"},
+		{"not requested", "none.test", "none.test", true, true, 200, "|-"},
+		{"sni without client auth", "none.test", "require.test", true, true, 421, ""},
+		{"sni with optional client auth", "verify.test", "require.test", true, true, 421, ""},
+		{"optional host from other sni", "none.test", "verify.test", true, true, 421, ""},
+		{"host with port", "require.test", "require.test:443", true, true, 200, "CN=localhost|localhost"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &tls.Config{ServerName: tt.sni, InsecureSkipVerify: true}
+			if tt.cert {
+				cfg.Certificates = []tls.Certificate{client}
+			}
+			hc := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+			defer hc.CloseIdleConnections()
+
+			req, _ := http.NewRequest("GET", "https://"+ln.Addr().String()+"/", nil)
+			req.Host = tt.host
+			resp, err := hc.Do(req)
+			if !tt.ok {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("request succeeded, want the handshake to be refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.code {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.code)
+			}
+			if string(body) != tt.want {
+				t.Errorf("subject and logged user = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestMisdirectedAuth(t *testing.T) {
+	prev, _ := hostTLS.Load().(map[string]*tls.Config)
+	t.Cleanup(func() { hostTLS.Store(prev) })
+	hostTLS.Store(map[string]*tls.Config{
+		"require.test": {ClientAuth: tls.RequireAndVerifyClientCert},
+		"verify.test":  {ClientAuth: tls.VerifyClientCertIfGiven},
+		"none.test":    {},
+	})
+	cert := [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "alice"}}}}
+
+	tests := []struct {
+		name, host string
+		state      *tls.ConnectionState
+		code       int
+	}{
+		{"verified", "require.test", &tls.ConnectionState{ServerName: "require.test", VerifiedChains: cert}, 200},
+		{"sni case", "Require.Test", &tls.ConnectionState{ServerName: "require.test", VerifiedChains: cert}, 200},
+		{"sni mismatch", "require.test", &tls.ConnectionState{ServerName: "none.test", VerifiedChains: cert}, 421},
+		{"no sni", "require.test", &tls.ConnectionState{VerifiedChains: cert}, 421},
+		{"no verified certificate", "require.test", &tls.ConnectionState{ServerName: "require.test"}, 421},
+		{"plain http", "require.test", nil, 421},
+		{"optional without certificate", "verify.test", &tls.ConnectionState{ServerName: "verify.test"}, 200},
+		{"optional sni mismatch", "verify.test", &tls.ConnectionState{ServerName: "none.test"}, 421},
+		{"no client auth", "none.test", &tls.ConnectionState{ServerName: "other.test"}, 200},
+		{"unconfigured host", "localhost", nil, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConf(t, baseConf())
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Host, r.TLS = tt.host, tt.state
+			w := httptest.NewRecorder()
+			mainHandle(w, r)
+			if w.Code != tt.code {
+				t.Errorf("status = %d, want %d", w.Code, tt.code)
+			}
+		})
+	}
+}
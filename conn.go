@@ -0,0 +1,315 @@
+// KatWeb by kittyhacker101 - Connection Management
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// hostSems contains a semaphore for each host, limiting the amount of concurrent requests to it.
+	hostSems sync.Map
+
+	// draining is set while the server is shutting down, and waiting for in-flight requests to finish.
+	draining   int32
+	activeReqs int64
+
+	// ready is set once the server is accepting connections, and cleared when it starts shutting down.
+	ready int32
+
+	// idleConns contains the idle keep-alive connections of each client IP, oldest first.
+	idleMu    sync.Mutex
+	idleConns = make(map[string][]net.Conn)
+)
+
+// connKey is the context key for the request counter of a connection.
+type connKey struct{}
+
+// connContext adds a request counter to the context of each connection.
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, new(uint64))
+}
+
+// connState tracks the state changes of connections, for the status endpoint and the idle connection limit.
+func connState(c net.Conn, state http.ConnState) {
+	trackConn(c, state)
+	limitIdle(c, state)
+}
+
+// limitIdle keeps track of the idle connections of each client IP.
+// When a client has more idle connections than the configured limit, it's oldest idle connection is closed.
+func limitIdle(c net.Conn, state http.ConnState) {
+	if conf().Adv.MaxIdle <= 0 {
+		return
+	}
+	ip, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+
+	idleMu.Lock()
+	defer idleMu.Unlock()
+
+	list := idleConns[ip]
+	for i, ic := range list {
+		if ic == c {
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if state == http.StateIdle {
+		list = append(list, c)
+		if len(list) > conf().Adv.MaxIdle {
+			list[0].Close()
+			list = list[1:]
+		}
+	}
+
+	if len(list) == 0 {
+		delete(idleConns, ip)
+		return
+	}
+	idleConns[ip] = list
+}
+
+// limitConn wraps a http.Handler, closing keep-alive connections after they have served the configured amount of requests.
+func limitConn(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conf().Adv.MaxReqs > 0 && r.ProtoMajor == 1 {
+			if n, ok := r.Context().Value(connKey{}).(*uint64); ok && atomic.AddUint64(n, 1) >= uint64(conf().Adv.MaxReqs) {
+				w.Header().Set("Connection", "close")
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// acquireHost tries to start a request for a host, returning false if the host is at it's concurrency limit.
+// The host's semaphore is returned, so the request is released from the same semaphore even if the limit is changed by a config reload.
+func acquireHost(label string) (chan struct{}, bool) {
+	limit := conf().Adv.HostLimit
+	val, ok := hostSems.Load(label)
+	if !ok {
+		val, _ = hostSems.LoadOrStore(label, make(chan struct{}, limit))
+	}
+	if cap(val.(chan struct{})) != limit {
+		// Requests already running under the old limit keep their own semaphore, so they don't count against the new one.
+		if next := make(chan struct{}, limit); hostSems.CompareAndSwap(label, val, next) {
+			val = next
+		} else {
+			val, _ = hostSems.Load(label)
+		}
+	}
+
+	sem := val.(chan struct{})
+	select {
+	case sem <- struct{}{}:
+		return sem, true
+	default:
+		return nil, false
+	}
+}
+
+// listenAddrs returns the addresses a server should listen on for a port.
+// If no bind addresses are configured, the server listens on all interfaces.
+func listenAddrs(port int) []string {
+	if len(conf().Adv.Bind) == 0 {
+		return []string{":" + strconv.Itoa(port)}
+	}
+
+	addrs := make([]string, len(conf().Adv.Bind))
+	for i, b := range conf().Adv.Bind {
+		addrs[i] = net.JoinHostPort(strings.Trim(b, "[]"), strconv.Itoa(port))
+	}
+	return addrs
+}
+
+// serveAll serves a http.Server on each of the given addresses, sending any errors to errc.
+func serveAll(srv *http.Server, addrs []string, secure bool, errc chan<- error) {
+	// A keep-alive period of zero uses the default period, and a negative period disables keep-alives.
+	lc := net.ListenConfig{KeepAlive: time.Duration(conf().Adv.KeepAlive) * time.Second}
+	for _, addr := range addrs {
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			errc <- err
+			continue
+		}
+
+		go func(ln net.Listener) {
+			if secure && conf().Adv.MaxHandshakes > 0 {
+				errc <- srv.Serve(newHandshakeListener(ln, srv))
+				return
+			}
+			if secure {
+				errc <- srv.ServeTLS(ln, "", "")
+				return
+			}
+			errc <- srv.Serve(ln)
+		}(ln)
+	}
+}
+
+// handshakeQueue is how many connections can wait for each handshake slot. Connections past the limit are closed immediately.
+const handshakeQueue = 4
+
+// handshakeListener is a net.Listener which completes TLS handshakes before connections are accepted, limiting how many can run at once.
+// Connections wait in a queue for a free slot, and are closed if they can't finish their handshake before the timeout.
+type handshakeListener struct {
+	net.Listener
+	srv     *http.Server
+	cfg     *tls.Config
+	timeout time.Duration
+	sem     chan struct{}
+	queue   chan struct{}
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+	err     error
+}
+
+// newHandshakeListener wraps a listener, using the TLS config and handshake timeout of a http.Server.
+// The server's TLS config is read for every handshake, so reloaded certificates and TLS settings are used by new connections.
+func newHandshakeListener(ln net.Listener, srv *http.Server) *handshakeListener {
+	timeout := srv.ReadHeaderTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	h := &handshakeListener{
+		Listener: ln,
+		srv:      srv,
+		timeout:  timeout,
+		sem:      make(chan struct{}, conf().Adv.MaxHandshakes),
+		queue:    make(chan struct{}, conf().Adv.MaxHandshakes*(1+handshakeQueue)),
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	h.cfg = &tls.Config{GetConfigForClient: h.configForClient}
+	go h.acceptLoop()
+	return h
+}
+
+// configForClient returns the server's current TLS config for a handshake, including any per-host config.
+func (h *handshakeListener) configForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	cfg := h.srv.TLSConfig
+	if cfg.GetConfigForClient != nil {
+		hc, err := cfg.GetConfigForClient(hello)
+		if err != nil {
+			return nil, err
+		}
+		if hc != nil {
+			cfg = hc
+		}
+	}
+
+	if len(cfg.NextProtos) == 0 {
+		cfg = cfg.Clone()
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return cfg, nil
+}
+
+// acceptLoop accepts raw connections, starting a handshake for each of them.
+// Connections are closed without a handshake if the queue is full, so a flood of connections can't start an unbounded number of goroutines.
+func (h *handshakeListener) acceptLoop() {
+	for {
+		c, err := h.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			h.shutdown(err)
+			return
+		}
+
+		select {
+		case h.queue <- struct{}{}:
+			go h.handshake(c)
+		default:
+			c.Close()
+		}
+	}
+}
+
+// handshake waits for a free handshake slot, then completes the TLS handshake of a connection and queues it to be accepted.
+func (h *handshakeListener) handshake(c net.Conn) {
+	defer func() { <-h.queue }()
+	deadline := time.Now().Add(h.timeout)
+	timer := time.NewTimer(h.timeout)
+	defer timer.Stop()
+
+	select {
+	case h.sem <- struct{}{}:
+	case <-timer.C:
+		c.Close()
+		return
+	case <-h.done:
+		c.Close()
+		return
+	}
+
+	tc := tls.Server(c, h.cfg)
+	tc.SetDeadline(deadline)
+	err := tc.Handshake()
+	<-h.sem
+	if err != nil {
+		tc.Close()
+		return
+	}
+	tc.SetDeadline(time.Time{})
+
+	select {
+	case h.conns <- tc:
+	case <-h.done:
+		tc.Close()
+	}
+}
+
+// Accept returns the next connection which has completed it's handshake.
+func (h *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-h.conns:
+		return c, nil
+	case <-h.done:
+		return nil, h.err
+	}
+}
+
+// Close stops accepting connections, and closes any connections waiting to be accepted.
+func (h *handshakeListener) Close() error {
+	return h.shutdown(net.ErrClosed)
+}
+
+// shutdown closes the listener, with the error which will be returned by future calls to Accept.
+func (h *handshakeListener) shutdown(reason error) error {
+	var err error
+	h.once.Do(func() {
+		h.err = reason
+		close(h.done)
+		err = h.Listener.Close()
+	})
+	return err
+}
+
+// drain rejects new requests while waiting for in-flight requests to finish, for up to the configured drain time.
+func drain() {
+	atomic.StoreInt32(&ready, 0)
+	if conf().Adv.Drain <= 0 {
+		return
+	}
+	atomic.StoreInt32(&draining, 1)
+
+	deadline := time.Now().Add(time.Duration(conf().Adv.Drain) * time.Second)
+	for atomic.LoadInt64(&activeReqs) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
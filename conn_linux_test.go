@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeAllKeepAlive(t *testing.T) {
+	tests := []struct {
+		name      string
+		keepAlive int
+		enabled   bool
+		idle      int
+	}{
+		{"default period", 0, true, 15},
+		{"custom period", 30, true, 30},
+		{"disabled", -1, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.KeepAlive = tt.keepAlive
+			setTestConf(t, c)
+
+			free, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := free.Addr().String()
+			free.Close()
+
+			// The socket options are read from the server's side of each accepted connection.
+			opts := make(chan [2]int, 1)
+			srv := &http.Server{
+				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+				ConnState: func(conn net.Conn, state http.ConnState) {
+					if state != http.StateNew {
+						return
+					}
+					raw, err := conn.(*net.TCPConn).SyscallConn()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					raw.Control(func(fd uintptr) {
+						on, _ := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+						idle, _ := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+						opts <- [2]int{on, idle}
+					})
+				},
+			}
+			errc := make(chan error, 1)
+			serveAll(srv, []string{addr}, false, errc)
+			defer srv.Close()
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+
+			select {
+			case o := <-opts:
+				if (o[0] != 0) != tt.enabled {
+					t.Errorf("SO_KEEPALIVE = %d, want enabled %v", o[0], tt.enabled)
+				}
+				if tt.enabled && o[1] != tt.idle {
+					t.Errorf("TCP_KEEPIDLE = %d, want %d", o[1], tt.idle)
+				}
+			case err := <-errc:
+				t.Fatal(err)
+			case <-time.After(2 * time.Second):
+				t.Fatal("no connection was accepted")
+			}
+		})
+	}
+}
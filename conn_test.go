@@ -0,0 +1,501 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testHandshakeListener creates a handshakeListener on a local port, closing it at the end of the test.
+func testHandshakeListener(t *testing.T, srv *http.Server, max int) *handshakeListener {
+	t.Helper()
+	c := &Conf{}
+	c.Adv.MaxHandshakes = max
+	setTestConf(t, c)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHandshakeListener(ln, srv)
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestHandshakeListenerConfig(t *testing.T) {
+	site, err := tls.LoadX509KeyPair("ssl/server.crt", "ssl/server.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := httptest.NewTLSServer(http.NotFoundHandler())
+	defer other.Close()
+	reloaded := other.TLS.Certificates[0]
+
+	tests := []struct {
+		name      string
+		protos    []string // NextProtos of the server's TLS config
+		reload    bool     // if the certificate is replaced after the listener is created
+		perHost   bool     // if a per-host config is returned for the client
+		offer     []string
+		wantProto string
+	}{
+		{"default protocols", nil, false, false, []string{"h2", "http/1.1"}, "h2"},
+		{"configured protocols", []string{"http/1.1"}, false, false, []string{"h2", "http/1.1"}, "http/1.1"},
+		{"reloaded certificate", nil, true, false, []string{"http/1.1"}, "http/1.1"},
+		{"per-host config", nil, false, true, []string{"http/1.1"}, "http/1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &http.Server{TLSConfig: &tls.Config{Certificates: []tls.Certificate{site}, NextProtos: tt.protos}}
+			if tt.perHost {
+				srv.TLSConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+					return &tls.Config{Certificates: []tls.Certificate{reloaded}}, nil
+				}
+			}
+			h := testHandshakeListener(t, srv, 1)
+			if tt.reload {
+				srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{reloaded}}
+			}
+
+			go func() {
+				if c, err := h.Accept(); err == nil {
+					c.Close()
+				}
+			}()
+			c, err := tls.Dial("tcp", h.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: tt.offer})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			state := c.ConnectionState()
+			if state.NegotiatedProtocol != tt.wantProto {
+				t.Errorf("negotiated protocol = %q, want %q", state.NegotiatedProtocol, tt.wantProto)
+			}
+			want := site.Certificate[0]
+			if tt.reload || tt.perHost {
+				want = reloaded.Certificate[0]
+			}
+			if got := state.PeerCertificates[0].Raw; string(got) != string(want) {
+				t.Error("server used the wrong certificate")
+			}
+		})
+	}
+}
+
+func TestHandshakeListenerQueue(t *testing.T) {
+	const max = 1
+	srv := &http.Server{TLSConfig: &tls.Config{}, ReadHeaderTimeout: time.Minute}
+	h := testHandshakeListener(t, srv, max)
+
+	// Idle connections never send a ClientHello, so they hold their place in the queue until the timeout.
+	var idle []net.Conn
+	for i := 0; i < max*(1+handshakeQueue); i++ {
+		c, err := net.Dial("tcp", h.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		idle = append(idle, c)
+	}
+
+	tests := []struct {
+		name   string
+		conn   func() net.Conn
+		closed bool
+	}{
+		{"queued connection", func() net.Conn { return idle[len(idle)-1] }, false},
+		{"queue full", func() net.Conn {
+			// The accept loop handles connections in order, so the queue is full once every idle connection is queued.
+			for len(h.queue) < cap(h.queue) {
+				time.Sleep(time.Millisecond)
+			}
+			c, err := net.Dial("tcp", h.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.conn()
+			c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, err := c.Read(make([]byte, 1))
+			if closed := err == io.EOF; closed != tt.closed {
+				t.Errorf("read error = %v, want connection closed %v", err, tt.closed)
+			}
+		})
+	}
+}
+
+func TestLimitConn(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		conns  int64
+		closed []bool
+	}{
+		{"no limit", 0, 1, []bool{false, false, false, false, false}},
+		{"one request", 1, 5, []bool{true, true, true, true, true}},
+		{"two requests", 2, 3, []bool{false, true, false, true, false}},
+		{"limit not reached", 10, 1, []bool{false, false, false, false, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.MaxReqs = tt.limit
+			setTestConf(t, c)
+
+			var conns int64
+			srv := httptest.NewUnstartedServer(limitConn(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+			srv.Config.ConnContext = connContext
+			srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					atomic.AddInt64(&conns, 1)
+				}
+			}
+			srv.Start()
+			defer srv.Close()
+
+			client := &http.Client{Transport: &http.Transport{}}
+			defer client.Transport.(*http.Transport).CloseIdleConnections()
+			for i, want := range tt.closed {
+				resp, err := client.Get(srv.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.Close != want {
+					t.Errorf("request %d closed connection = %v, want %v", i+1, resp.Close, want)
+				}
+			}
+
+			if got := atomic.LoadInt64(&conns); got != tt.conns {
+				t.Errorf("opened %d connections, want %d", got, tt.conns)
+			}
+		})
+	}
+}
+
+// idleTestConn is a net.Conn from a fixed remote address, which records when it is closed.
+type idleTestConn struct {
+	net.Conn
+	addr   net.Addr
+	closed bool
+}
+
+func (c *idleTestConn) RemoteAddr() net.Addr { return c.addr }
+func (c *idleTestConn) Close() error         { c.closed = true; return nil }
+
+func TestLimitIdle(t *testing.T) {
+	type event struct {
+		conn  int
+		state http.ConnState
+	}
+	tests := []struct {
+		name   string
+		limit  int
+		events []event
+		closed []bool
+	}{
+		{"under limit", 2, []event{{0, http.StateIdle}, {1, http.StateIdle}}, []bool{false, false, false}},
+		{"oldest closed", 1, []event{{0, http.StateIdle}, {1, http.StateIdle}}, []bool{true, false, false}},
+		{"active not counted", 1, []event{{0, http.StateIdle}, {0, http.StateActive}, {1, http.StateIdle}}, []bool{false, false, false}},
+		{"closed not counted", 1, []event{{0, http.StateIdle}, {0, http.StateClosed}, {1, http.StateIdle}}, []bool{false, false, false}},
+		{"idle again", 1, []event{{0, http.StateIdle}, {1, http.StateIdle}, {1, http.StateActive}, {1, http.StateIdle}}, []bool{true, false, false}},
+		{"separate clients", 1, []event{{0, http.StateIdle}, {2, http.StateIdle}}, []bool{false, false, false}},
+		{"disabled", 0, []event{{0, http.StateIdle}, {1, http.StateIdle}}, []bool{false, false, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.MaxIdle = tt.limit
+			setTestConf(t, c)
+			t.Cleanup(func() { idleConns = make(map[string][]net.Conn) })
+
+			conns := []*idleTestConn{
+				{addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1001}},
+				{addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1002}},
+				{addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1001}},
+			}
+			for _, e := range tt.events {
+				limitIdle(conns[e.conn], e.state)
+			}
+			for i, want := range tt.closed {
+				if conns[i].closed != want {
+					t.Errorf("connection %d closed = %v, want %v", i, conns[i].closed, want)
+				}
+			}
+
+			for _, e := range tt.events {
+				limitIdle(conns[e.conn], http.StateClosed)
+			}
+			if len(idleConns) != 0 {
+				t.Errorf("idle connections left after closing = %v", idleConns)
+			}
+		})
+	}
+}
+
+func TestHostLimit(t *testing.T) {
+	var (
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+	}))
+	defer backend.Close()
+
+	loadTestProxies(t, `{"documentRoot":"html","advanced":{"httpPort":80,"sslPort":443,"hostConcurrency":1},"proxy":[`+
+		`{"location":"a.test","host":"`+backend.URL+`"},{"location":"b.test","host":"`+backend.URL+`"}]}`)
+	if err := LoadProxyTransport(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		hostSems.Range(func(k, _ interface{}) bool {
+			hostSems.Delete(k)
+			return true
+		})
+	})
+
+	get := func(host, path string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		mainHandle(w, r)
+		return w.Code
+	}
+
+	done := make(chan int)
+	go func() { done <- get("a.test", "/slow") }()
+	select {
+	case <-started:
+	case code := <-done:
+		t.Fatalf("slow request finished with %d before reaching the backend", code)
+	}
+
+	tests := []struct {
+		name, host string
+		code       int
+	}{
+		{"busy host", "a.test", 503},
+		{"other host", "b.test", 200},
+		{"other host again", "b.test", 200},
+	}
+	for _, tt := range tests {
+		if code := get(tt.host, "/fast"); code != tt.code {
+			t.Errorf("%s: status = %d, want %d", tt.name, code, tt.code)
+		}
+	}
+
+	close(release)
+	if code := <-done; code != 200 {
+		t.Errorf("slow request status = %d, want 200", code)
+	}
+	if code := get("a.test", "/fast"); code != 200 {
+		t.Errorf("status after the slow request finished = %d, want 200", code)
+	}
+}
+
+func TestAcquireHostReload(t *testing.T) {
+	t.Cleanup(func() { hostSems.Delete("example.com") })
+
+	tests := []struct {
+		limit, held int
+		ok          bool
+	}{
+		{1, 0, true},
+		{1, 1, false},
+		{2, 0, true},
+		{2, 1, true},
+		{2, 2, false},
+	}
+
+	var held []chan struct{}
+	for _, tt := range tests {
+		c := &Conf{}
+		c.Adv.HostLimit = tt.limit
+		setTestConf(t, c)
+
+		sem, ok := acquireHost("example.com")
+		if ok != tt.ok {
+			t.Errorf("limit %d with %d running: acquireHost() = %v, want %v", tt.limit, tt.held, ok, tt.ok)
+		}
+		if ok {
+			held = append(held, sem)
+		}
+	}
+
+	// Requests started under the old limit are released from the semaphore they were acquired from.
+	for _, sem := range held {
+		<-sem
+	}
+	if sem, ok := acquireHost("example.com"); !ok {
+		t.Error("acquireHost() failed after every request was released")
+	} else {
+		<-sem
+	}
+}
+
+func TestListenAddrs(t *testing.T) {
+	tests := []struct {
+		name string
+		bind []string
+		want []string
+	}{
+		{"all interfaces", nil, []string{":8080"}},
+		{"ipv4", []string{"127.0.0.1"}, []string{"127.0.0.1:8080"}},
+		{"ipv6", []string{"::1", "[fe80::1]"}, []string{"[::1]:8080", "[fe80::1]:8080"}},
+		{"mixed", []string{"192.0.2.1", "::"}, []string{"192.0.2.1:8080", "[::]:8080"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.Bind = tt.bind
+			setTestConf(t, c)
+
+			if got := listenAddrs(8080); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listenAddrs(8080) = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeAll(t *testing.T) {
+	setTestConf(t, &Conf{})
+
+	// One address is free, and the other is already in use, so only the first can be served.
+	used, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := free.Addr().String()
+	free.Close()
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "served")
+	})}
+	errc := make(chan error, 2)
+	serveAll(srv, []string{addr, used.Addr().String()}, false, errc)
+
+	select {
+	case err := <-errc:
+		if err == nil || err == http.ErrServerClosed {
+			t.Fatalf("error = %v, want a listen error for the address in use", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no error for the address in use")
+	}
+
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "served" {
+		t.Errorf("body = %q, want served", body)
+	}
+
+	srv.Close()
+	select {
+	case err := <-errc:
+		if err != http.ErrServerClosed {
+			t.Errorf("error = %v, want http.ErrServerClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("server did not stop")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name      string
+		drainTime int
+		finish    bool // if the in-flight request finishes during the drain
+		rejects   bool
+		min, max  time.Duration
+	}{
+		{"request finishes", 2, true, true, 0, time.Second},
+		{"drain time runs out", 1, false, true, time.Second, 2 * time.Second},
+		{"disabled", 0, false, false, 0, 50 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Adv.Drain = tt.drainTime
+			setTestConf(t, c)
+			t.Cleanup(func() {
+				atomic.StoreInt32(&draining, 0)
+				atomic.StoreInt64(&activeReqs, 0)
+			})
+
+			atomic.AddInt64(&activeReqs, 1)
+			start, done := time.Now(), make(chan struct{})
+			go func() {
+				drain()
+				close(done)
+			}()
+
+			if tt.rejects {
+				for atomic.LoadInt32(&draining) == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			} else {
+				<-done
+			}
+			w := httptest.NewRecorder()
+			mainHandle(w, httptest.NewRequest("GET", "/", nil))
+			if tt.rejects {
+				if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != strconv.Itoa(tt.drainTime) || w.Header().Get("Connection") != "close" {
+					t.Errorf("response = %d %v, want 503 with Retry-After and Connection: close", w.Code, w.Header())
+				}
+			} else if w.Code != http.StatusOK {
+				t.Errorf("status = %d, want 200 when not draining", w.Code)
+			}
+
+			if tt.finish {
+				time.Sleep(200 * time.Millisecond)
+				atomic.AddInt64(&activeReqs, -1)
+			}
+			<-done
+			if d := time.Since(start); d < tt.min || d > tt.max {
+				t.Errorf("drain took %v, want between %v and %v", d, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestDrainClearsReady(t *testing.T) {
+	setTestConf(t, &Conf{})
+	atomic.StoreInt32(&ready, 1)
+	drain()
+	if atomic.LoadInt32(&ready) != 0 {
+		atomic.StoreInt32(&ready, 0)
+		t.Error("the server is still ready after shutdown started")
+	}
+}
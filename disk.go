@@ -0,0 +1,64 @@
+// KatWeb by kittyhacker101 - Free Disk Space Checking
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// diskFree returns the amount of free bytes on the volume containing a path.
+	diskFree = statDisk
+	lowDisk  int32
+)
+
+// checkDisk checks if the free space on the document root's volume is below the configured threshold.
+// A warning is printed when the free space falls below the threshold, and when it recovers.
+func checkDisk() {
+	free, err := diskFree(conf().Root)
+	if err != nil {
+		return
+	}
+
+	if free < uint64(conf().Adv.MinDisk)*1000000 {
+		if atomic.SwapInt32(&lowDisk, 1) == 0 {
+			Print("[Warn] : Free disk space is low (" + strconv.FormatUint(free/1000000, 10) + "mb available)!")
+		}
+	} else if atomic.SwapInt32(&lowDisk, 0) == 1 {
+		Print("[Info] : Free disk space has recovered.")
+	}
+}
+
+// StartDiskCheck checks the free disk space on startup, and then periodically.
+func StartDiskCheck() {
+	if conf().Adv.MinDisk <= 0 {
+		return
+	}
+	if _, err := diskFree(conf().Root); err != nil {
+		Print("[Warn] : Unable to check free disk space!")
+		return
+	}
+
+	checkDisk()
+	go func() {
+		for range time.Tick(time.Minute) {
+			checkDisk()
+		}
+	}()
+}
+
+// refuseWrite checks if a request should be refused because free disk space is low.
+// Only requests which may write data are refused.
+func refuseWrite(r *http.Request) bool {
+	if !conf().Adv.DiskRefuse || atomic.LoadInt32(&lowDisk) == 0 {
+		return false
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,13 @@
+// KatWeb by kittyhacker101 - Free Disk Space Checking (Unsupported Platforms)
+
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import "errors"
+
+// statDisk is not supported on this platform, and always returns an error.
+func statDisk(path string) (uint64, error) {
+	return 0, errors.New("checking free disk space is not supported on this platform")
+}
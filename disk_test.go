@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCheckDisk(t *testing.T) {
+	tests := []struct {
+		name string
+		free []uint64
+		low  []bool
+		msgs []string
+	}{
+		{"plenty of space", []uint64{500e6, 400e6}, []bool{false, false}, []string{"", ""}},
+		{"below threshold", []uint64{50e6, 40e6}, []bool{true, true}, []string{"Free disk space is low (50mb available)", ""}},
+		{"recovers", []uint64{50e6, 200e6}, []bool{true, false}, []string{"Free disk space is low", "Free disk space has recovered"}},
+		{"at threshold", []uint64{100e6}, []bool{false}, []string{""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.MinDisk = 100
+			setTestConf(t, c)
+			prev := diskFree
+			t.Cleanup(func() {
+				diskFree = prev
+				atomic.StoreInt32(&lowDisk, 0)
+			})
+
+			for i, free := range tt.free {
+				free := free
+				diskFree = func(string) (uint64, error) { return free, nil }
+				out := captureOutput(t, checkDisk)
+
+				if low := atomic.LoadInt32(&lowDisk) == 1; low != tt.low[i] {
+					t.Errorf("check %d: low = %v, want %v", i+1, low, tt.low[i])
+				}
+				if (tt.msgs[i] == "") != (out == "") || !strings.Contains(out, tt.msgs[i]) {
+					t.Errorf("check %d: printed %q, want %q", i+1, out, tt.msgs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCheckDiskError(t *testing.T) {
+	c := &Conf{}
+	c.Adv.MinDisk = 100
+	setTestConf(t, c)
+	prev := diskFree
+	t.Cleanup(func() { diskFree = prev })
+	diskFree = func(string) (uint64, error) { return 0, errors.New("unsupported") }
+
+	if out := captureOutput(t, StartDiskCheck); !strings.Contains(out, "Unable to check free disk space") {
+		t.Errorf("printed %q, want a warning", out)
+	}
+	if atomic.LoadInt32(&lowDisk) != 0 {
+		t.Error("disk space is low after a failed check")
+	}
+}
+
+func TestRefuseWrite(t *testing.T) {
+	tests := []struct {
+		name, method string
+		refuse, low  bool
+		code         int
+	}{
+		{"post with low disk", "POST", true, true, 503},
+		{"put with low disk", "PUT", true, true, 503},
+		{"get with low disk", "GET", true, true, 200},
+		{"head with low disk", "HEAD", true, true, 200},
+		{"post with enough disk", "POST", true, false, 200},
+		{"refusing disabled", "POST", false, true, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Adv.MinDisk, c.Adv.DiskRefuse = 100, tt.refuse
+			setTestConf(t, c)
+			if tt.low {
+				atomic.StoreInt32(&lowDisk, 1)
+				defer atomic.StoreInt32(&lowDisk, 0)
+			}
+
+			w := httptest.NewRecorder()
+			mainHandle(w, httptest.NewRequest(tt.method, "/", nil))
+			if w.Code != tt.code {
+				t.Errorf("status = %d, want %d", w.Code, tt.code)
+			}
+			if got := w.Header().Get("Retry-After"); (tt.code == 503) != (got == "60") {
+				t.Errorf("Retry-After = %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,18 @@
+// KatWeb by kittyhacker101 - Free Disk Space Checking (Unix)
+
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import "syscall"
+
+// statDisk returns the amount of free bytes on the volume containing a path.
+func statDisk(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,17 @@
+module github.com/kittyhacker101/KatWeb
+
+go 1.26.0
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/ghodss/yaml v1.0.0
+	github.com/klauspost/compress v1.20.1
+	golang.org/x/crypto v0.57.0
+	golang.org/x/net v0.58.0
+	golang.org/x/sync v0.23.0
+)
+
+require (
+	golang.org/x/text v0.42.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+)
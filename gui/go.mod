@@ -0,0 +1,3 @@
+module github.com/kittyhacker101/KatWeb/gui
+
+go 1.21
@@ -2,18 +2,24 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/publicsuffix"
 )
 
 const typeProxy = "proxy%"
@@ -21,24 +27,33 @@ const typeProxy = "proxy%"
 var (
 	// httpsredir is a http.HandlerFunc for redirecting HTTP requests to HTTPS
 	httpsredir = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		host := r.Host
-		if conf.Adv.HTTP != 80 {
-			host = strings.TrimSuffix(host, ":"+strconv.Itoa(conf.Adv.HTTP))
+		// OPTIONS * is about the server rather than a resource, so there is nothing to redirect it to.
+		if r.RequestURI == "*" {
+			mainHandle(w, r)
+			return
+		}
+
+		// The canonical host is used, so requests reach the canonical HTTPS URL with a single redirect.
+		host := canonicalHost(r.Host)
+		if conf().Adv.HTTP != 80 {
+			host = strings.TrimSuffix(host, ":"+strconv.Itoa(conf().Adv.HTTP))
 		}
-		if conf.Adv.HTTPS != 443 {
-			host = host + ":" + strconv.Itoa(conf.Adv.HTTPS)
+		if conf().Adv.HTTPS != 443 {
+			host = host + ":" + strconv.Itoa(conf().Adv.HTTPS)
 		}
 
-		redir(w, "https://"+host+r.URL.EscapedPath())
+		redir(w, "https://"+host+r.URL.RequestURI())
 		logr(r, "WebHSTS", "", r.URL.EscapedPath())
 	})
 
 	// Logger is a custom logger for net/http and httputil
-	Logger = log.New(os.Stderr, "[Error] : ", 0)
+	Logger = log.New(cleanWriter{os.Stderr}, "[Error] : ", 0)
 
 	// tlsc provides an TLS configuration for use with http.Server
 	tlsc = &tls.Config{
 		NextProtos:               []string{"h2", "http/1.1"},
+		GetCertificate:           getCert,
+		GetConfigForClient:       getHostTLS,
 		PreferServerCipherSuites: true,
 		CurvePreferences: []tls.CurveID{
 			tls.X25519,
@@ -67,7 +82,11 @@ func logNCSA(r *http.Request, status int, url, host, format string) string {
 
 	ip := strings.Trim(trimPort(r.RemoteAddr), "[]")
 
+	// Clients without a login are identified by their certificate's common name, if they sent one.
 	user, _, _ := r.BasicAuth()
+	if c := clientCert(r); user == "" && c != nil {
+		user = strings.Replace(c.Subject.CommonName, " ", "_", -1)
+	}
 	if user == "" || status != http.StatusOK {
 		user = "-"
 	}
@@ -82,7 +101,7 @@ func logNCSA(r *http.Request, status int, url, host, format string) string {
 			size = strconv.Itoa(int(fi.Size()))
 		}
 
-		if size != "-" && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") && !conf.Adv.Dev {
+		if size != "-" && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") && !conf().Adv.Dev {
 			fi, err := os.Stat(host + urld + ".gz")
 			if err == nil {
 				size = strconv.Itoa(int(fi.Size()))
@@ -97,51 +116,81 @@ func logNCSA(r *http.Request, status int, url, host, format string) string {
 		}
 	}
 
+	url, user = cleanLog(url), cleanLog(user)
 	if format == "common" {
-		return ip + " - " + user + " [" + time.Now().Format("02/Jan/2006:15:04:05 -0700") + `] "` + r.Method + " " + url + " " + r.Proto + `" ` + strconv.Itoa(status) + " " + size
+		return ip + " - " + user + " [" + logTime() + `] "` + r.Method + " " + url + " " + r.Proto + `" ` + strconv.Itoa(status) + " " + size
 	}
 
-	vhost := trimPort(r.Host)
+	vhost := cleanLog(trimPort(r.Host))
 	if vhost == "" {
 		vhost = "-"
 	}
 
 	if format == "commonvhost" {
-		return vhost + " " + ip + " - " + user + " [" + time.Now().Format("02/Jan/2006:15:04:05 -0700") + `] "` + r.Method + " " + url + " " + r.Proto + `" ` + strconv.Itoa(status) + " " + size
+		return vhost + " " + ip + " - " + user + " [" + logTime() + `] "` + r.Method + " " + url + " " + r.Proto + `" ` + strconv.Itoa(status) + " " + size
 	}
 
-	refer := `"` + r.Header.Get("Referer") + `"`
-	if refer == `""` {
-		refer = "-"
+	referer := r.Header.Get("Referer")
+	if conf().Adv.NoQuery {
+		if i := strings.IndexAny(referer, "?#"); i != -1 {
+			referer = referer[:i]
+		}
+	}
+	agent := r.Header.Get("User-agent")
+	if conf().Adv.NoRefUA {
+		referer, agent = "", ""
 	}
 
-	usra := `"` + r.Header.Get("User-agent") + `"`
-	if usra == `""` {
-		usra = "-"
+	// The fields are quoted, so quotes and control characters in them can't be used to forge log entries.
+	refer := "-"
+	if referer != "" {
+		refer = strconv.Quote(referer)
+	}
+	usra := "-"
+	if agent != "" {
+		usra = strconv.Quote(agent)
 	}
 
 	if format == "combined" {
-		return ip + " - " + user + " [" + time.Now().Format("02/Jan/2006:15:04:05 -0700") + `] "` + r.Method + " " + url + " " + r.Proto + `" ` + strconv.Itoa(status) + " " + size + " " + refer + " " + usra
+		return ip + " - " + user + " [" + logTime() + `] "` + r.Method + " " + url + " " + r.Proto + `" ` + strconv.Itoa(status) + " " + size + " " + refer + " " + usra
 	}
 
-	return vhost + " " + ip + " - " + user + " [" + time.Now().Format("02/Jan/2006:15:04:05 -0700") + `] "` + r.Method + " " + url + " " + r.Proto + `" ` + strconv.Itoa(status) + " " + size + " " + refer + " " + usra
+	return vhost + " " + ip + " - " + user + " [" + logTime() + `] "` + r.Method + " " + url + " " + r.Proto + `" ` + strconv.Itoa(status) + " " + size + " " + refer + " " + usra
 }
 
-// logr logs a request to the console.
+// logr logs a request to the console, and to any additional access logs.
 func logr(r *http.Request, head, host, url string) {
-	if !conf.Adv.Dev && *logt == "none" {
+	if head == "WebNotFound" {
+		n := atomic.AddUint64(&notFoundCount, 1)
+		if conf().Adv.NoLog404 && (conf().Adv.Sample404 <= 0 || n%uint64(conf().Adv.Sample404) != 0) {
+			return
+		}
+	}
+
+	for _, s := range logSinks {
+		if s.format != "none" {
+			writeSink(s, logLine(r, head, host, url, s.format))
+		}
+	}
+	if !conf().Adv.Dev && *logt == "none" {
 		return
 	}
+	PrintLog(logLine(r, head, host, url, *logt))
+}
 
-	switch *logt {
+// logLine formats a request as an access log entry, using the given log type.
+func logLine(r *http.Request, head, host, url, format string) string {
+	switch format {
 	case "common", "commonvhost", "combined", "combinedvhost":
 		status := 0
 		switch head {
 		case "WebHSTS", "WebRedir":
 			status = http.StatusMovedPermanently
+		case "WebRedirKeep":
+			status = http.StatusPermanentRedirect
 		case "WebBad":
 			status = http.StatusBadRequest
-		case "WebProxy", "Web":
+		case "WebProxy", "Web", "WebRoot":
 			status = http.StatusOK
 		case "WebForbid":
 			status = http.StatusForbidden
@@ -153,11 +202,47 @@ func logr(r *http.Request, head, host, url string) {
 			status = http.StatusInternalServerError
 		case "WebProxyError":
 			status = http.StatusBadGateway
+		case "WebProxyTimeout":
+			status = http.StatusGatewayTimeout
+		case "WebProxyTooLarge":
+			status = http.StatusRequestEntityTooLarge
+		case "WebVersion":
+			status = http.StatusHTTPVersionNotSupported
+		case "WebUnavail":
+			status = http.StatusServiceUnavailable
+		case "WebLong":
+			status = http.StatusRequestURITooLong
+		case "WebMisdirect":
+			status = http.StatusMisdirectedRequest
+		case "WebNotAccept":
+			status = http.StatusNotAcceptable
+		case "WebMethod":
+			status = http.StatusMethodNotAllowed
 		}
 
-		Print(logNCSA(r, status, url, host, *logt))
+		line := logNCSA(r, status, url, host, format)
+		if conf().Adv.LogTLS {
+			line += " " + tlsInfo(r)
+		}
+		if conf().Adv.Trace {
+			line += " " + traceID(r)
+		}
+		if conf().Adv.LogUpstream && strings.HasPrefix(head, "WebProxy") {
+			line += " " + upstreamInfo(r)
+		}
+		return line
 	default:
-		Print("[" + head + "][" + trimPort(r.Host) + url + "] : " + r.RemoteAddr)
+		line := "[" + head + "][" + cleanLog(trimPort(r.Host)+url) + "] : " + r.RemoteAddr
+		if conf().Adv.LogTLS && r.TLS != nil {
+			line += " (" + tlsInfo(r) + ")"
+		}
+		if conf().Adv.Trace {
+			line += " [" + traceID(r) + "]"
+		}
+		if conf().Adv.LogUpstream && strings.HasPrefix(head, "WebProxy") {
+			line += " (upstream " + upstreamInfo(r) + ")"
+		}
+		return line
 	}
 }
 
@@ -177,10 +262,56 @@ func redir(w http.ResponseWriter, loc string) {
 	w.WriteHeader(http.StatusMovedPermanently)
 }
 
+// maxDrain is the largest request body which is read and discarded, when bodies on GET and HEAD requests are ignored.
+// Connections with larger bodies are closed once the response is sent.
+const maxDrain = 256 << 10
+
+// hasReadBody checks if a GET or HEAD request has a body.
+func hasReadBody(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	return r.ContentLength > 0 || (r.ContentLength == -1 && len(r.TransferEncoding) > 0)
+}
+
+// stripBase removes the configured base path from the path of a request, returning false if the request is outside of the base path.
+// Requests are resolved as if the base path was the root, so KatWeb can be served from a sub-path behind a reverse proxy.
+func stripBase(r *http.Request) bool {
+	if conf().Adv.Base == "" {
+		return true
+	}
+	if !strings.HasPrefix(r.URL.Path, conf().Adv.Base+"/") {
+		return false
+	}
+
+	r.URL.Path = r.URL.Path[len(conf().Adv.Base):]
+	if raw := escapedBase(); strings.HasPrefix(r.URL.RawPath, raw+"/") {
+		r.URL.RawPath = r.URL.RawPath[len(raw):]
+	} else {
+		r.URL.RawPath = ""
+	}
+	return true
+}
+
+// escapedBase returns the configured base path, escaped for use in a URL.
+func escapedBase() string {
+	return (&url.URL{Path: conf().Adv.Base}).EscapedPath()
+}
+
+// collapseSlashes replaces repeated slashes in a path with a single slash.
+func collapseSlashes(path string) string {
+	for strings.Contains(path, "//") {
+		path = strings.Replace(path, "//", "/", -1)
+	}
+
+	return path
+}
+
 // trimPort trims the port from a domain or IPv4/IPv6 address.
 func trimPort(path string) string {
 	if path == "" {
-		return "html"
+		return conf().Root
 	}
 
 	if pathn, _, err := net.SplitHostPort(path[:len(path)-1]); err == nil {
@@ -194,11 +325,106 @@ func trimPort(path string) string {
 	return path
 }
 
+// allowedMethods lists the HTTP methods supported by the server.
+// Other methods are only supported when reverse proxying.
+func allowedMethods() string {
+	if len(conf().Proxy) > 0 {
+		return "GET, HEAD, OPTIONS, POST, PUT, PATCH, DELETE"
+	}
+
+	return "GET, HEAD, OPTIONS"
+}
+
+// isBareHost checks if a request's host is empty, or is an IP address.
+func isBareHost(host string) bool {
+	return host == "" || net.ParseIP(strings.Trim(trimPort(host), "[]")) != nil
+}
+
+// allowedHost checks if a host is in a host allowlist.
+// Entries starting with "*." match any subdomain of the entry. If the allowlist is empty, all hosts are allowed.
+// Requests without a host and IP addresses are only allowed if they are listed exactly, with an empty entry allowing requests without a host.
+func allowedHost(host string, allow []string) bool {
+	if len(allow) == 0 {
+		return true
+	}
+
+	if host != "" {
+		host = strings.Trim(strings.ToLower(trimPort(host)), "[]")
+	}
+	ip := net.ParseIP(host) != nil
+	for _, a := range allow {
+		a = strings.Trim(strings.ToLower(a), "[]")
+		if host == a || (host != "" && !ip && strings.HasPrefix(a, "*.") && strings.HasSuffix(host, a[1:])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// canonicalHost adds or removes the www subdomain from a host, based on the server configuration.
+// The www subdomain is only added to registrable domains, so local names and other subdomains are left alone.
+func canonicalHost(host string) string {
+	if host == "" || isBareHost(host) {
+		return host
+	}
+
+	www := strings.HasPrefix(strings.ToLower(host), "www.")
+	switch {
+	case conf().Adv.WWW == "remove" && www:
+		return host[4:]
+	case conf().Adv.WWW == "add" && !www && isApex(host):
+		return "www." + host
+	}
+
+	return host
+}
+
+// isApex checks if a host is a registrable domain, such as example.com or example.co.uk.
+func isApex(host string) bool {
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if !strings.Contains(name, ".") || name == "localhost" || strings.HasSuffix(name, ".localhost") {
+		return false
+	}
+
+	apex, err := publicsuffix.EffectiveTLDPlusOne(name)
+	return err == nil && apex == name
+}
+
+// getScheme returns the URL scheme used by a request.
+func getScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// decodedPath returns the decoded path of a request, to be used for filesystem resolution.
+// It returns false if the path contains null bytes, or any .. segments.
+func decodedPath(r *http.Request) (string, bool) {
+	p := r.URL.Path
+	if strings.IndexByte(p, 0) != -1 {
+		return p, false
+	}
+	for _, seg := range strings.FieldsFunc(p, func(c rune) bool { return c == '/' || c == '\\' }) {
+		if seg == ".." {
+			return p, false
+		}
+	}
+
+	return p, true
+}
+
 // detectPath allows dynamic content control by domain and path.
 func detectPath(path string, url string, r *http.Request) (string, string) {
 	path = trimPort(path) + "/"
 
-	if len(conf.Proxy) > 0 {
+	if len(conf().Proxy) > 0 {
 		prox, _ := GetProxy(r)
 		if prox != "" {
 			return prox, typeProxy
@@ -206,13 +432,37 @@ func detectPath(path string, url string, r *http.Request) (string, string) {
 	}
 
 	if _, err := os.Stat(path); err == nil {
-		i := sort.SearchStrings(conf.No, path[:len(path)-1])
-		if i >= len(conf.No) || conf.No[i] != path[:len(path)-1] {
+		i := sort.SearchStrings(conf().No, path[:len(path)-1])
+		if i >= len(conf().No) || conf().No[i] != path[:len(path)-1] {
 			return path, url
 		}
 	}
 
-	return "html/", url
+	return conf().Root + "/", url
+}
+
+// inRoot checks if the real location of a file is inside of the root folder, after following any symlinks.
+// Files which do not exist are considered to be inside of the root folder.
+func inRoot(root, file string) bool {
+	filer, err := filepath.EvalSymlinks(file)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	rootr, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
+	}
+
+	filer, err = filepath.Abs(filer)
+	if err != nil {
+		return false
+	}
+	rootr, err = filepath.Abs(rootr)
+	if err != nil {
+		return false
+	}
+
+	return filer == rootr || strings.HasPrefix(filer, rootr+string(filepath.Separator))
 }
 
 // loadHeaders adds headers from the server configuration to the request.
@@ -220,47 +470,313 @@ func loadHeaders(w http.ResponseWriter, r *http.Request) {
 	if len(*svrh) > 0 {
 		w.Header().Add("Server", *svrh)
 	}
-	if conf.HSTS {
+	if conf().HSTS {
 		w.Header().Add("Strict-Transport-Security", "max-age=31536000;includeSubDomains;preload")
 	}
+	if conf().Adv.Upgrade {
+		w.Header().Add("Content-Security-Policy", "upgrade-insecure-requests")
+	}
+	if conf().Adv.AltSvc != "" {
+		w.Header().Set("Alt-Svc", conf().Adv.AltSvc)
+	}
+	if conf().Adv.Frame != "" {
+		w.Header().Set("X-Frame-Options", strings.ToUpper(conf().Adv.Frame))
+	}
 
-	if conf.Adv.Pro {
+	if conf().Adv.Pro {
 		w.Header().Add("Referrer-Policy", "no-referrer")
 		w.Header().Add("X-Content-Type-Options", "nosniff")
-		w.Header().Add("Content-Security-Policy", "default-src https: data: 'unsafe-inline' 'unsafe-eval' 'self'; frame-ancestors 'self'")
+		frame := "'self'"
+		if strings.EqualFold(conf().Adv.Frame, "deny") {
+			frame = "'none'"
+		}
+		w.Header().Add("Content-Security-Policy", "default-src https: data: 'unsafe-inline' 'unsafe-eval' 'self'; frame-ancestors "+frame)
 		w.Header().Add("X-XSS-Protection", "1; mode=block")
 	}
 
-	if conf.CachTime != 0 {
-		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(3600*conf.CachTime)+", public, stale-while-revalidate="+strconv.Itoa(900*conf.CachTime))
+	cach, ok := getCache(r.URL.Path)
+	if mc, mok := mountCache(r); mok {
+		cach, ok = mc, true
+	}
+	if ok && cach == 0 {
+		w.Header().Set("Cache-Control", "no-store")
+		return
+	}
+	if cach != 0 {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(3600*cach)+", public, stale-while-revalidate="+strconv.Itoa(900*cach))
+		w.Header().Set("Expires", time.Now().Add(time.Duration(cach)*time.Hour).UTC().Format(http.TimeFormat))
+	}
+}
+
+// loadPreload adds Link preload headers for any assets configured for a page.
+// If early hints are enabled, the headers are also sent in a 103 Early Hints response.
+func loadPreload(w http.ResponseWriter, url string) {
+	hints := false
+	for _, p := range conf().Preload {
+		if p.Loc != url {
+			continue
+		}
+
+		for _, f := range p.Files {
+			w.Header().Add("Link", "<"+f+">; rel=preload"+preloadType(f))
+			hints = true
+		}
+	}
+
+	if hints && conf().Adv.Hints {
+		w.WriteHeader(http.StatusEarlyHints)
+	}
+}
+
+// preloadType chooses the "as" attribute of a Link preload header, based on the asset's file extension.
+func preloadType(file string) string {
+	switch strings.ToLower(filepath.Ext(strings.SplitN(file, "?", 2)[0])) {
+	case ".css":
+		return "; as=style"
+	case ".js", ".mjs":
+		return "; as=script"
+	case ".woff", ".woff2", ".ttf", ".otf":
+		return "; as=font; crossorigin"
+	case ".png", ".jpg", ".jpeg", ".gif", ".svg", ".webp", ".ico":
+		return "; as=image"
+	}
+
+	return ""
+}
+
+// getCache finds the caching timeout for a path, using the longest matching location in conf().Cache.
+// If no location matches, the default caching timeout is returned, along with false.
+// Query strings are not part of the path, so cache-busting queries get the same caching headers as the file.
+func getCache(url string) (int, bool) {
+	var (
+		cach  = conf().CachTime
+		match = -1
+	)
+	for _, c := range conf().Cache {
+		if strings.HasPrefix(url, c.Loc) && len(c.Loc) > match {
+			cach, match = c.Time, len(c.Loc)
+		}
+	}
+
+	return cach, match != -1
+}
+
+// methodOverride applies the X-HTTP-Method-Override header to POST requests, if the method is allowed.
+// TRACE and CONNECT can never be used as overrides, even if they are allowed.
+func methodOverride(r *http.Request) {
+	m := strings.ToUpper(r.Header.Get("X-HTTP-Method-Override"))
+	if m == "" || r.Method != http.MethodPost {
+		return
+	}
+	if m == http.MethodTrace || m == http.MethodConnect {
+		r.Header.Del("X-HTTP-Method-Override")
+		return
+	}
+	r.Header.Del("X-HTTP-Method-Override")
+
+	for _, a := range conf().Override.Allow {
+		if strings.ToUpper(a) == m {
+			r.Method = m
+			return
+		}
 	}
 }
 
 // mainHandle handles all requests given to the http.Server
 func mainHandle(w http.ResponseWriter, r *http.Request) {
-	urlo, err := url.QueryUnescape(r.URL.EscapedPath())
-	if err != nil {
-		StyledError(w, "400 Bad Request", "The server cannot process the request due to an apparent client error", http.StatusBadRequest)
+	atomic.AddUint64(&reqCount, 1)
+	for _, h := range conf().Headers.StripReq {
+		r.Header.Del(h)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), timingKey{}, time.Now()))
+	if conf().Adv.Trace {
+		r = startTrace(r)
+	}
+	cw, cr, label := &countWriter{ResponseWriter: w}, &countReader{ReadCloser: r.Body}, "other"
+	w, r.Body = cw, cr
+	defer func() {
+		addHostBytes(label, cr.n, cw.n)
+		finishTrace(r, cw.code())
+	}()
+
+	if ProbeHandle(w, r) {
+		return
+	}
+	if atomic.LoadInt32(&draining) == 1 {
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Retry-After", strconv.Itoa(conf().Adv.Drain))
+		StyledError(w, r, "503 Service Unavailable", "The server is shutting down, try again later.", http.StatusServiceUnavailable)
+		logr(r, "WebUnavail", "", r.URL.EscapedPath())
+		return
+	}
+	atomic.AddInt64(&activeReqs, 1)
+	defer atomic.AddInt64(&activeReqs, -1)
+
+	if conf().Adv.MaxPath > 0 && len(r.URL.Path) > conf().Adv.MaxPath {
+		StyledError(w, r, "414 URI Too Long", "The requested URI is longer than the server is willing to process.", http.StatusRequestURITooLong)
+		logr(r, "WebLong", "", r.URL.Path[:conf().Adv.MaxPath])
+		return
+	}
+
+	if conf().Adv.HTTP10 == "reject" && !r.ProtoAtLeast(1, 1) {
+		w.Header().Set("Connection", "close")
+		StyledError(w, r, "505 HTTP Version Not Supported", "The server does not support HTTP/1.0, please use HTTP/1.1 or newer.", http.StatusHTTPVersionNotSupported)
+		logr(r, "WebVersion", "", r.URL.EscapedPath())
+		return
+	}
+
+	// The override is applied before the method checks, so it can't be used to bypass them.
+	if conf().Override.Run {
+		methodOverride(r)
+	}
+
+	if r.Method == http.MethodTrace && !conf().Adv.AllowTrace {
+		w.Header().Set("Allow", allowedMethods())
+		StyledError(w, r, "405 Method Not Allowed", "The TRACE method is not allowed on this server.", http.StatusMethodNotAllowed)
+		logr(r, "WebMethod", "", r.URL.EscapedPath())
+		return
+	}
+
+	if hasReadBody(r) {
+		if conf().Adv.GetBody == "reject" {
+			w.Header().Set("Connection", "close")
+			StyledError(w, r, "400 Bad Request", "The server does not accept a request body for "+r.Method+" requests.", http.StatusBadRequest)
+			logr(r, "WebBad", "", r.URL.EscapedPath())
+			return
+		}
+		if conf().Adv.GetBody == "ignore" {
+			io.Copy(ioutil.Discard, io.LimitReader(r.Body, maxDrain))
+			r.Body, r.ContentLength = http.NoBody, 0
+			r.Header.Del("Content-Length")
+			r.Header.Del("Transfer-Encoding")
+		}
+	}
+
+	if refuseWrite(r) {
+		w.Header().Set("Retry-After", "60")
+		StyledError(w, r, "503 Service Unavailable", "The server is low on disk space, and cannot process this request right now.", http.StatusServiceUnavailable)
+		logr(r, "WebUnavail", "", r.URL.EscapedPath())
+		return
+	}
+
+	if r.Method == http.MethodOptions && r.RequestURI == "*" {
+		w.Header().Set("Allow", allowedMethods())
+		w.WriteHeader(http.StatusOK)
+		logr(r, "Web", "", "*")
+		return
+	}
+
+	if conf().Status.Run && r.URL.Path == conf().Adv.Base+conf().Status.Loc {
+		StatusHandle(w, r)
+		return
+	}
+
+	if conf().IP.Mode != "" && conf().IP.Mode != "serve" && isBareHost(r.Host) {
+		if conf().IP.Mode == "redirect" && conf().IP.Host != "" {
+			redir(w, getScheme(r)+"://"+conf().IP.Host+r.URL.RequestURI())
+			logr(r, "WebRedir", "", r.URL.EscapedPath())
+			return
+		}
+		StyledError(w, r, "421 Misdirected Request", "The request was directed at a server that is not able to produce a response.", http.StatusMisdirectedRequest)
+		logr(r, "WebMisdirect", "", r.URL.EscapedPath())
+		return
+	}
+
+	if !allowedHost(r.Host, conf().Hosts.Allow) {
+		if conf().Hosts.Redir != "" {
+			redir(w, getScheme(r)+"://"+conf().Hosts.Redir+r.URL.RequestURI())
+			logr(r, "WebRedir", "", r.URL.EscapedPath())
+			return
+		}
+		StyledError(w, r, "421 Misdirected Request", "The request was directed at a server that is not able to produce a response.", http.StatusMisdirectedRequest)
+		logr(r, "WebMisdirect", "", r.URL.EscapedPath())
+		return
+	}
+
+	if misdirectedAuth(r) {
+		StyledError(w, r, "421 Misdirected Request", "The request was sent on a connection which was not authenticated for this host.", http.StatusMisdirectedRequest)
+		logr(r, "WebMisdirect", "", r.URL.EscapedPath())
+		return
+	}
+
+	if host := canonicalHost(r.Host); host != r.Host {
+		redir(w, getScheme(r)+"://"+host+r.URL.RequestURI())
+		logr(r, "WebRedir", "", r.URL.EscapedPath())
+		return
+	}
+
+	if conf().Adv.Slash != "" && strings.Contains(r.URL.Path, "//") {
+		clean := collapseSlashes(r.URL.Path)
+		if conf().Adv.Slash == "redirect" {
+			loc := (&url.URL{Path: clean, RawQuery: r.URL.RawQuery}).String()
+			redir(w, loc)
+			logr(r, "WebRedir", "", r.URL.EscapedPath())
+			return
+		}
+		r.URL.Path, r.URL.RawPath = clean, ""
+	}
+
+	if conf().Adv.Base != "" && r.URL.Path == conf().Adv.Base {
+		redir(w, escapedBase()+"/")
+		logr(r, "WebRedir", "", r.URL.EscapedPath())
+		return
+	}
+	if !stripBase(r) {
+		StyledError(w, r, "404 Not Found", "The requested resource could not be found but may be available in the future.", http.StatusNotFound)
+		logr(r, "WebNotFound", "", r.URL.EscapedPath())
+		return
+	}
+
+	// r.URL.Path has already been decoded once, so it must not be decoded again.
+	urlo, ok := decodedPath(r)
+	if !ok {
+		StyledError(w, r, "400 Bad Request", "The server cannot process the request due to an apparent client error", http.StatusBadRequest)
 		logr(r, "WebBad", "", r.URL.EscapedPath())
 		return
 	}
 
 	path, url := detectPath(r.Host, urlo, r)
+	label = hostLabel(r.Host, path)
+	if conf().Adv.HostLimit > 0 {
+		sem, ok := acquireHost(label)
+		if !ok {
+			w.Header().Set("Retry-After", "5")
+			StyledError(w, r, "503 Service Unavailable", "The server is currently handling too many requests for this site, try again later.", http.StatusServiceUnavailable)
+			logr(r, "WebUnavail", "", urlo)
+			return
+		}
+		defer func() { <-sem }()
+	}
 	if url == typeProxy {
-		ProxyRequest(w, r)
-		logr(r, "WebProxy", "", urlo)
+		if conf().Adv.LogUpstream {
+			r = withUpstream(r)
+		}
+		logr(r, ProxyRequest(w, r), "", urlo)
+		return
+	}
+	// Mounts only change the file which is served, so redirects, logs, and preloads use the request's own path.
+	var mounted bool
+	r, path, url, mounted = applyMount(r, path, url)
+	if mounted && url == "/" && !strings.HasSuffix(urlo, "/") {
+		redir(w, escapedBase()+r.URL.EscapedPath()+"/")
 		return
 	}
 
 	loadHeaders(w, r)
 
 	// Apply any required redirects.
-	if strings.HasSuffix(url, IndexFile) {
+	if strings.HasSuffix(urlo, IndexFile) {
 		redir(w, "./")
 		return
 	}
-	if i := sort.SearchStrings(redirSort, r.Host+url); i < len(redirSort) && redirSort[i] == r.Host+url || len(redirRegex) > 0 {
-		if loc := GetRedir(r, url); loc != "" {
+	if _, ok := route().redirs[r.Host+urlo]; ok || len(route().redirRegex) > 0 {
+		if loc, keep := GetRedir(r, urlo); loc != "" {
+			if keep {
+				w.Header().Set("Location", loc)
+				w.WriteHeader(http.StatusPermanentRedirect)
+				logr(r, "WebRedirKeep", "", r.URL.EscapedPath())
+				return
+			}
 			redir(w, loc)
 			logr(r, "WebRedir", "", r.URL.EscapedPath())
 			return
@@ -268,48 +784,170 @@ func mainHandle(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Don't allow the client to access .. or . folders, and don't allow access to hidden files.
-	// Also, don't allow access to the root folder.
-	if strings.Contains(url, "..") || path == "ssl/" || path[0] == 46 || path[0] == 47 {
-		StyledError(w, "403 Forbidden", "You do not have permission to access this resource.", http.StatusForbidden)
-		logr(r, "WebForbid", "", url)
+	// Also, don't allow access to the root folder, unless it is the configured document root.
+	if strings.Contains(url, "..") || path == "ssl/" || (path != conf().Root+"/" && !mounted && (path[0] == 46 || path[0] == 47)) {
+		Forbidden(w, r)
+		logr(r, "WebForbid", "", urlo)
 		return
 	}
 
 	// Check the file's password protection options.
-	finfo, err := os.Stat(path + url)
+	statStart := time.Now()
+	loc := overlayFile(path, url)
+	finfo, err := os.Stat(loc)
+	addTiming(w, r, "stat", time.Since(statStart))
+	// Generated robots.txt and sitemap.xml files are only used if the files don't exist on disk.
+	if err != nil && conf().Robots.Run && RobotsHandle(w, r, urlo) {
+		logr(r, "WebRoot", "", urlo)
+		return
+	}
 	if err == nil {
 		if finfo.IsDir() && !strings.HasSuffix(url, "/") {
-			redir(w, r.URL.EscapedPath()+"/")
+			redir(w, escapedBase()+r.URL.EscapedPath()+"/")
 			return
 		}
 	}
 
 	// Provide an error message if the content is unavailable, and run authentication if required.
+	if err == nil && conf().Adv.CaseStrict && !exactCase(strings.TrimSuffix(loc, url), url) {
+		err = os.ErrNotExist
+	}
 	if err != nil {
-		StyledError(w, "404 Not Found", "The requested resource could not be found but may be available in the future.", http.StatusNotFound)
-		logr(r, "WebNotFound", "", url)
+		StyledError(w, r, "404 Not Found", "The requested resource could not be found but may be available in the future.", http.StatusNotFound)
+		logr(r, "WebNotFound", "", urlo)
+		return
+	}
+	// Files from the overlay folder are checked against the overlay folder, so they can't escape it either.
+	if root := strings.TrimSuffix(loc, url); !conf().Adv.Symlink && (!inRoot(root, loc) || (finfo.IsDir() && !inRoot(root, loc+IndexFile))) {
+		Forbidden(w, r)
+		logr(r, "WebForbid", "", urlo)
 		return
 	}
 	auth := DetectPasswd(url, path)
 	if finfo.Name() == "passwd" || auth[0] == "forbid" {
-		StyledError(w, "403 Forbidden", "You do not have permission to access this resource.", http.StatusForbidden)
-		logr(r, "WebForbid", "", url)
+		Forbidden(w, r)
+		logr(r, "WebForbid", "", urlo)
 		return
 	}
 	if auth[0] != "err" && !RunAuth(w, r, auth) {
-		StyledError(w, "401 Unauthorized", "Correct authentication credentials are required to access this resource.", http.StatusUnauthorized)
-		logr(r, "WebUnAuth", "", url)
+		StyledError(w, r, "401 Unauthorized", "Correct authentication credentials are required to access this resource.", http.StatusUnauthorized)
+		logr(r, "WebUnAuth", "", urlo)
 		return
 	}
 
 	// Serve the content, and return an error if needed
-	if ServeFile(w, r, path+url, url) != nil {
-		StyledError(w, "500 Internal Server Error", "An unexpected condition was encountered, try again later", http.StatusInternalServerError)
-		logr(r, "WebError", "", url)
+	loadPreload(w, urlo)
+	if err := ServeFile(w, r, loc, urlo); err != nil {
+		if err == errNoIndex {
+			if urlo == "/" && rootResponse(w) {
+				logr(r, "WebRoot", "", urlo)
+				return
+			}
+			if isEmptyDir(loc) {
+				switch conf().Index.Empty {
+				case "forbid":
+					Forbidden(w, r)
+					logr(r, "WebForbid", "", urlo)
+					return
+				case "page":
+					if data, err := ioutil.ReadFile(conf().Index.EPage); err == nil {
+						w.Header().Set("Content-Type", "text/html; charset=utf-8")
+						w.Write(data)
+						logr(r, "WebRoot", "", urlo)
+						return
+					}
+				}
+			}
+			StyledError(w, r, "404 Not Found", "The requested resource could not be found but may be available in the future.", http.StatusNotFound)
+			logr(r, "WebNotFound", "", urlo)
+			return
+		}
+		if err == errNotAcceptable {
+			StyledError(w, r, "406 Not Acceptable", "The requested resource is not available in an encoding accepted by your browser.", http.StatusNotAcceptable)
+			logr(r, "WebNotAccept", "", urlo)
+			return
+		}
+		// Errors caused by the client disconnecting are not server errors.
+		if r.Context().Err() != nil || cw.err != nil {
+			logDisconnect(r, urlo)
+			return
+		}
+		StyledError(w, r, "500 Internal Server Error", "An unexpected condition was encountered, try again later", http.StatusInternalServerError)
+		logr(r, "WebError", "", urlo)
 		return
 	}
 
-	logr(r, "Web", path, url)
+	if r.Context().Err() != nil || cw.err != nil {
+		logDisconnect(r, urlo)
+	}
+	logr(r, "Web", path, urlo)
+}
+
+// exactCase checks if the casing of each part of a path matches the files on disk.
+// This prevents case-insensitive filesystems from serving the same file at multiple paths.
+func exactCase(root, url string) bool {
+	dir := root
+	for _, seg := range strings.Split(strings.Trim(url, "/"), "/") {
+		if seg == "" {
+			continue
+		}
+
+		f, err := os.Open(dir)
+		if err != nil {
+			return false
+		}
+		names, err := f.Readdirnames(0)
+		f.Close()
+		if err != nil {
+			return false
+		}
+
+		found := false
+		for _, n := range names {
+			if n == seg {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+		dir = filepath.Join(dir, seg)
+	}
+
+	return true
+}
+
+// isEmptyDir checks if a folder has no files in it.
+func isEmptyDir(loc string) bool {
+	f, err := os.Open(loc)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	_, err = f.Readdirnames(1)
+	return err == io.EOF
+}
+
+// overlayFile returns the location a file should be served from.
+// Files in the overlay folder take precedence over the files in the site's folder, but folders are never overlaid.
+func overlayFile(path, url string) string {
+	if conf().Adv.Overlay != "" {
+		if fi, err := os.Stat(conf().Adv.Overlay + url); err == nil && !fi.IsDir() {
+			return conf().Adv.Overlay + url
+		}
+	}
+
+	return path + url
+}
+
+// logDisconnect logs a client disconnecting before a response was fully sent.
+// This is normal behavior for clients, so it is only logged in development mode.
+func logDisconnect(r *http.Request, url string) {
+	if conf().Adv.Dev {
+		Print("[Debug] : Client " + r.RemoteAddr + " disconnected before " + cleanLog(trimPort(r.Host)+url) + " was fully sent.")
+	}
 }
 
 // wrapLoad chooses the correct handler wrappers based on server configuration.
@@ -322,13 +960,13 @@ func wrapLoad(origin http.HandlerFunc) http.Handler {
 		}
 	)
 
-	if conf.HSTS {
+	if conf().HSTS {
 		wrap = httpsredir
 	}
 
-	if conf.Le.Run {
+	if conf().Le.Run {
 		tlsc.GetCertificate = certManager.GetCertificate
-		certManager.HostPolicy = autocert.HostWhitelist(conf.Le.Loc...)
+		certManager.HostPolicy = autocert.HostWhitelist(conf().Le.Loc...)
 		return certManager.HTTPHandler(wrap)
 	}
 
@@ -0,0 +1,1527 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMethodOverride(t *testing.T) {
+	tests := []struct {
+		name, method, override, want string
+	}{
+		{"allowed", "POST", "PUT", "PUT"},
+		{"lowercase", "POST", "delete", "DELETE"},
+		{"not allowed", "POST", "PATCH", "POST"},
+		{"not post", "GET", "PUT", "GET"},
+		{"no header", "POST", "", "POST"},
+		{"trace", "POST", "TRACE", "POST"},
+		{"connect", "POST", "CONNECT", "POST"},
+	}
+
+	c := &Conf{}
+	c.Override.Run, c.Override.Allow = true, []string{"PUT", "DELETE", "TRACE", "CONNECT"}
+	setTestConf(t, c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/", nil)
+			if tt.override != "" {
+				r.Header.Set("X-HTTP-Method-Override", tt.override)
+			}
+			methodOverride(r)
+			if r.Method != tt.want {
+				t.Errorf("method = %s, want %s", r.Method, tt.want)
+			}
+			if r.Header.Get("X-HTTP-Method-Override") != "" && tt.method == "POST" {
+				t.Errorf("override header was not removed")
+			}
+		})
+	}
+}
+
+func TestGetCache(t *testing.T) {
+	loadTestConf(t, `{"cachingTimeout": 4, "caching": [
+		{"location": "/images/", "time": 168},
+		{"location": "/images/icons/", "time": 1},
+		{"location": "/api/", "time": 0}
+	]}`)
+
+	tests := []struct {
+		url     string
+		want    int
+		matched bool
+	}{
+		{"/index.html", 4, false},
+		{"/images/cat.png", 168, true},
+		{"/images/icons/cat.png", 1, true},
+		{"/api/users", 0, true},
+		{"/apiary", 4, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			got, ok := getCache(tt.url)
+			if got != tt.want || ok != tt.matched {
+				t.Errorf("getCache(%q) = %d, %v, want %d, %v", tt.url, got, ok, tt.want, tt.matched)
+			}
+
+			w := httptest.NewRecorder()
+			loadHeaders(w, httptest.NewRequest("GET", tt.url, nil))
+			cc := w.Header().Get("Cache-Control")
+			switch {
+			case tt.want == 0 && cc != "no-store":
+				t.Errorf("Cache-Control = %q, want no-store", cc)
+			case tt.want != 0 && !strings.HasPrefix(cc, "max-age="+strconv.Itoa(3600*tt.want)+","):
+				t.Errorf("Cache-Control = %q, want max-age=%d", cc, 3600*tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalHost(t *testing.T) {
+	tests := []struct {
+		mode, host, want string
+	}{
+		{"add", "example.com", "www.example.com"},
+		{"add", "example.com:8080", "www.example.com:8080"},
+		{"add", "example.co.uk", "www.example.co.uk"},
+		{"add", "www.example.com", "www.example.com"},
+		{"add", "api.example.com", "api.example.com"},
+		{"add", "localhost", "localhost"},
+		{"add", "localhost:8080", "localhost:8080"},
+		{"add", "intranet", "intranet"},
+		{"add", "app.localhost", "app.localhost"},
+		{"add", "127.0.0.1", "127.0.0.1"},
+		{"add", "[::1]:443", "[::1]:443"},
+		{"add", "", ""},
+		{"remove", "www.example.com", "example.com"},
+		{"remove", "WWW.example.com", "example.com"},
+		{"remove", "example.com", "example.com"},
+		{"", "example.com", "example.com"},
+		{"", "www.example.com", "www.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.host, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.WWW = tt.mode
+			setTestConf(t, c)
+			if got := canonicalHost(tt.host); got != tt.want {
+				t.Errorf("canonicalHost(%q) = %q, want %q", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalHostRedirect(t *testing.T) {
+	tests := []struct {
+		name, mode, target, host string
+		tls, hsts                bool
+		location                 string
+	}{
+		{"add www", "add", "/a/b?q=1&r=2", "example.com", false, false, "http://www.example.com/a/b?q=1&r=2"},
+		{"remove www", "remove", "/a/b?q=1", "www.example.com", false, false, "http://example.com/a/b?q=1"},
+		{"add www over https", "add", "/a?q=1", "example.com", true, false, "https://www.example.com/a?q=1"},
+		{"remove www over https", "remove", "/a?q=1", "www.example.com:8443", true, false, "https://example.com:8443/a?q=1"},
+		{"add www behind https redirect", "add", "/a?q=1", "example.com", false, true, "https://www.example.com/a?q=1"},
+		{"remove www behind https redirect", "remove", "/a?q=%2F", "www.example.com", false, true, "https://example.com/a?q=%2F"},
+		{"escaped path", "add", "/a%20b?q", "example.com", true, false, "https://www.example.com/a%20b?q"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.HSTS, c.Adv.WWW = tt.hsts, tt.mode
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", tt.target, nil)
+			r.Host = tt.host
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{ServerName: trimPort(tt.host)}
+			}
+			w := httptest.NewRecorder()
+			if tt.hsts {
+				httpsredir(w, r)
+			} else {
+				mainHandle(w, r)
+			}
+			if w.Code != http.StatusMovedPermanently {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusMovedPermanently)
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("Location = %q, want %q", got, tt.location)
+			}
+		})
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		name, method, target string
+		https                int
+		code                 int
+		location             string
+	}{
+		{"path", "GET", "http://example.com/a/b", 443, 301, "https://example.com/a/b"},
+		{"port", "GET", "http://example.com/", 8443, 301, "https://example.com:8443/"},
+		{"options path", "OPTIONS", "http://example.com/a", 443, 301, "https://example.com/a"},
+		{"options asterisk", "OPTIONS", "*", 443, 200, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.HSTS, c.Adv.HTTPS = true, tt.https
+			setTestConf(t, c)
+
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			r.Host = "example.com"
+			w := httptest.NewRecorder()
+			httpsredir(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("Location = %q, want %q", got, tt.location)
+			}
+		})
+	}
+}
+
+func TestIPRequests(t *testing.T) {
+	tests := []struct {
+		name, mode, host string
+		code             int
+		loc              string
+	}{
+		{"serve no host", "serve", "", 200, ""},
+		{"serve bare ip", "serve", "192.0.2.1", 200, ""},
+		{"default bare ip", "", "192.0.2.1:80", 200, ""},
+		{"reject no host", "reject", "", 421, ""},
+		{"reject bare ip", "reject", "192.0.2.1", 421, ""},
+		{"reject bare ipv6", "reject", "[2001:db8::1]:80", 421, ""},
+		{"reject named host", "reject", "localhost", 200, ""},
+		{"redirect no host", "redirect", "", 301, "http://example.com/?q=1"},
+		{"redirect bare ip", "redirect", "192.0.2.1:80", 301, "http://example.com/?q=1"},
+		{"redirect named host", "redirect", "localhost", 200, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.IP.Mode, c.IP.Host = tt.mode, "example.com"
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/?q=1", nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			mainHandle(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if got := w.Header().Get("Location"); got != tt.loc {
+				t.Errorf("Location = %q, want %q", got, tt.loc)
+			}
+		})
+	}
+}
+
+func TestPermanentRedirect(t *testing.T) {
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		io.WriteString(w, r.Method+" "+string(body))
+	}))
+	defer dest.Close()
+	srv := httptest.NewServer(http.HandlerFunc(mainHandle))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	tests := []struct {
+		name, path, method string
+		code               int
+		want               string
+	}{
+		{"keep method post", "/keep", "POST", 308, "POST data"},
+		{"keep method put", "/keep", "PUT", 308, "PUT data"},
+		{"keep method regex", "/api/v1", "POST", 308, "POST data"},
+		{"moved post", "/moved", "POST", 301, "GET "},
+		{"moved get", "/moved", "GET", 301, "GET "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestProxies(t, `{"documentRoot":"html","advanced":{"httpPort":80,"sslPort":443},"redir":[`+
+				`{"location":"`+host+`/keep","dest":"`+dest.URL+`/new","keepMethod":true},`+
+				`{"location":".+\\/api\\/v1","dest":"`+dest.URL+`/api/v2","keepMethod":true},`+
+				`{"location":"`+host+`/moved","dest":"`+dest.URL+`/new"}]}`)
+
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader("data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+			resp, err := noFollow.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.code || !strings.HasPrefix(resp.Header.Get("Location"), dest.URL) {
+				t.Fatalf("response = %d %q, want %d to %s", resp.StatusCode, resp.Header.Get("Location"), tt.code, dest.URL)
+			}
+
+			req, _ = http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader("data"))
+			resp, err = http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != tt.want {
+				t.Errorf("redirected request = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoubleSlashes(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "foo"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, root, IndexFile, []byte("root index"))
+	writeFile(t, filepath.Join(root, "foo"), "bar", []byte("bar"))
+	writeFile(t, filepath.Join(root, "foo"), IndexFile, []byte("foo index"))
+
+	tests := []struct {
+		name, mode, path string
+		code             int
+		body, loc        string
+	}{
+		{"collapse root", "collapse", "//", 200, "root index", ""},
+		{"collapse file", "collapse", "/foo//bar", 200, "bar", ""},
+		{"collapse many", "collapse", "///foo///bar", 200, "bar", ""},
+		{"collapse trailing slash", "collapse", "/foo//", 200, "foo index", ""},
+		{"collapse folder without slash", "collapse", "//foo", 301, "", "/foo/"},
+		{"redirect root", "redirect", "//", 301, "", "/"},
+		{"redirect file", "redirect", "/foo//bar?x=1", 301, "", "/foo/bar?x=1"},
+		{"redirect trailing slash", "redirect", "/foo//", 301, "", "/foo/"},
+		{"redirect single slashes", "redirect", "/foo/bar", 200, "bar", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Root, c.Adv.Slash = root, tt.mode
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.URL.Path = tt.path
+			if i := strings.IndexByte(tt.path, '?'); i >= 0 {
+				r.URL.Path, r.URL.RawQuery = tt.path[:i], tt.path[i+1:]
+			}
+			w := httptest.NewRecorder()
+			mainHandle(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.body)
+			}
+			if got := w.Header().Get("Location"); got != tt.loc {
+				t.Errorf("Location = %q, want %q", got, tt.loc)
+			}
+		})
+	}
+}
+
+func TestPreload(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(mainHandle))
+	defer srv.Close()
+
+	tests := []struct {
+		name, path string
+		hints      bool
+		code       int
+		want       []string
+	}{
+		{"configured page", "/", false, 200, []string{
+			"</style.css>; rel=preload; as=style",
+			"</app.js?v=2>; rel=preload; as=script",
+			"</font.woff2>; rel=preload; as=font; crossorigin",
+			"</logo.png>; rel=preload; as=image",
+		}},
+		{"other page", "/missing.html", false, 404, nil},
+		{"early hints", "/", true, 200, []string{
+			"</style.css>; rel=preload; as=style",
+			"</app.js?v=2>; rel=preload; as=script",
+			"</font.woff2>; rel=preload; as=font; crossorigin",
+			"</logo.png>; rel=preload; as=image",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := loadTestConf(t, `{"documentRoot":"html","advanced":{"httpPort":80,"sslPort":443},"preload":[`+
+				`{"location":"/","files":["/style.css","/app.js?v=2","/font.woff2","/logo.png"]}]}`)
+			c.Adv.Hints = tt.hints
+
+			var early http.Header
+			trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, h textproto.MIMEHeader) error {
+				if code == http.StatusEarlyHints {
+					early = http.Header(h)
+				}
+				return nil
+			}}
+			req, _ := http.NewRequest("GET", srv.URL+tt.path, nil)
+			resp, err := http.DefaultClient.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.code {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.code)
+			}
+			if got := resp.Header.Values("Link"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Link = %q, want %q", got, tt.want)
+			}
+			if tt.hints != (early != nil) {
+				t.Fatalf("early hints sent = %v, want %v", early != nil, tt.hints)
+			}
+			if got := early.Values("Link"); tt.hints && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("early hints Link = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxPathLength(t *testing.T) {
+	tests := []struct {
+		name string
+		max  int
+		path string
+		code int
+	}{
+		{"under limit", 16, "/missing.txt", 404},
+		{"at limit", 12, "/missing.txt", 404},
+		{"over limit", 11, "/missing.txt", 414},
+		{"far over limit", 2048, "/" + strings.Repeat("a", 4096), 414},
+		{"no limit", 0, "/" + strings.Repeat("a", 4096), 404},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Adv.MaxPath = tt.max
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.URL.Path = tt.path
+			w := httptest.NewRecorder()
+			mainHandle(w, r)
+			if w.Code != tt.code {
+				t.Errorf("status = %d, want %d", w.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestRootResponse(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "sub"), "page.txt", []byte("page"))
+	welcome := writeFile(t, t.TempDir(), "welcome.html", []byte("<p>welcome</p>"))
+
+	tests := []struct {
+		name, path, page, redirect string
+		noList                     bool
+		code                       int
+		body, loc                  string
+	}{
+		{"welcome page", "/", welcome, "", true, 200, "<p>welcome</p>", ""},
+		{"redirect", "/", "", "https://example.com/", true, 301, "", "https://example.com/"},
+		{"redirect over page", "/", welcome, "https://example.com/", true, 301, "", "https://example.com/"},
+		{"not configured", "/", "", "", true, 404, "", ""},
+		{"missing page", "/", welcome + ".missing", "", true, 404, "", ""},
+		{"not the root", "/sub/", welcome, "https://example.com/", true, 404, "", ""},
+		{"listing enabled", "/", welcome, "", false, 200, "Contents of directory", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Root = root
+			c.Index.NoList, c.Index.Page, c.Index.Redir = tt.noList, tt.page, tt.redirect
+			setTestConf(t, c)
+
+			w := httptest.NewRecorder()
+			mainHandle(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("body = %q, want it to contain %q", w.Body.String(), tt.body)
+			}
+			if got := w.Header().Get("Location"); got != tt.loc {
+				t.Errorf("Location = %q, want %q", got, tt.loc)
+			}
+		})
+	}
+}
+
+func TestUpgradeInsecure(t *testing.T) {
+	tests := []struct {
+		name          string
+		upgrade, hsts bool
+	}{
+		{"enabled", true, false},
+		{"enabled with hsts", true, true},
+		{"hsts only", false, true},
+		{"disabled", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Adv.Upgrade, c.HSTS = tt.upgrade, tt.hsts
+			setTestConf(t, c)
+
+			w := httptest.NewRecorder()
+			mainHandle(w, httptest.NewRequest("GET", "/", nil))
+			if got := w.Header().Get("Content-Security-Policy") == "upgrade-insecure-requests"; got != tt.upgrade {
+				t.Errorf("Content-Security-Policy = %q, want upgrade-insecure-requests %v", w.Header().Get("Content-Security-Policy"), tt.upgrade)
+			}
+			if got := w.Header().Get("Strict-Transport-Security") != ""; got != tt.hsts {
+				t.Errorf("Strict-Transport-Security = %q, want it sent %v", w.Header().Get("Strict-Transport-Security"), tt.hsts)
+			}
+		})
+	}
+}
+
+func TestAltSvc(t *testing.T) {
+	tests := []struct {
+		name, altSvc, path string
+	}{
+		{"file", `h3=":443"; ma=86400`, "/"},
+		{"not found", `h3=":443"; ma=86400`, "/missing.txt"},
+		{"clear", "clear", "/"},
+		{"disabled", "", "/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Adv.AltSvc = tt.altSvc
+			setTestConf(t, c)
+
+			w := httptest.NewRecorder()
+			mainHandle(w, httptest.NewRequest("GET", tt.path, nil))
+			if got := w.Header().Values("Alt-Svc"); len(got) > 1 || w.Header().Get("Alt-Svc") != tt.altSvc {
+				t.Errorf("Alt-Svc = %q, want %q", got, tt.altSvc)
+			}
+		})
+	}
+}
+
+func TestFrameOptions(t *testing.T) {
+	tests := []struct {
+		name, frame string
+		protect     bool
+		want, csp   string
+	}{
+		{"deny", "deny", true, "DENY", "frame-ancestors 'none'"},
+		{"same origin", "SameOrigin", true, "SAMEORIGIN", "frame-ancestors 'self'"},
+		{"default", "", true, "", "frame-ancestors 'self'"},
+		{"without protect", "DENY", false, "DENY", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Adv.Frame, c.Adv.Pro = tt.frame, tt.protect
+			setTestConf(t, c)
+
+			w := httptest.NewRecorder()
+			mainHandle(w, httptest.NewRequest("GET", "/", nil))
+			if got := w.Header().Get("X-Frame-Options"); got != tt.want {
+				t.Errorf("X-Frame-Options = %q, want %q", got, tt.want)
+			}
+			csp := w.Header().Get("Content-Security-Policy")
+			if (tt.csp == "") != (csp == "") || !strings.HasSuffix(csp, tt.csp) {
+				t.Errorf("Content-Security-Policy = %q, want suffix %q", csp, tt.csp)
+			}
+		})
+	}
+}
+
+func TestEarlyHints(t *testing.T) {
+	tests := []struct {
+		name, path string
+		hints, h2  bool
+		want       []int
+	}{
+		{"http/1.1", "/", true, false, []int{103, 200}},
+		{"http/2", "/", true, true, []int{103, 200}},
+		{"disabled", "/", false, true, []int{200}},
+		{"page without preload", "/missing.html", true, true, []int{404}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := loadTestConf(t, `{"documentRoot":"html","advanced":{"httpPort":80,"sslPort":443},"preload":[{"location":"/","files":["/style.css"]}]}`)
+			c.Adv.Hints = tt.hints
+
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(mainHandle))
+			srv.EnableHTTP2 = tt.h2
+			srv.StartTLS()
+			defer srv.Close()
+
+			var codes []int
+			trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, h textproto.MIMEHeader) error {
+				codes = append(codes, code)
+				if h.Get("Link") != "</style.css>; rel=preload; as=style" {
+					t.Errorf("early hints Link = %q", h.Get("Link"))
+				}
+				return nil
+			}}
+			req, _ := http.NewRequest("GET", srv.URL+tt.path, nil)
+			resp, err := srv.Client().Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			codes = append(codes, resp.StatusCode)
+
+			if h2 := resp.ProtoMajor == 2; h2 != tt.h2 {
+				t.Errorf("protocol = %s, want http/2 %v", resp.Proto, tt.h2)
+			}
+			if !reflect.DeepEqual(codes, tt.want) {
+				t.Errorf("responses = %v, want %v", codes, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "large.bin", bytes.Repeat([]byte("0123456789abcdef"), 4<<20))
+
+	tests := []struct {
+		name  string
+		dev   bool
+		debug bool
+	}{
+		{"development mode", true, true},
+		{"production mode", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Root, c.Adv.Dev = root, tt.dev
+			setTestConf(t, c)
+
+			sink, err := os.Create(filepath.Join(t.TempDir(), "access.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sink.Close()
+			logSinks = []logSink{{sink, "simple"}}
+			defer func() { logSinks = nil }()
+
+			done := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(done)
+				mainHandle(w, r)
+			}))
+			defer srv.Close()
+
+			out := captureOutput(t, func() {
+				conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.WriteString(conn, "GET /large.bin HTTP/1.1\r\nHost: localhost\r\n\r\n")
+				io.ReadFull(conn, make([]byte, 4096))
+				conn.Close()
+
+				select {
+				case <-done:
+				case <-time.After(5 * time.Second):
+					t.Fatal("handler did not finish after the client disconnected")
+				}
+			})
+
+			if got := strings.Contains(out, "[Debug] : Client ") && strings.Contains(out, "disconnected before localhost/large.bin was fully sent."); got != tt.debug {
+				t.Errorf("printed %q, want disconnect message %v", out, tt.debug)
+			}
+			logged, err := ioutil.ReadFile(sink.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(logged), "[WebError]") {
+				t.Errorf("access log = %q, want no server error", logged)
+			}
+		})
+	}
+}
+
+func TestHTTP10(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(mainHandle))
+	defer srv.Close()
+
+	tests := []struct {
+		name, mode, req string
+		code            int
+		conn            string
+		keepAlive       bool
+	}{
+		{"serve without host", "serve", "GET / HTTP/1.0\r\n\r\n", 200, "", false},
+		{"serve keep-alive", "serve", "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", 200, "keep-alive", true},
+		{"default mode", "", "GET / HTTP/1.0\r\n\r\n", 200, "", false},
+		{"reject without host", "reject", "GET / HTTP/1.0\r\n\r\n", 505, "close", false},
+		{"reject keep-alive", "reject", "GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", 505, "close", false},
+		{"reject allows http/1.1", "reject", "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", 200, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Adv.HTTP10 = tt.mode
+			setTestConf(t, c)
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			io.WriteString(conn, tt.req)
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.code {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.code)
+			}
+			if got := resp.Header.Get("Connection"); !strings.EqualFold(got, tt.conn) {
+				t.Errorf("Connection = %q, want %q", got, tt.conn)
+			}
+
+			// The server closes the connection after the response, unless it is kept alive.
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, err = br.ReadByte()
+			if closed := err == io.EOF; closed == tt.keepAlive {
+				t.Errorf("connection closed = %v, want kept alive %v (%v)", closed, tt.keepAlive, err)
+			}
+		})
+	}
+}
+
+func TestNotFoundLogging(t *testing.T) {
+	tests := []struct {
+		name     string
+		suppress bool
+		sample   int
+		logged   int
+	}{
+		{"logged", false, 0, 4},
+		{"suppressed", true, 0, 0},
+		{"sampled", true, 2, 2},
+		{"sample ignored when not suppressed", false, 3, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Adv.NoLog404, c.Adv.Sample404 = tt.suppress, tt.sample
+			setTestConf(t, c)
+			atomic.StoreUint64(&notFoundCount, 0)
+
+			sink, err := os.Create(filepath.Join(t.TempDir(), "access.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sink.Close()
+			logSinks = []logSink{{sink, "simple"}}
+			defer func() { logSinks = nil }()
+
+			for i := 0; i < 4; i++ {
+				mainHandle(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing.txt", nil))
+			}
+			mainHandle(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+			data, err := ioutil.ReadFile(sink.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := strings.Count(string(data), "[WebNotFound]"); n != tt.logged {
+				t.Errorf("logged %d not found requests, want %d", n, tt.logged)
+			}
+			if !strings.Contains(string(data), "[Web][") {
+				t.Error("successful request was not logged")
+			}
+
+			w := httptest.NewRecorder()
+			c.Status.Run, c.Status.Loc = true, "/status"
+			StatusHandle(w, httptest.NewRequest("GET", "/status", nil))
+			var stat StatusData
+			if err := json.Unmarshal(w.Body.Bytes(), &stat); err != nil {
+				t.Fatal(err)
+			}
+			if stat.NotFound != 4 {
+				t.Errorf("status notFound = %d, want 4", stat.NotFound)
+			}
+		})
+	}
+}
+
+func TestAllowedHost(t *testing.T) {
+	tests := []struct {
+		host  string
+		allow []string
+		want  bool
+	}{
+		{"example.com", nil, true},
+		{"", nil, true},
+		{"127.0.0.1", nil, true},
+		{"example.com", []string{"example.com"}, true},
+		{"Example.COM:8080", []string{"example.com"}, true},
+		{"other.com", []string{"example.com"}, false},
+		{"api.example.com", []string{"*.example.com"}, true},
+		{"example.com", []string{"*.example.com"}, false},
+		{"badexample.com", []string{"*.example.com"}, false},
+		{"", []string{"example.com"}, false},
+		{"", []string{"example.com", ""}, true},
+		{"127.0.0.1", []string{"example.com"}, false},
+		{"127.0.0.1:8080", []string{"127.0.0.1"}, true},
+		{"127.0.0.1", []string{"*.0.0.1"}, false},
+		{"[::1]:443", []string{"example.com"}, false},
+		{"[::1]:443", []string{"::1"}, true},
+		{"[::1]", []string{"[::1]"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host+" "+strings.Join(tt.allow, ","), func(t *testing.T) {
+			setTestConf(t, baseConf())
+			if got := allowedHost(tt.host, tt.allow); got != tt.want {
+				t.Errorf("allowedHost(%q, %q) = %v, want %v", tt.host, tt.allow, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostAllowlist(t *testing.T) {
+	tests := []struct {
+		name, host string
+		code       int
+	}{
+		{"listed", "example.com", 200},
+		{"not listed", "other.com", 421},
+		{"empty host", "", 421},
+		{"ip address", "127.0.0.1", 421},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Hosts.Allow = []string{"example.com"}
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			mainHandle(w, r)
+			if w.Code != tt.code {
+				t.Errorf("status = %d, want %d", w.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	var (
+		root    = t.TempDir()
+		outside = t.TempDir()
+	)
+	page := writeFile(t, root, "page.txt", []byte("inside"))
+	secret := writeFile(t, outside, "secret.txt", []byte("secret"))
+	writeFile(t, outside, IndexFile, []byte("secret index"))
+	if err := os.Symlink(page, filepath.Join(root, "inside.txt")); err != nil {
+		t.Skip("symlinks are not supported:", err)
+	}
+	for name, target := range map[string]string{"outside.txt": secret, "folder": outside} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name, path string
+		symlinks   bool
+		code       int
+		body       string
+	}{
+		{"inside root", "/inside.txt", false, 200, "inside"},
+		{"inside root followed", "/inside.txt", true, 200, "inside"},
+		{"outside root", "/outside.txt", false, 403, ""},
+		{"outside root followed", "/outside.txt", true, 200, "secret"},
+		{"folder outside root", "/folder/", false, 403, ""},
+		{"folder outside root followed", "/folder/", true, 200, "secret index"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Root, c.Adv.Symlink = root, tt.symlinks
+			setTestConf(t, c)
+
+			w := httptest.NewRecorder()
+			mainHandle(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+func TestInRoot(t *testing.T) {
+	var (
+		root    = t.TempDir()
+		outside = t.TempDir()
+	)
+	writeFile(t, root, "page.txt", []byte("inside"))
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skip("symlinks are not supported:", err)
+	}
+	if err := os.Symlink(root, root+"-prefix"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(root + "-prefix") })
+
+	tests := []struct {
+		name, file string
+		want       bool
+	}{
+		{"root", root, true},
+		{"file", filepath.Join(root, "page.txt"), true},
+		{"missing file", filepath.Join(root, "missing.txt"), true},
+		{"symlink outside", filepath.Join(root, "link"), false},
+		{"outside", outside, false},
+		{"root through a symlink", root + "-prefix/page.txt", true},
+	}
+	for _, tt := range tests {
+		if got := inRoot(root, tt.file); got != tt.want {
+			t.Errorf("%s: inRoot(%q) = %v, want %v", tt.name, tt.file, got, tt.want)
+		}
+	}
+}
+
+func TestOverlaySymlinks(t *testing.T) {
+	var (
+		root    = t.TempDir()
+		overlay = t.TempDir()
+		outside = t.TempDir()
+	)
+	writeFile(t, root, "page.txt", []byte("root"))
+	writeFile(t, overlay, "page.txt", []byte("overlay"))
+	secret := writeFile(t, outside, "secret.txt", []byte("secret"))
+	if err := os.Symlink(secret, filepath.Join(overlay, "link.txt")); err != nil {
+		t.Skip("symlinks are not supported:", err)
+	}
+	if err := os.Symlink(secret, filepath.Join(root, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(overlay, "rootlink.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, path string
+		symlinks   bool
+		code       int
+		body       string
+	}{
+		{"overlay file", "/page.txt", false, 200, "overlay"},
+		{"overlay symlink outside", "/link.txt", false, 403, ""},
+		{"overlay symlink allowed", "/link.txt", true, 200, "secret"},
+		{"overlay only symlink", "/rootlink.txt", false, 403, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Root, c.Adv.Overlay, c.Adv.Symlink = root, overlay, tt.symlinks
+			setTestConf(t, c)
+
+			w := httptest.NewRecorder()
+			mainHandle(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+func TestDocumentRoot(t *testing.T) {
+	var (
+		root    = t.TempDir()
+		outside = t.TempDir()
+	)
+	writeFile(t, root, "page.txt", []byte("custom root"))
+	secret := writeFile(t, outside, "secret.txt", []byte("secret"))
+	if err := os.Symlink(secret, filepath.Join(root, "link.txt")); err != nil {
+		t.Skip("symlinks are not supported:", err)
+	}
+
+	tests := []struct {
+		name, path string
+		code       int
+		body       string
+	}{
+		{"file", "/page.txt", 200, "custom root"},
+		{"missing", "/index.txt", 404, ""},
+		{"parent folder", "/../" + filepath.Base(outside) + "/secret.txt", 400, ""},
+		{"symlink outside", "/link.txt", 403, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Root = root
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.URL.Path = tt.path
+			w := httptest.NewRecorder()
+			mainHandle(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+func TestWrapLoadChallenges(t *testing.T) {
+	prev := tlsc.GetCertificate
+	t.Cleanup(func() { tlsc.GetCertificate = prev })
+
+	tests := []struct {
+		name, path string
+		le, hsts   bool
+		code       int
+		location   string
+	}{
+		{"challenge", "/.well-known/acme-challenge/token", true, true, 404, ""},
+		{"other path redirects", "/page", true, true, 301, "https://example.com/page"},
+		{"challenge without hsts", "/.well-known/acme-challenge/token", true, false, 404, ""},
+		{"hsts only", "/.well-known/acme-challenge/token", false, true, 301, "https://example.com/.well-known/acme-challenge/token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.HSTS, c.Le.Run, c.Le.Loc = tt.hsts, tt.le, []string{"example.com"}
+			c.Root = t.TempDir()
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "http://example.com"+tt.path, nil)
+			w := httptest.NewRecorder()
+			wrapLoad(mainHandle).ServeHTTP(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("Location = %q, want %q", got, tt.location)
+			}
+			// Challenges are answered by autocert, rather than the site's 404 page.
+			if autocert := strings.Contains(w.Body.String(), "acme/autocert"); autocert != (tt.code == 404) {
+				t.Errorf("body = %q, want autocert's response %v", w.Body.String(), tt.code == 404)
+			}
+		})
+	}
+}
+
+func TestTraceMethod(t *testing.T) {
+	tests := []struct {
+		name, method string
+		allow        bool
+		code         int
+	}{
+		{"trace rejected", "TRACE", false, 405},
+		{"trace allowed", "TRACE", true, 200},
+		{"get unaffected", "GET", false, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Adv.AllowTrace = tt.allow
+			setTestConf(t, c)
+
+			w := httptest.NewRecorder()
+			mainHandle(w, httptest.NewRequest(tt.method, "/", nil))
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if allow := w.Header().Get("Allow"); (tt.code == 405) != (allow != "") {
+				t.Errorf("Allow = %q, want it only on rejected requests", allow)
+			} else if tt.code == 405 && strings.Contains(allow, "TRACE") {
+				t.Errorf("Allow = %q, want TRACE to be excluded", allow)
+			}
+		})
+	}
+}
+
+func TestDecodedPath(t *testing.T) {
+	tests := []struct {
+		target, want string
+		ok           bool
+	}{
+		{"/page.html", "/page.html", true},
+		{"/a%20b.html", "/a b.html", true},
+		{"/%2e%2e/ssl/key.pem", "/../ssl/key.pem", false},
+		{"/dir/..%2fssl", "/dir/../ssl", false},
+		{"/dir/..%5cssl", "/dir/..\\ssl", false},
+		{"/%252e%252e/ssl", "/%2e%2e/ssl", true},
+		{"/file%00.html", "/file\x00.html", false},
+		{"/..file", "/..file", true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		u, err := url.ParseRequestURI(tt.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.URL = u
+		if got, ok := decodedPath(r); got != tt.want || ok != tt.ok {
+			t.Errorf("decodedPath(%q) = %q, %v, want %q, %v", tt.target, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestTraversal(t *testing.T) {
+	tests := []struct {
+		name, target string
+		code         int
+	}{
+		{"encoded dot segments", "/%2e%2e/ssl/", 400},
+		{"encoded slash", "/css/..%2f..%2fmain.go", 400},
+		{"double encoded", "/%252e%252e/main.go", 404},
+		{"plain file", "/", 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConf(t, baseConf())
+
+			r := httptest.NewRequest("GET", "/", nil)
+			u, err := url.ParseRequestURI(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.URL, r.RequestURI = u, tt.target
+			w := httptest.NewRecorder()
+			mainHandle(w, r)
+			if w.Code != tt.code {
+				t.Errorf("status = %d, want %d", w.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestLogReferer(t *testing.T) {
+	tests := []struct {
+		name, referer string
+		strip         bool
+		want          string
+	}{
+		{"query stripped", "https://example.com/search?q=secret", true, `"https://example.com/search"`},
+		{"fragment stripped", "https://example.com/page#token=secret", true, `"https://example.com/page"`},
+		{"no query", "https://example.com/page", true, `"https://example.com/page"`},
+		{"query kept", "https://example.com/search?q=secret", false, `"https://example.com/search?q=secret"`},
+		{"no referer", "", true, "-"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.NoQuery = tt.strip
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/page?q=kept", nil)
+			r.Header.Set("User-Agent", "test-agent")
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			line := logNCSA(r, http.StatusNotFound, "/page?q=kept", "html", "combined")
+			if want := " " + tt.want + ` "test-agent"`; !strings.HasSuffix(line, want) {
+				t.Errorf("log line = %q, want suffix %q", line, want)
+			}
+			if !strings.Contains(line, "/page?q=kept") {
+				t.Errorf("log line = %q, want the request's own query to be kept", line)
+			}
+		})
+	}
+}
+
+func TestStripRequestHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Debug") + "|" + r.Header.Get("X-Keep") + "|" + r.Header.Get("X-Forwarded-For")))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name, strip, want string
+	}{
+		{"stripped", `["x-debug","X-Forwarded-For"]`, "|kept|192.0.2.1"},
+		{"not stripped", `[]`, "on|kept|203.0.113.9, 192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestProxies(t, `{"documentRoot":"html","streamTimeout":5,"headers":{"stripRequest":`+tt.strip+`},"proxy":[{"location":"api","host":"`+backend.URL+`"}]}`)
+			if err := LoadProxyTransport(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest("GET", "/api/", nil)
+			r.Header.Set("X-Debug", "on")
+			r.Header.Set("X-Keep", "kept")
+			r.Header.Set("X-Forwarded-For", "203.0.113.9")
+			w := httptest.NewRecorder()
+			mainHandle(w, r)
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("backend received %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmptyFolder(t *testing.T) {
+	root := t.TempDir()
+	for _, d := range []string{"empty", "full"} {
+		if err := os.Mkdir(filepath.Join(root, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(root, "full"), "file.txt", []byte("file"))
+	page := writeFile(t, t.TempDir(), "empty.html", []byte("nothing here yet"))
+
+	tests := []struct {
+		name, mode, page, path string
+		code                   int
+		body                   string
+	}{
+		{"default", "", "", "/empty/", 404, "404 Not Found"},
+		{"not found", "notfound", "", "/empty/", 404, "404 Not Found"},
+		{"forbid", "forbid", "", "/empty/", 403, "403 Forbidden"},
+		{"page", "page", page, "/empty/", 200, "nothing here yet"},
+		{"missing page", "page", filepath.Join(root, "missing.html"), "/empty/", 404, "404 Not Found"},
+		{"folder with files", "forbid", "", "/full/", 404, "404 Not Found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Root, c.Index.NoList, c.Index.Empty, c.Index.EPage = root, true, tt.mode, tt.page
+			setTestConf(t, c)
+
+			w := httptest.NewRecorder()
+			mainHandle(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("response = %d %q, want %d %q", w.Code, w.Body.String(), tt.code, tt.body)
+			}
+		})
+	}
+}
+
+func TestNotAcceptable(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "page.txt", []byte("page"))
+	writeFile(t, root, "zipped.txt", []byte("zipped"))
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("zipped"))
+	gz.Close()
+	writeFile(t, root, "zipped.txt.gz", buf.Bytes())
+
+	tests := []struct {
+		name, path, accept string
+		code               int
+		encoding           string
+	}{
+		{"identity refused", "/page.txt", "identity;q=0", 406, ""},
+		{"everything refused", "/page.txt", "*;q=0", 406, ""},
+		{"identity refused with compressed file", "/zipped.txt", "identity;q=0, gzip", 200, "gzip"},
+		{"identity accepted", "/page.txt", "gzip", 200, ""},
+		{"no header", "/page.txt", "", 200, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Root = root
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", tt.path, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+			sink, err := os.Create(filepath.Join(t.TempDir(), "access.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sink.Close()
+			logSinks = []logSink{{sink, "common"}}
+			defer func() { logSinks = nil }()
+
+			w := httptest.NewRecorder()
+			mainHandle(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if enc := w.Header().Get("Content-Encoding"); enc != tt.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", enc, tt.encoding)
+			}
+			if tt.code == 406 && !strings.Contains(w.Body.String(), "406 Not Acceptable") {
+				t.Errorf("body = %q, want a 406 error page", w.Body.String())
+			}
+			logged, err := ioutil.ReadFile(sink.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(logged), `" `+strconv.Itoa(tt.code)+" ") {
+				t.Errorf("access log = %q, want status %d", logged, tt.code)
+			}
+		})
+	}
+}
+
+func TestIsEmptyDir(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"empty", "full"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	full := filepath.Dir(writeFile(t, filepath.Join(dir, "full"), ".hidden", []byte("hidden")))
+
+	tests := []struct {
+		loc  string
+		want bool
+	}{
+		{filepath.Join(dir, "empty"), true},
+		{full, false},
+		{filepath.Join(dir, "missing"), false},
+		{filepath.Join(full, ".hidden"), false},
+	}
+
+	for _, tt := range tests {
+		if got := isEmptyDir(tt.loc); got != tt.want {
+			t.Errorf("isEmptyDir(%q) = %v, want %v", tt.loc, got, tt.want)
+		}
+	}
+}
+
+func TestExactCase(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "Dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "Dir"), "File.txt", []byte("file"))
+
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"/", true},
+		{"/Dir/", true},
+		{"/Dir/File.txt", true},
+		{"/Dir//File.txt", true},
+		{"/dir/File.txt", false},
+		{"/Dir/file.txt", false},
+		{"/DIR/", false},
+		{"/Dir/Missing.txt", false},
+		{"/Dir/File.txt/inner", false},
+	}
+
+	for _, tt := range tests {
+		if got := exactCase(root, tt.url); got != tt.want {
+			t.Errorf("exactCase(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestStrictCase(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "Dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "Dir"), "File.txt", []byte("file"))
+
+	tests := []struct {
+		name, path string
+		strict     bool
+		code       int
+	}{
+		{"matching case", "/Dir/File.txt", true, 200},
+		{"matching folder", "/Dir/", true, 200},
+		{"disabled", "/Dir/File.txt", false, 200},
+		{"missing", "/Dir/Other.txt", true, 404},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Root, c.Adv.CaseStrict = root, tt.strict
+			setTestConf(t, c)
+
+			w := httptest.NewRecorder()
+			mainHandle(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.code {
+				t.Errorf("status = %d, want %d", w.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestLogRefererAgent(t *testing.T) {
+	tests := []struct {
+		name, referer, agent string
+		omit                 bool
+		want                 string
+	}{
+		{"plain", "https://example.com/", "Mozilla/5.0", false, ` "https://example.com/" "Mozilla/5.0"`},
+		{"quotes escaped", `https://example.com/"x`, `agent" 200 "forged`, false, ` "https://example.com/\"x" "agent\" 200 \"forged"`},
+		{"control characters escaped", "https://example.com/\n127.0.0.1 - -", "agent\r\n", false, ` "https://example.com/\n127.0.0.1 - -" "agent\r\n"`},
+		{"missing", "", "", false, " - -"},
+		{"omitted", "https://example.com/", "Mozilla/5.0", true, " - -"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.NoRefUA = tt.omit
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/page", nil)
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			if tt.agent != "" {
+				r.Header.Set("User-Agent", tt.agent)
+			}
+			for _, format := range []string{"combined", "combinedvhost"} {
+				line := logNCSA(r, http.StatusNotFound, "/page", "html", format)
+				if !strings.HasSuffix(line, tt.want) || strings.ContainsAny(line, "\r\n") {
+					t.Errorf("%s log = %q, want suffix %q", format, line, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestHasReadBody(t *testing.T) {
+	tests := []struct {
+		name, method string
+		length       int64
+		chunked      bool
+		want         bool
+	}{
+		{"get with body", "GET", 4, false, true},
+		{"head with body", "HEAD", 4, false, true},
+		{"chunked get", "GET", -1, true, true},
+		{"get without body", "GET", 0, false, false},
+		{"post with body", "POST", 4, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/", nil)
+			r.ContentLength = tt.length
+			if tt.chunked {
+				r.TransferEncoding = []string{"chunked"}
+			}
+			if got := hasReadBody(r); got != tt.want {
+				t.Errorf("hasReadBody() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte("body=" + string(body)))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name, mode, method, path, body string
+		code                           int
+		want                           string
+	}{
+		{"serve", "serve", "GET", "/api/", "data", 200, "body=data"},
+		{"default", "", "GET", "/api/", "data", 200, "body=data"},
+		{"ignore", "ignore", "GET", "/api/", "data", 200, "body="},
+		{"reject", "reject", "GET", "/api/", "data", 400, "400 Bad Request"},
+		{"reject static file", "reject", "GET", "/index.html", "data", 400, "400 Bad Request"},
+		{"reject without body", "reject", "GET", "/api/", "", 200, "body="},
+		{"reject post", "reject", "POST", "/api/", "data", 200, "body=data"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestProxies(t, `{"documentRoot":"html","streamTimeout":5,"advanced":{"getBody":"`+tt.mode+`"},
+				"proxy":[{"location":"api","host":"`+backend.URL+`"}]}`)
+			if err := LoadProxyTransport(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			mainHandle(w, r)
+			if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.want) {
+				t.Fatalf("response = %d %q, want %d %q", w.Code, w.Body.String(), tt.code, tt.want)
+			}
+			if tt.code == 400 && w.Header().Get("Connection") != "close" {
+				t.Errorf("Connection = %q, want close", w.Header().Get("Connection"))
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+// KatWeb by kittyhacker101 - Configuration Testing
+package main
+
+import (
+	"crypto/tls"
+	"mime"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// checkConfig validates the fields of a config, and checks that any referenced files exist.
+// It returns a list of the problems found in the configuration.
+func checkConfig(c *Conf) []string {
+	var errs []string
+
+	ports := map[string]int{"httpPort": c.Adv.HTTP, "sslPort": c.Adv.HTTPS}
+	for _, name := range sortedKeys(ports) {
+		if port := ports[name]; port < 1 || port > 65535 {
+			errs = append(errs, name+" must be between 1 and 65535.")
+		}
+	}
+	if c.Adv.HTTP == c.Adv.HTTPS {
+		errs = append(errs, "httpPort and sslPort must be different.")
+	}
+	nums := map[string]int{
+		"cachingTimeout":       c.CachTime,
+		"streamTimeout":        c.DatTime,
+		"certOverlap":          c.Adv.CertOver,
+		"flushSize":            c.Adv.Flush,
+		"challengeTimeout":     c.Le.Timeout,
+		"logBuffer":            c.Adv.LogBuf,
+		"logFlushInterval":     c.Adv.LogFlush,
+		"keepAliveRequests":    c.Adv.MaxReqs,
+		"maxPathLength":        c.Adv.MaxPath,
+		"minFreeDisk":          c.Adv.MinDisk,
+		"slowRequest":          c.Adv.Slow,
+		"maxBodySize":          c.Adv.MaxBody,
+		"hostConcurrency":      c.Adv.HostLimit,
+		"notFoundSample":       c.Adv.Sample404,
+		"copyBuffer":           c.Adv.CopyBuf,
+		"maxFails":             c.ProxyHealth.Fails,
+		"cooldown":             c.ProxyHealth.Cooldown,
+		"checkInterval":        c.ProxyHealth.Interval,
+		"checkTimeout":         c.ProxyHealth.Timeout,
+		"healthyThreshold":     c.ProxyHealth.Healthy,
+		"unhealthyThreshold":   c.ProxyHealth.Unhealthy,
+		"retries":              c.ProxyHealth.Retries,
+		"listingCache":         c.Adv.ListCache,
+		"drainTime":            c.Adv.Drain,
+		"maxHandshakes":        c.Adv.MaxHandshakes,
+		"compressLengthBuffer": c.Adv.ZipLength,
+		"maxIdlePerIP":         c.Adv.MaxIdle,
+		"maxIdle":              c.ProxyConns.MaxIdle,
+		"maxIdlePerHost":       c.ProxyConns.MaxIdleHost,
+		"idleTimeout":          c.ProxyConns.IdleTime,
+	}
+	for _, name := range sortedKeys(nums) {
+		if nums[name] < 0 {
+			errs = append(errs, name+" must not be negative.")
+		}
+	}
+
+	if fi, err := os.Stat(c.Root); err != nil || !fi.IsDir() {
+		errs = append(errs, "documentRoot "+c.Root+" is not a folder.")
+	}
+	if c.Adv.Base != "" && (!strings.HasPrefix(c.Adv.Base, "/") || c.Adv.Base == "/" || filepath.ToSlash(filepath.Clean(c.Adv.Base)) != c.Adv.Base) {
+		errs = append(errs, "basePath must be a clean path starting with /, without a trailing slash.")
+	}
+	for _, p := range c.Adv.NoZipUA {
+		if _, err := regexp.Compile(p); err != nil {
+			errs = append(errs, "noCompressAgents pattern "+p+" is not a valid regular expression.")
+		}
+	}
+	if c.Adv.WellKnown != "" {
+		if fi, err := os.Stat(c.Adv.WellKnown); err != nil || !fi.IsDir() {
+			errs = append(errs, "wellKnownRoot "+c.Adv.WellKnown+" is not a folder.")
+		}
+	}
+	if c.Adv.Overlay != "" {
+		if fi, err := os.Stat(c.Adv.Overlay); err != nil || !fi.IsDir() {
+			errs = append(errs, "overlayRoot "+c.Adv.Overlay+" is not a folder.")
+		}
+	}
+	if _, err := tls.LoadX509KeyPair("ssl/server.crt", "ssl/server.key"); err != nil {
+		errs = append(errs, "Unable to load TLS keypair from ssl/server.crt and ssl/server.key.")
+	}
+	if _, err := buildHostTLS(c); err != nil {
+		errs = append(errs, "Invalid hostTLS settings, "+err.Error()+".")
+	}
+	if len(c.Adv.ALPN) > 0 && !validALPN(c.Adv.ALPN) {
+		errs = append(errs, "alpn must include h2 or http/1.1.")
+	}
+	for _, b := range c.Adv.Bind {
+		if net.ParseIP(strings.Trim(b, "[]")) == nil {
+			errs = append(errs, "Bind address "+b+" is not a valid IP address.")
+		}
+	}
+	if c.Le.Run && len(c.Le.Loc) == 0 {
+		errs = append(errs, "letsencrypt is enabled, but no domains are set.")
+	}
+
+	for _, p := range c.Proxy {
+		if p.Loc == "" {
+			errs = append(errs, "A proxy location is empty.")
+		}
+		for _, h := range append([]string{p.URL}, p.Hosts...) {
+			if u, err := url.Parse(h); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, "Proxy host "+h+" is not a valid http or https URL.")
+			}
+		}
+		if p.Mode != "" && p.Mode != "roundrobin" && p.Mode != "leastconn" {
+			errs = append(errs, "Proxy balance mode must be roundrobin or leastconn.")
+		}
+	}
+	if c.ProxyHealth.Path != "" && !strings.HasPrefix(c.ProxyHealth.Path, "/") {
+		errs = append(errs, "Proxy health check path must start with a /.")
+	}
+	if c.ProxyTLS.CA != "" {
+		if _, err := os.Stat(c.ProxyTLS.CA); err != nil {
+			errs = append(errs, "Proxy CA bundle "+c.ProxyTLS.CA+" does not exist.")
+		}
+	}
+	for _, m := range c.Mounts {
+		if !strings.HasPrefix(m.Loc, "/") {
+			errs = append(errs, "Mount location "+m.Loc+" must start with a /.")
+		}
+		if fi, err := os.Stat(m.Root); err != nil || !fi.IsDir() {
+			errs = append(errs, "Mount root "+m.Root+" is not a folder.")
+		}
+		if m.Cache < -1 {
+			errs = append(errs, "Mount caching for "+m.Loc+" must be -1 or more.")
+		}
+	}
+	for _, r := range c.Redir {
+		if r.Loc == "" || r.URL == "" {
+			errs = append(errs, "A redirect location or destination is empty.")
+		}
+	}
+
+	statuses := make([]int, 0, len(c.ErrPage))
+	for status := range c.ErrPage {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		page := c.ErrPage[status]
+		if status < 400 || status > 599 {
+			errs = append(errs, "Error page status "+strconv.Itoa(status)+" is not an error status code.")
+		}
+		if _, err := os.Stat(page); err != nil {
+			errs = append(errs, "Error page "+page+" does not exist.")
+		}
+	}
+	if c.Index.Page != "" {
+		if _, err := os.Stat(c.Index.Page); err != nil {
+			errs = append(errs, "Root page "+c.Index.Page+" does not exist.")
+		}
+	}
+	if c.Adv.MimeDef != "" {
+		if _, _, err := mime.ParseMediaType(c.Adv.MimeDef); err != nil {
+			errs = append(errs, "defaultMime "+c.Adv.MimeDef+" is not a valid media type.")
+		}
+	}
+	for _, e := range c.Adv.ZipExt {
+		if !strings.HasPrefix(e, ".") {
+			errs = append(errs, "Compression extension "+e+" must start with a dot.")
+		}
+	}
+	switch c.Index.Empty {
+	case "", "notfound", "forbid":
+	case "page":
+		if _, err := os.Stat(c.Index.EPage); err != nil {
+			errs = append(errs, "Empty folder page "+c.Index.EPage+" does not exist.")
+		}
+	default:
+		errs = append(errs, "emptyFolder must be notfound, forbid, or page.")
+	}
+	for _, d := range c.Download {
+		if _, err := filepath.Match(d, ""); err != nil {
+			errs = append(errs, "Download pattern "+d+" is not valid.")
+		}
+	}
+
+	switch c.IP.Mode {
+	case "", "serve", "reject":
+	case "redirect":
+		if c.IP.Host == "" {
+			errs = append(errs, "ipRequests is set to redirect, but no host is set.")
+		}
+	default:
+		errs = append(errs, "ipRequests mode must be serve, reject, or redirect.")
+	}
+
+	if c.Hosts.Redir != "" && !allowedHost(c.Hosts.Redir, c.Hosts.Allow) {
+		errs = append(errs, "hostAllowlist redirect host "+c.Hosts.Redir+" is not in the allowlist.")
+	}
+
+	if c.Adv.Zstd < 0 || c.Adv.Zstd > 22 {
+		errs = append(errs, "zstdLevel must be between 0 and 22.")
+	}
+	if c.Adv.KeepAlive < -1 {
+		errs = append(errs, "tcpKeepAlive must be -1 or more.")
+	}
+	if c.Adv.ProxyFlush < -1 {
+		errs = append(errs, "proxyFlushInterval must be -1 or more.")
+	}
+
+	if c.Adv.AltSvc != "" && !validAltSvc(c.Adv.AltSvc) {
+		errs = append(errs, "altSvc must be clear, or a list of protocol=\"host:port\" entries.")
+	}
+
+	if c.Adv.Frame != "" && !strings.EqualFold(c.Adv.Frame, "deny") && !strings.EqualFold(c.Adv.Frame, "sameorigin") {
+		errs = append(errs, "frameOptions must be empty, DENY, or SAMEORIGIN.")
+	}
+
+	if c.Adv.Slash != "" && c.Adv.Slash != "collapse" && c.Adv.Slash != "redirect" {
+		errs = append(errs, "doubleSlashes must be empty, collapse, or redirect.")
+	}
+
+	if c.Adv.WWW != "" && c.Adv.WWW != "add" && c.Adv.WWW != "remove" {
+		errs = append(errs, "canonicalWWW must be empty, add, or remove.")
+	}
+
+	if c.Adv.HTTP10 != "" && c.Adv.HTTP10 != "serve" && c.Adv.HTTP10 != "reject" {
+		errs = append(errs, "http10 must be serve or reject.")
+	}
+	for _, m := range c.Override.Allow {
+		if strings.EqualFold(m, "TRACE") || strings.EqualFold(m, "CONNECT") {
+			errs = append(errs, "methodOverride can't allow "+strings.ToUpper(m)+".")
+		}
+	}
+	if c.Adv.GetBody != "" && c.Adv.GetBody != "serve" && c.Adv.GetBody != "ignore" && c.Adv.GetBody != "reject" {
+		errs = append(errs, "getBody must be serve, ignore, or reject.")
+	}
+	if c.Adv.LogTime != "" && c.Adv.LogTime != "clf" && c.Adv.LogTime != "rfc3339" && c.Adv.LogTime != "unix" {
+		errs = append(errs, "logTime must be clf, rfc3339, or unix.")
+	}
+
+	for _, l := range c.Logs {
+		switch l.Format {
+		case "none", "simple", "common", "commonvhost", "combined", "combinedvhost":
+		default:
+			errs = append(errs, "Access log "+l.File+" has an unsupported log type.")
+		}
+	}
+
+	if c.Robots.Run && len(c.Robots.Pages) > 0 {
+		if u, err := url.Parse(c.Robots.Site); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, "Robots site URL "+c.Robots.Site+" is not a valid http or https URL.")
+		}
+	}
+	if c.Adv.OTLP != "" {
+		if u, err := url.Parse(c.Adv.OTLP); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, "OTLP endpoint "+c.Adv.OTLP+" is not a valid http or https URL.")
+		}
+		if !c.Adv.Trace {
+			errs = append(errs, "otlpEndpoint is set, but traceContext is disabled.")
+		}
+	}
+	if c.Probes.Run && (!strings.HasPrefix(c.Probes.Live, "/") || !strings.HasPrefix(c.Probes.Ready, "/")) {
+		errs = append(errs, "Probe locations must start with a /.")
+	}
+	if c.Status.Run && !strings.HasPrefix(c.Status.Loc, "/") {
+		errs = append(errs, "Status location must start with a /.")
+	}
+	for _, a := range c.Status.IPs {
+		if _, _, err := net.ParseCIDR(a); err != nil && net.ParseIP(a) == nil {
+			errs = append(errs, "Status allowlist entry "+a+" is not a valid IP or CIDR range.")
+		}
+	}
+
+	return errs
+}
+
+// sortedKeys returns the keys of a map in sorted order, so the problems found are always reported in the same order.
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// altSvcEntry matches a single alternative service, such as h3=":443"; ma=3600
+var altSvcEntry = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+.^_|~-]+="[^"]*:[0-9]+"(\s*;\s*[a-z]+=[^;,]+)*$`)
+
+// validAltSvc checks the syntax of an Alt-Svc header value.
+func validAltSvc(v string) bool {
+	if v == "clear" {
+		return true
+	}
+	for _, e := range strings.Split(v, ",") {
+		if !altSvcEntry.MatchString(strings.TrimSpace(e)) {
+			return false
+		}
+	}
+	return true
+}
+
+// TestConfig loads a configuration file, and prints a report of any problems with it.
+// It returns the exit code which should be used.
+func TestConfig(file string) int {
+	next, errt := loadConfig(file)
+	if errt != "" {
+		Print("[Error] : " + errt)
+		return 1
+	}
+
+	errs := checkConfig(next)
+	for _, e := range errs {
+		Print("[Error] : " + e)
+	}
+	if len(errs) > 0 {
+		Print("[Info] : Config test failed with " + strconv.Itoa(len(errs)) + " error(s).")
+		return 1
+	}
+
+	Print("[Info] : Config test passed.")
+	return 0
+}
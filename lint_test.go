@@ -0,0 +1,204 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// baseConf returns a config which passes checkConfig, for tests to modify.
+func baseConf() *Conf {
+	c := &Conf{Root: "html"}
+	c.Adv.HTTP, c.Adv.HTTPS = 80, 443
+	return c
+}
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Conf)
+		want   string
+	}{
+		{"valid", func(c *Conf) {}, ""},
+		{"port out of range", func(c *Conf) { c.Adv.HTTP = 0 }, "httpPort must be between 1 and 65535."},
+		{"same ports", func(c *Conf) { c.Adv.HTTPS = 80 }, "httpPort and sslPort must be different."},
+		{"negative number", func(c *Conf) { c.DatTime = -1 }, "streamTimeout must not be negative."},
+		{"robots sitemap", func(c *Conf) {
+			c.Robots.Run, c.Robots.Site, c.Robots.Pages = true, "https://example.com", []string{"/"}
+		}, ""},
+		{"robots sitemap without site", func(c *Conf) { c.Robots.Run, c.Robots.Site, c.Robots.Pages = true, "example.com", []string{"/"} }, "Robots site URL example.com is not a valid http or https URL."},
+		{"probe locations", func(c *Conf) { c.Probes.Run, c.Probes.Live, c.Probes.Ready = true, "/healthz", "/readyz" }, ""},
+		{"probe location without slash", func(c *Conf) { c.Probes.Run, c.Probes.Live, c.Probes.Ready = true, "/healthz", "readyz" }, "Probe locations must start with a /."},
+		{"negative drain time", func(c *Conf) { c.Adv.Drain = -1 }, "drainTime must not be negative."},
+		{"missing root", func(c *Conf) { c.Root = "missing" }, "documentRoot missing is not a folder."},
+		{"no compress agents", func(c *Conf) { c.Adv.NoZipUA = []string{"^OldBrowser/"} }, ""},
+		{"invalid no compress agent", func(c *Conf) { c.Adv.NoZipUA = []string{"[invalid"} }, "noCompressAgents pattern [invalid is not a valid regular expression."},
+		{"well-known root", func(c *Conf) { c.Adv.WellKnown = "html" }, ""},
+		{"missing well-known root", func(c *Conf) { c.Adv.WellKnown = "missing" }, "wellKnownRoot missing is not a folder."},
+		{"well-known root is a file", func(c *Conf) { c.Adv.WellKnown = "conf.json" }, "wellKnownRoot conf.json is not a folder."},
+		{"root is a file", func(c *Conf) { c.Root = "conf.json" }, "documentRoot conf.json is not a folder."},
+		{"missing overlay", func(c *Conf) { c.Adv.Overlay = "missing" }, "overlayRoot missing is not a folder."},
+		{"alpn", func(c *Conf) { c.Adv.ALPN = []string{"acme-tls/1", "h2"} }, ""},
+		{"alpn without http", func(c *Conf) { c.Adv.ALPN = []string{"acme-tls/1"} }, "alpn must include h2 or http/1.1."},
+		{"bind addresses", func(c *Conf) { c.Adv.Bind = []string{"127.0.0.1", "[::1]", "::"} }, ""},
+		{"bind hostname", func(c *Conf) { c.Adv.Bind = []string{"localhost"} }, "Bind address localhost is not a valid IP address."},
+		{"ip redirect", func(c *Conf) { c.IP.Mode, c.IP.Host = "redirect", "example.com" }, ""},
+		{"ip redirect without host", func(c *Conf) { c.IP.Mode = "redirect" }, "ipRequests is set to redirect, but no host is set."},
+		{"unknown ip mode", func(c *Conf) { c.IP.Mode = "drop" }, "ipRequests mode must be serve, reject, or redirect."},
+		{"frame options", func(c *Conf) { c.Adv.Frame = "sameorigin" }, ""},
+		{"unknown frame options", func(c *Conf) { c.Adv.Frame = "ALLOW-FROM https://example.com" }, "frameOptions must be empty, DENY, or SAMEORIGIN."},
+		{"get body", func(c *Conf) { c.Adv.GetBody = "ignore" }, ""},
+		{"unknown get body", func(c *Conf) { c.Adv.GetBody = "drop" }, "getBody must be serve, ignore, or reject."},
+		{"log time", func(c *Conf) { c.Adv.LogTime = "rfc3339" }, ""},
+		{"negative compress length buffer", func(c *Conf) { c.Adv.ZipLength = -1 }, "compressLengthBuffer must not be negative."},
+		{"negative idle connection limit", func(c *Conf) { c.Adv.MaxIdle = -1 }, "maxIdlePerIP must not be negative."},
+		{"negative proxy idle connections", func(c *Conf) { c.ProxyConns.MaxIdle = -1 }, "maxIdle must not be negative."},
+		{"negative proxy idle connections per host", func(c *Conf) { c.ProxyConns.MaxIdleHost = -1 }, "maxIdlePerHost must not be negative."},
+		{"negative proxy idle timeout", func(c *Conf) { c.ProxyConns.IdleTime = -1 }, "idleTimeout must not be negative."},
+		{"unknown log time", func(c *Conf) { c.Adv.LogTime = "iso" }, "logTime must be clf, rfc3339, or unix."},
+		{"double slashes", func(c *Conf) { c.Adv.Slash = "collapse" }, ""},
+		{"unknown double slashes", func(c *Conf) { c.Adv.Slash = "strip" }, "doubleSlashes must be empty, collapse, or redirect."},
+		{"http10 reject", func(c *Conf) { c.Adv.HTTP10 = "reject" }, ""},
+		{"unknown http10 mode", func(c *Conf) { c.Adv.HTTP10 = "upgrade" }, "http10 must be serve or reject."},
+		{"access logs", func(c *Conf) {
+			c.Logs = append(c.Logs, struct {
+				File   string `json:"file"`
+				Format string `json:"logType"`
+			}{"access.log", "combinedvhost"})
+		}, ""},
+		{"access log type", func(c *Conf) {
+			c.Logs = append(c.Logs, struct {
+				File   string `json:"file"`
+				Format string `json:"logType"`
+			}{"access.log", "json"})
+		}, "Access log access.log has an unsupported log type."},
+		{"compression extensions", func(c *Conf) { c.Adv.ZipExt = []string{".svg", ".html"} }, ""},
+		{"compression extension without dot", func(c *Conf) { c.Adv.ZipExt = []string{"svg"} }, "Compression extension svg must start with a dot."},
+		{"empty folder forbid", func(c *Conf) { c.Index.Empty = "forbid" }, ""},
+		{"empty folder page", func(c *Conf) { c.Index.Empty, c.Index.EPage = "page", "html/index.html" }, ""},
+		{"missing empty folder page", func(c *Conf) { c.Index.Empty, c.Index.EPage = "page", "missing.html" }, "Empty folder page missing.html does not exist."},
+		{"unknown empty folder mode", func(c *Conf) { c.Index.Empty = "list" }, "emptyFolder must be notfound, forbid, or page."},
+		{"default mime", func(c *Conf) { c.Adv.MimeDef = "text/plain; charset=utf-8" }, ""},
+		{"invalid default mime", func(c *Conf) { c.Adv.MimeDef = "text/" }, "defaultMime text/ is not a valid media type."},
+		{"override allows trace", func(c *Conf) { c.Override.Allow = []string{"PUT", "trace"} }, "methodOverride can't allow TRACE."},
+		{"override allows connect", func(c *Conf) { c.Override.Allow = []string{"CONNECT"} }, "methodOverride can't allow CONNECT."},
+		{"override allows put", func(c *Conf) { c.Override.Allow = []string{"PUT", "DELETE"} }, ""},
+		{"allowlist redirect", func(c *Conf) { c.Hosts.Allow, c.Hosts.Redir = []string{"example.com"}, "example.com" }, ""},
+		{"allowlist redirect not listed", func(c *Conf) { c.Hosts.Allow, c.Hosts.Redir = []string{"example.com"}, "other.com" }, "hostAllowlist redirect host other.com is not in the allowlist."},
+		{"zstd level", func(c *Conf) { c.Adv.Zstd = 22 }, ""},
+		{"zstd level too high", func(c *Conf) { c.Adv.Zstd = 23 }, "zstdLevel must be between 0 and 22."},
+		{"tcp keep-alive disabled", func(c *Conf) { c.Adv.KeepAlive = -1 }, ""},
+		{"negative tcp keep-alive", func(c *Conf) { c.Adv.KeepAlive = -2 }, "tcpKeepAlive must be -1 or more."},
+		{"proxy flush immediately", func(c *Conf) { c.Adv.ProxyFlush = -1 }, ""},
+		{"negative proxy flush", func(c *Conf) { c.Adv.ProxyFlush = -2 }, "proxyFlushInterval must be -1 or more."},
+		{"alt-svc", func(c *Conf) { c.Adv.AltSvc = `h3=":443"; ma=86400, h2="alt.example.com:443"` }, ""},
+		{"alt-svc clear", func(c *Conf) { c.Adv.AltSvc = "clear" }, ""},
+		{"alt-svc without port", func(c *Conf) { c.Adv.AltSvc = `h3="example.com"` }, "altSvc must be clear, or a list of protocol=\"host:port\" entries."},
+		{"otlp endpoint", func(c *Conf) { c.Adv.Trace, c.Adv.OTLP = true, "http://collector:4318" }, ""},
+		{"otlp not a url", func(c *Conf) { c.Adv.Trace, c.Adv.OTLP = true, "collector:4318" }, "OTLP endpoint collector:4318 is not a valid http or https URL."},
+		{"otlp without tracing", func(c *Conf) { c.Adv.OTLP = "http://collector:4318" }, "otlpEndpoint is set, but traceContext is disabled."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			tt.modify(c)
+			errs := checkConfig(c)
+			if tt.want == "" {
+				if len(errs) > 0 {
+					t.Errorf("checkConfig() = %v, want no errors", errs)
+				}
+				return
+			}
+			if !strings.Contains(strings.Join(errs, "\n"), tt.want) {
+				t.Errorf("checkConfig() = %v, want %q", errs, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckConfigOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Conf)
+		want   []string
+	}{
+		{"ports", func(c *Conf) { c.Adv.HTTP, c.Adv.HTTPS = 0, 70000 }, []string{
+			"httpPort must be between 1 and 65535.",
+			"sslPort must be between 1 and 65535.",
+		}},
+		{"negative numbers", func(c *Conf) { c.DatTime, c.CachTime, c.Adv.Slow = -1, -1, -1 }, []string{
+			"cachingTimeout must not be negative.",
+			"slowRequest must not be negative.",
+			"streamTimeout must not be negative.",
+		}},
+		{"error pages", func(c *Conf) { c.ErrPage = map[int]string{503: "missing503", 404: "missing404", 500: "missing500"} }, []string{
+			"Error page missing404 does not exist.",
+			"Error page missing500 does not exist.",
+			"Error page missing503 does not exist.",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Maps are iterated in a random order, so the check is repeated to catch an unsorted iteration.
+			for i := 0; i < 10; i++ {
+				c := baseConf()
+				tt.modify(c)
+				if errs := checkConfig(c); !reflect.DeepEqual(errs, tt.want) {
+					t.Fatalf("checkConfig() = %q, want %q", errs, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidAltSvc(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"clear", true},
+		{`h3=":443"`, true},
+		{`h3=":443"; ma=3600`, true},
+		{`h3=":443"; ma=3600; persist=1, h2="alt.example.com:8443"`, true},
+		{`h3=:443`, false},
+		{`h3="example.com"`, false},
+		{`h3=":443",`, false},
+		{`=":443"`, false},
+		{"Clear", false},
+	}
+
+	for _, tt := range tests {
+		if got := validAltSvc(tt.value); got != tt.want {
+			t.Errorf("validAltSvc(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestTestConfig(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name, data string
+		want       int
+	}{
+		{"valid", `{"documentRoot":"html","advanced":{"httpPort":80,"sslPort":443}}`, 0},
+		{"invalid value", `{"documentRoot":"html","advanced":{"httpPort":80,"sslPort":80}}`, 1},
+		{"missing root", `{"documentRoot":"missing","advanced":{"httpPort":80,"sslPort":443}}`, 1},
+		{"unparseable", `{"documentRoot":`, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := writeFile(t, dir, "conf.json", []byte(tt.data))
+			if got := TestConfig(file); got != tt.want {
+				t.Errorf("TestConfig() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	if got := TestConfig(filepath.Join(dir, "missing.json")); got != 1 {
+		t.Errorf("TestConfig() of a missing file = %d, want 1", got)
+	}
+}
@@ -0,0 +1,200 @@
+// KatWeb by kittyhacker101 - Access Log Writing
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	logMu    sync.Mutex
+	logW     io.Writer
+	logOut   *bufio.Writer
+	logSinks []logSink
+)
+
+// logSink is an additional access log file, with it's own log type.
+type logSink struct {
+	file   *os.File
+	format string
+}
+
+// StartLog sets up syslog and buffering for the access log, if they are enabled.
+// Any additional access log files are also opened.
+func StartLog() {
+	for _, l := range conf().Logs {
+		f, err := os.OpenFile(l.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			Print("[Warn] : Unable to open access log " + l.File + "!")
+			continue
+		}
+		logSinks = append(logSinks, logSink{f, l.Format})
+	}
+
+	if conf().Syslog.Run {
+		access, errs, err := dialSyslog()
+		if err == nil {
+			logW = access
+			Logger.SetOutput(cleanWriter{errs})
+			return
+		}
+		Print("[Warn] : Unable to connect to syslog, logging to the console instead!")
+	}
+
+	if conf().Adv.LogBuf > 0 {
+		bufferLog(os.Stdout, conf().Adv.LogBuf*1024, time.Duration(conf().Adv.LogFlush)*time.Second)
+	}
+}
+
+// bufferLog buffers access log entries written to the console, flushing them to dst on an interval if one is set.
+func bufferLog(dst io.Writer, size int, flush time.Duration) {
+	logMu.Lock()
+	logOut = bufio.NewWriterSize(dst, size)
+	logMu.Unlock()
+
+	if flush > 0 {
+		go func() {
+			for range time.Tick(flush) {
+				FlushLog()
+			}
+		}()
+	}
+}
+
+// PrintLog writes an entry to the access log.
+func PrintLog(content string) {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	switch {
+	case logOut != nil:
+		logOut.WriteString(content + "\n")
+	case logW != nil:
+		io.WriteString(logW, content+"\n")
+	default:
+		Print(content)
+	}
+}
+
+// cleanLog escapes control characters in untrusted request data, so it can't be used to split or forge log entries.
+func cleanLog(s string) string {
+	if strings.IndexFunc(s, isControl) == -1 {
+		return s
+	}
+
+	var b strings.Builder
+	for _, c := range s {
+		if isControl(c) {
+			b.WriteString(`\x` + strconv.FormatInt(int64(c)|0x100, 16)[1:])
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// cleanWriter escapes control characters in each entry written to it, other than the newline ending the entry.
+// It is used for the error log, as errors from net/http and httputil can contain untrusted request data.
+type cleanWriter struct {
+	w io.Writer
+}
+
+func (c cleanWriter) Write(b []byte) (int, error) {
+	if _, err := io.WriteString(c.w, cleanLog(strings.TrimSuffix(string(b), "\n"))+"\n"); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// isControl checks if a character is an ASCII control character.
+func isControl(c rune) bool {
+	return c < 0x20 || c == 0x7f
+}
+
+// logTime formats the current time for an access log entry, using the configured timestamp format.
+func logTime() string {
+	now := time.Now()
+	switch conf().Adv.LogTime {
+	case "rfc3339":
+		return now.Format(time.RFC3339)
+	case "unix":
+		return strconv.FormatInt(now.Unix(), 10)
+	default:
+		return now.Format("02/Jan/2006:15:04:05 -0700")
+	}
+}
+
+// writeSink writes an entry to an additional access log file.
+func writeSink(s logSink, content string) {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	s.file.WriteString(content + "\n")
+}
+
+// FlushLog writes any buffered access log entries to the console.
+func FlushLog() {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	if logOut != nil {
+		logOut.Flush()
+	}
+}
+
+// timingKey is the context key for the time a request started, used for the Server-Timing header and proxy deadlines.
+type timingKey struct{}
+
+// addTiming adds a metric to the Server-Timing header, if it is enabled.
+func addTiming(w http.ResponseWriter, r *http.Request, name string, d time.Duration) {
+	if !conf().Adv.Timing {
+		return
+	}
+
+	w.Header().Add("Server-Timing", name+";dur="+strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64))
+}
+
+// tlsInfo returns the negotiated TLS version, cipher suite, and SNI server name of a request, for use in the access log.
+// Requests which do not use TLS have each field replaced with a "-".
+func tlsInfo(r *http.Request) string {
+	if r.TLS == nil {
+		return "- - -"
+	}
+
+	vers := "-"
+	for name, v := range tlsVersions {
+		if v == r.TLS.Version {
+			vers = "TLSv" + name
+		}
+	}
+	sni := r.TLS.ServerName
+	if sni == "" {
+		sni = "-"
+	}
+
+	return vers + " " + tls.CipherSuiteName(r.TLS.CipherSuite) + " " + sni
+}
+
+// timeRequest wraps a http.Handler, printing a warning when a request takes longer than the configured threshold.
+// Websocket requests are not timed, as they are expected to be long-lived.
+func timeRequest(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conf().Adv.Slow <= 0 || r.Header.Get("Upgrade") != "" || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		h.ServeHTTP(w, r)
+		if dur := time.Since(start); dur > time.Duration(conf().Adv.Slow)*time.Millisecond {
+			Print("[Warn] : Slow request to " + cleanLog(trimPort(r.Host)) + r.URL.EscapedPath() + " took " + strconv.FormatInt(int64(dur/time.Millisecond), 10) + "ms.")
+		}
+	})
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer which can be read while the access log is being flushed to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestBufferLog(t *testing.T) {
+	tests := []struct {
+		name     string
+		flush    time.Duration
+		shutdown bool
+	}{
+		{"flush interval", 10 * time.Millisecond, false},
+		{"graceful shutdown", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := &syncBuffer{}
+			bufferLog(dst, 64*1024, tt.flush)
+			t.Cleanup(func() {
+				logMu.Lock()
+				logOut = nil
+				logMu.Unlock()
+			})
+
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					PrintLog("entry " + strconv.Itoa(i))
+				}(i)
+			}
+			wg.Wait()
+
+			if tt.shutdown {
+				if got := dst.String(); got != "" {
+					t.Fatalf("entries written before flushing: %q", got)
+				}
+				FlushLog()
+			}
+
+			deadline := time.Now().Add(2 * time.Second)
+			for strings.Count(dst.String(), "\n") < 50 && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+
+			got := dst.String()
+			if n := strings.Count(got, "\n"); n != 50 {
+				t.Fatalf("flushed %d entries, want 50", n)
+			}
+			for i := 0; i < 50; i++ {
+				if !strings.Contains(got, "entry "+strconv.Itoa(i)+"\n") {
+					t.Errorf("entry %d missing or corrupted", i)
+				}
+			}
+		})
+	}
+}
+
+func TestTimeRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		delay     time.Duration
+		header    string
+		warn      bool
+	}{
+		{"slow request", 10, 30 * time.Millisecond, "", true},
+		{"fast request", 500, 0, "", false},
+		{"disabled", 0, 30 * time.Millisecond, "", false},
+		{"websocket", 10, 30 * time.Millisecond, "Upgrade", false},
+		{"event stream", 10, 30 * time.Millisecond, "Accept", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.Slow = tt.threshold
+			setTestConf(t, c)
+
+			h := timeRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(tt.delay)
+			}))
+			r := httptest.NewRequest("GET", "/slow/page?q=1", nil)
+			r.Host = "example.com:8080"
+			switch tt.header {
+			case "Upgrade":
+				r.Header.Set("Upgrade", "websocket")
+			case "Accept":
+				r.Header.Set("Accept", "text/event-stream")
+			}
+			out := captureOutput(t, func() { h.ServeHTTP(httptest.NewRecorder(), r) })
+
+			if !tt.warn {
+				if out != "" {
+					t.Errorf("printed %q, want no warning", out)
+				}
+				return
+			}
+			if !strings.HasPrefix(out, "[Warn] : Slow request to example.com/slow/page took ") || !strings.HasSuffix(out, "ms.\n") {
+				t.Errorf("printed %q, want a slow request warning", out)
+			}
+		})
+	}
+}
+
+func TestLogTLS(t *testing.T) {
+	lines := make(chan [2]string, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lines <- [2]string{logLine(r, "Web", "", "/", "common"), logLine(r, "Web", "", "/", "simple")}
+	}))
+	srv.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+
+	tests := []struct {
+		name           string
+		tls, enabled   bool
+		server         string
+		common, simple string
+	}{
+		{"tls", true, true, "example.com", " TLSv1.2 TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 example.com", " (TLSv1.2 TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 example.com)"},
+		{"tls without sni", true, true, "", " TLSv1.2 TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 -", " (TLSv1.2 TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 -)"},
+		{"plain http", false, true, "", " - - -", ""},
+		{"disabled", true, false, "example.com", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.LogTLS = tt.enabled
+			setTestConf(t, c)
+
+			var line [2]string
+			if tt.tls {
+				client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+					ServerName:         tt.server,
+					MaxVersion:         tls.VersionTLS12,
+					CipherSuites:       []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+				}}}
+				resp, err := client.Get(srv.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				line = <-lines
+			} else {
+				r := httptest.NewRequest("GET", "/", nil)
+				line = [2]string{logLine(r, "Web", "", "/", "common"), logLine(r, "Web", "", "/", "simple")}
+			}
+
+			if tt.common == "" {
+				if strings.Contains(line[0], "TLS") {
+					t.Errorf("common log = %q, want no TLS fields", line[0])
+				}
+			} else if !strings.HasSuffix(line[0], tt.common) {
+				t.Errorf("common log = %q, want suffix %q", line[0], tt.common)
+			}
+			if tt.simple == "" {
+				if strings.HasSuffix(line[1], ")") {
+					t.Errorf("simple log = %q, want no TLS fields", line[1])
+				}
+			} else if !strings.HasSuffix(line[1], tt.simple) {
+				t.Errorf("simple log = %q, want suffix %q", line[1], tt.simple)
+			}
+		})
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		path    string
+		want    []string
+	}{
+		{"served file", true, "/", []string{"stat", "read", "total"}},
+		{"missing file", true, "/missing.txt", []string{"stat"}},
+		{"disabled", false, "/", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Adv.Timing = tt.enabled
+			setTestConf(t, c)
+
+			w := httptest.NewRecorder()
+			mainHandle(w, httptest.NewRequest("GET", tt.path, nil))
+
+			metrics := w.Header().Values("Server-Timing")
+			if len(metrics) != len(tt.want) {
+				t.Fatalf("Server-Timing = %q, want metrics %q", metrics, tt.want)
+			}
+			durs := make(map[string]float64)
+			for i, m := range metrics {
+				parts := strings.SplitN(m, ";dur=", 2)
+				if len(parts) != 2 || parts[0] != tt.want[i] {
+					t.Fatalf("Server-Timing metric %q, want %s;dur=", m, tt.want[i])
+				}
+				d, err := strconv.ParseFloat(parts[1], 64)
+				if err != nil || d < 0 || d > 10000 {
+					t.Errorf("%s duration = %q, want a plausible number of milliseconds", parts[0], parts[1])
+				}
+				durs[parts[0]] = d
+			}
+			if durs["total"] < durs["read"] {
+				t.Errorf("total %v is less than read %v", durs["total"], durs["read"])
+			}
+		})
+	}
+}
+
+func TestAccessLogs(t *testing.T) {
+	dir := t.TempDir()
+	simple, common, none := filepath.Join(dir, "simple.log"), filepath.Join(dir, "common.log"), filepath.Join(dir, "none.log")
+	loadTestConf(t, `{"accessLogs":[
+		{"file":"`+simple+`","logType":"simple"},
+		{"file":"`+common+`","logType":"common"},
+		{"file":"`+none+`","logType":"none"},
+		{"file":"`+filepath.Join(dir, "missing", "access.log")+`","logType":"simple"}]}`)
+	t.Cleanup(func() {
+		for _, s := range logSinks {
+			s.file.Close()
+		}
+		logSinks = nil
+	})
+
+	if out := captureOutput(t, StartLog); !strings.Contains(out, "[Warn] : Unable to open access log "+filepath.Join(dir, "missing", "access.log")+"!") {
+		t.Errorf("printed %q, want a warning for the missing folder", out)
+	}
+	if len(logSinks) != 3 {
+		t.Fatalf("opened %d access logs, want 3", len(logSinks))
+	}
+	r := httptest.NewRequest("GET", "http://example.com/page", nil)
+	captureOutput(t, func() { logr(r, "WebNotFound", "", "/page") })
+
+	tests := []struct {
+		file, want string
+	}{
+		{simple, "[WebNotFound][example.com/page] : 192.0.2.1:1234\n"},
+		{common, `] "GET /page HTTP/1.1" 404 -` + "\n"},
+		{none, ""},
+	}
+
+	for _, tt := range tests {
+		data, err := ioutil.ReadFile(tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.want == "" && len(data) > 0 || !strings.HasSuffix(string(data), tt.want) {
+			t.Errorf("%s = %q, want suffix %q", filepath.Base(tt.file), data, tt.want)
+		}
+	}
+}
+
+func TestCleanLog(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"/page.html", "/page.html"},
+		{"/a\nb", `/a\x0ab`},
+		{"/a\r\n[Web][forged]", `/a\x0d\x0a[Web][forged]`},
+		{"tab\there", `tab\x09here`},
+		{"del\x7f", `del\x7f`},
+		{"null\x00", `null\x00`},
+		{"/café", "/café"},
+	}
+
+	for _, tt := range tests {
+		if got := cleanLog(tt.in); got != tt.want {
+			t.Errorf("cleanLog(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCleanWriter(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"[Error] : entry\n", "[Error] : entry\n"},
+		{"[Error] : a\r\n[Web][forged]\n", `[Error] : a\x0d\x0a[Web][forged]` + "\n"},
+		{"[Error] : no newline", "[Error] : no newline\n"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if n, err := (cleanWriter{&buf}).Write([]byte(tt.in)); n != len(tt.in) || err != nil {
+			t.Errorf("Write(%q) = %d, %v", tt.in, n, err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("Write(%q) wrote %q, want %q", tt.in, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestLogLineControlCharacters(t *testing.T) {
+	tests := []struct {
+		format, head, host, want string
+	}{
+		{"simple", "WebNotFound", "example.com", `[WebNotFound][example.com/a\x0a[Web][forged]] : 192.0.2.1:1234`},
+		{"common", "WebNotFound", "example.com", `"GET /a\x0a[Web][forged] HTTP/1.1" 404 -`},
+		{"commonvhost", "WebNotFound", "example.com\r", `example.com\x0d 192.0.2.1 - - [`},
+		{"common", "Web", "example.com", `192.0.2.1 - bob\x0aevil [`},
+	}
+
+	setTestConf(t, &Conf{})
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = tt.host
+		r.SetBasicAuth("bob\nevil", "")
+		line := logLine(r, tt.head, "", "/a\n[Web][forged]", tt.format)
+		if strings.ContainsAny(line, "\r\n") || !strings.Contains(line, tt.want) {
+			t.Errorf("%s log = %q, want it to contain %q", tt.format, line, tt.want)
+		}
+	}
+}
+
+func TestLogTime(t *testing.T) {
+	tests := []struct {
+		format string
+		parse  func(string) (time.Time, error)
+	}{
+		{"", func(s string) (time.Time, error) { return time.Parse("02/Jan/2006:15:04:05 -0700", s) }},
+		{"clf", func(s string) (time.Time, error) { return time.Parse("02/Jan/2006:15:04:05 -0700", s) }},
+		{"rfc3339", func(s string) (time.Time, error) { return time.Parse(time.RFC3339, s) }},
+		{"unix", func(s string) (time.Time, error) {
+			n, err := strconv.ParseInt(s, 10, 64)
+			return time.Unix(n, 0), err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.LogTime = tt.format
+			setTestConf(t, c)
+
+			line := logLine(httptest.NewRequest("GET", "/", nil), "Web", "", "/", "common")
+			start, end := strings.IndexByte(line, '['), strings.IndexByte(line, ']')
+			if start < 0 || end < start {
+				t.Fatalf("common log = %q, want a bracketed timestamp", line)
+			}
+			ts, err := tt.parse(line[start+1 : end])
+			if err != nil {
+				t.Fatalf("timestamp %q: %v", line[start+1:end], err)
+			}
+			if d := time.Since(ts); d < -time.Second || d > 2*time.Second {
+				t.Errorf("timestamp %q is %v from now", line[start+1:end], d)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"flag"
@@ -11,50 +12,219 @@ import (
 	"os"
 	"os/signal"
 	"os/user"
+	"path/filepath"
 	"runtime"
 	"runtime/debug"
-	"strconv"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ghodss/yaml"
+	"github.com/klauspost/compress/gzip"
 )
 
 // Conf contains all configuration fields for the server.
 type Conf struct {
-	CachTime int  `json:"cachingTimeout"`
-	DatTime  int  `json:"streamTimeout"`
-	HSTS     bool `json:"hsts"`
+	Root     string `json:"documentRoot"`
+	CachTime int    `json:"cachingTimeout"`
+	DatTime  int    `json:"streamTimeout"`
+	HSTS     bool   `json:"hsts"`
 	Le       struct {
-		Run bool     `json:"enabled"`
-		Loc []string `json:"domains"`
+		Run     bool     `json:"enabled"`
+		Loc     []string `json:"domains"`
+		Timeout int      `json:"challengeTimeout"`
 	} `json:"letsencrypt"`
+	HostTLS []struct {
+		Host    string   `json:"host"`
+		Min     string   `json:"minVersion"`
+		Ciphers []string `json:"ciphers"`
+		CA      string   `json:"clientCA"`
+		Auth    string   `json:"clientAuth"`
+	} `json:"hostTLS"`
 	Proxy []struct {
-		Loc string `json:"location"`
-		URL string `json:"host"`
+		Loc     string            `json:"location"`
+		URL     string            `json:"host"`
+		Hosts   []string          `json:"extraHosts"`
+		Mode    string            `json:"balance"`
+		Sticky  bool              `json:"sticky"`
+		Keep    bool              `json:"keepPrefix"`
+		Headers map[string]string `json:"headers"`
+		Rewrite map[string]string `json:"rewrite"`
 	} `json:"proxy"`
+	ProxyHealth struct {
+		Fails     int    `json:"maxFails"`
+		Cooldown  int    `json:"cooldown"`
+		Path      string `json:"checkPath"`
+		Interval  int    `json:"checkInterval"`
+		Timeout   int    `json:"checkTimeout"`
+		Healthy   int    `json:"healthyThreshold"`
+		Unhealthy int    `json:"unhealthyThreshold"`
+		Retries   int    `json:"retries"`
+	} `json:"proxyHealth"`
+	ProxyConns struct {
+		MaxIdle     int `json:"maxIdle"`
+		MaxIdleHost int `json:"maxIdlePerHost"`
+		IdleTime    int `json:"idleTimeout"`
+	} `json:"proxyConns"`
+	ProxyTLS struct {
+		Verify bool   `json:"verify"`
+		CA     string `json:"caBundle"`
+	} `json:"proxyTLS"`
 	Redir []struct {
-		Loc string `json:"location"`
-		URL string `json:"dest"`
+		Loc  string `json:"location"`
+		URL  string `json:"dest"`
+		Keep bool   `json:"keepMethod"`
 	} `json:"redir"`
-	No  []string `json:"hide"`
+	Preload []struct {
+		Loc   string   `json:"location"`
+		Files []string `json:"files"`
+	} `json:"preload"`
+	Cache []struct {
+		Loc  string `json:"location"`
+		Time int    `json:"time"`
+	} `json:"caching"`
+	Index struct {
+		NoList bool   `json:"disableListing"`
+		Page   string `json:"rootPage"`
+		Redir  string `json:"rootRedirect"`
+		Empty  string `json:"emptyFolder"`
+		EPage  string `json:"emptyPage"`
+	} `json:"index"`
+	Mounts []struct {
+		Loc    string `json:"location"`
+		Root   string `json:"root"`
+		Cache  int    `json:"caching"`
+		NoZip  bool   `json:"disableCompression"`
+		NoList bool   `json:"disableListing"`
+	} `json:"mounts"`
+	No       []string       `json:"hide"`
+	Download []string       `json:"download"`
+	ErrPage  map[int]string `json:"errorPages"`
+	IP       struct {
+		Mode string `json:"mode"`
+		Host string `json:"host"`
+	} `json:"ipRequests"`
+	Hosts struct {
+		Allow []string `json:"allow"`
+		Redir string   `json:"redirect"`
+	} `json:"hostAllowlist"`
+	Headers struct {
+		StripReq  []string `json:"stripRequest"`
+		StripResp []string `json:"stripResponse"`
+	} `json:"headers"`
+	Override struct {
+		Run   bool     `json:"enabled"`
+		Allow []string `json:"methods"`
+	} `json:"methodOverride"`
+	Syslog struct {
+		Run      bool   `json:"enabled"`
+		Net      string `json:"network"`
+		Addr     string `json:"address"`
+		Facility string `json:"facility"`
+		Tag      string `json:"tag"`
+	} `json:"syslog"`
+	Logs []struct {
+		File   string `json:"file"`
+		Format string `json:"logType"`
+	} `json:"accessLogs"`
+	Status struct {
+		Run   bool     `json:"enabled"`
+		Loc   string   `json:"location"`
+		IPs   []string `json:"allow"`
+		Login []string `json:"logins"`
+	} `json:"status"`
+	Robots struct {
+		Run      bool     `json:"enabled"`
+		Site     string   `json:"siteURL"`
+		Allow    []string `json:"allow"`
+		Disallow []string `json:"disallow"`
+		Pages    []string `json:"sitemap"`
+	} `json:"robots"`
+	Probes struct {
+		Run   bool   `json:"enabled"`
+		Live  string `json:"liveLocation"`
+		Ready string `json:"readyLocation"`
+	} `json:"probes"`
 	Adv struct {
-		Dev   bool `json:"devmode"`
-		Pro   bool `json:"protect"`
-		HTTP  int  `json:"httpPort"`
-		HTTPS int  `json:"sslPort"`
+		Dev           bool     `json:"devmode"`
+		Pro           bool     `json:"protect"`
+		HTTP          int      `json:"httpPort"`
+		HTTPS         int      `json:"sslPort"`
+		CertOver      int      `json:"certOverlap"`
+		Flush         int      `json:"flushSize"`
+		LogBuf        int      `json:"logBuffer"`
+		LogFlush      int      `json:"logFlushInterval"`
+		Symlink       bool     `json:"followSymlinks"`
+		ALPN          []string `json:"alpn"`
+		LangIdx       bool     `json:"languageIndex"`
+		Slash         string   `json:"doubleSlashes"`
+		MaxReqs       int      `json:"keepAliveRequests"`
+		WWW           string   `json:"canonicalWWW"`
+		MaxPath       int      `json:"maxPathLength"`
+		MinDisk       int      `json:"minFreeDisk"`
+		DiskRefuse    bool     `json:"lowDiskRefuse"`
+		Slow          int      `json:"slowRequest"`
+		Inflate       bool     `json:"decompressRequests"`
+		MaxBody       int      `json:"maxBodySize"`
+		Upgrade       bool     `json:"upgradeInsecure"`
+		LogTLS        bool     `json:"logTLS"`
+		HostLimit     int      `json:"hostConcurrency"`
+		Hints         bool     `json:"earlyHints"`
+		HTTP10        string   `json:"http10"`
+		NoLog404      bool     `json:"hideNotFound"`
+		Sample404     int      `json:"notFoundSample"`
+		Timing        bool     `json:"serverTiming"`
+		ZipExt        []string `json:"compressExtensions"`
+		MimeDef       string   `json:"defaultMime"`
+		NoSniff       bool     `json:"disableMimeSniff"`
+		Trace         bool     `json:"traceContext"`
+		OTLP          string   `json:"otlpEndpoint"`
+		AllowTrace    bool     `json:"allowTrace"`
+		CopyBuf       int      `json:"copyBuffer"`
+		NoQuery       bool     `json:"stripLogQueries"`
+		Bind          []string `json:"bindAddresses"`
+		NoRanges      bool     `json:"disableRanges"`
+		Overlay       string   `json:"overlayRoot"`
+		LogUpstream   bool     `json:"logUpstream"`
+		ProxyFlush    int      `json:"proxyFlushInterval"`
+		AltSvc        string   `json:"altSvc"`
+		CaseStrict    bool     `json:"strictCase"`
+		ListCache     int      `json:"listingCache"`
+		Zstd          int      `json:"zstdLevel"`
+		Drain         int      `json:"drainTime"`
+		KeepAlive     int      `json:"tcpKeepAlive"`
+		Frame         string   `json:"frameOptions"`
+		NoRefUA       bool     `json:"omitRefererAgent"`
+		MaxHandshakes int      `json:"maxHandshakes"`
+		LogTime       string   `json:"logTime"`
+		ZipLength     int      `json:"compressLengthBuffer"`
+		MaxIdle       int      `json:"maxIdlePerIP"`
+		Base          string   `json:"basePath"`
+		WellKnown     string   `json:"wellKnownRoot"`
+		NoZipUA       []string `json:"noCompressAgents"`
+		GetBody       string   `json:"getBody"`
 	} `json:"advanced"`
+
+	// routes contains the routing state built from the config, so it is replaced together with the config.
+	routes *routes
 }
 
 const currentVersion = "v1.10.2"
 
 var (
-	conf Conf
+	// confv holds the *Conf currently in use. It is only replaced as a whole, so handlers never see a partially applied config.
+	confv atomic.Value
 
 	rootl = flag.String("root", ".", "Root folder location.")
+	confl = flag.String("config", "conf.json", "Configuration file location. JSON, YAML, and TOML files are supported.")
 	svrh  = flag.String("serverName", "KatWeb", `String set in the "server" HTTP header.`)
 	noup  = flag.Bool("ignoreUpdates", false, "Disable checking if KatWeb is up to date.")
 	logt  = flag.String("logType", "none", `Type of logging displayed to the console. Supported values are "none", "simple", "common", "commonvhost", "combined", and "combinedvhost".`)
 	vers  = flag.Bool("version", false, "View info about this KatWeb binary.")
+	testc = flag.Bool("test", false, "Check the configuration for errors, and exit without starting the server.")
 )
 
 // Print writes a message to the console
@@ -64,28 +234,133 @@ func Print(content string) {
 	}
 }
 
-// ParseConfig parses a configuration file into the conf struct
-func ParseConfig(file string) string {
-	data, err := ioutil.ReadFile("conf.json")
+// decodeConfig converts a YAML or TOML configuration file into JSON, based on the file extension.
+func decodeConfig(file string, data []byte) ([]byte, error) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return yaml.YAMLToJSON(data)
+	case ".toml":
+		var tree map[string]interface{}
+		if _, err := toml.Decode(string(data), &tree); err != nil {
+			return nil, err
+		}
+		return json.Marshal(tree)
+	}
+
+	return data, nil
+}
+
+// unzipConfig decompresses a gzipped configuration file.
+func unzipConfig(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
 	if err != nil {
-		return "Unable to read config file!"
+		return nil, err
 	}
-	if json.Unmarshal(data, &conf) != nil {
-		return "Unable to parse config file!"
+	defer gz.Close()
+
+	return ioutil.ReadAll(gz)
+}
+
+// conf returns the config currently in use.
+func conf() *Conf {
+	if c, ok := confv.Load().(*Conf); ok {
+		return c
 	}
+	return &Conf{}
+}
+
+// setConf replaces the config currently in use.
+// The config must not be modified after it has been set.
+func setConf(c *Conf) {
+	confv.Store(c)
+}
 
-	data, err = json.MarshalIndent(conf, "", "  ")
+// loadConfig reads a configuration file into a new Conf struct, without applying it.
+func loadConfig(file string) (*Conf, string) {
+	data, err := ioutil.ReadFile(file)
 	if err != nil {
-		return "Unable to load configuration!"
+		return nil, "Unable to read config file!"
 	}
-	if ioutil.WriteFile("conf.json", data, 0644) != nil {
-		return "Unable to write configuration!"
+	if strings.HasSuffix(strings.ToLower(file), ".gz") || bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		if data, err = unzipConfig(data); err != nil {
+			return nil, "Unable to decompress config file!"
+		}
+		file = strings.TrimSuffix(strings.TrimSuffix(file, ".gz"), ".GZ")
+	}
+
+	next := new(Conf)
+	if data, err = decodeConfig(file, data); err != nil || json.Unmarshal(data, next) != nil {
+		return nil, "Unable to parse config file!"
+	}
+	next.Root = strings.TrimSuffix(filepath.Clean(next.Root), "/")
+	if next.Root == "" || next.Root == "." {
+		next.Root = "html"
+	}
+	sort.Strings(next.No)
+
+	return next, ""
+}
+
+// ParseConfig parses a configuration file into the conf struct
+// Uncompressed JSON configuration files are rewritten to include any missing fields.
+func ParseConfig(file string) string {
+	next, errt := loadConfig(file)
+	if errt != "" {
+		return errt
 	}
 
-	MakeProxyMap()
+	next.routes = MakeProxyMap(next, route())
+	setConf(next)
+	return applyConfig(file)
+}
+
+// ReloadConfig parses and validates a configuration file, then applies it.
+// The new config is only put into use once it has passed validation, so an invalid config never reaches handlers,
+// and the last-good config continues to be used.
+func ReloadConfig(file string) string {
+	next, errt := loadConfig(file)
+	if errt != "" {
+		return errt + " Keeping the current config."
+	}
+	if errs := checkConfig(next); len(errs) > 0 {
+		return "Invalid config file, " + strings.TrimSuffix(strings.Join(errs, " "), ".") + "! Keeping the current config."
+	}
+
+	next.routes = MakeProxyMap(next, route())
+	setConf(next)
+	return applyConfig(file)
+}
+
+// applyConfig rewrites the configuration file to include any missing fields, and loads the settings which depend on it.
+func applyConfig(file string) string {
+	// Gzipped configuration files are not rewritten, so they stay compressed.
+	if data, err := ioutil.ReadFile(file); err == nil && strings.ToLower(filepath.Ext(file)) == ".json" && !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		data, err = json.MarshalIndent(conf(), "", "  ")
+		if err != nil {
+			return "Unable to load configuration!"
+		}
+		if ioutil.WriteFile(file, data, 0644) != nil {
+			return "Unable to write configuration!"
+		}
+	}
+
+	if LoadProxyTransport() != nil {
+		return "Unable to load proxy CA bundle!"
+	}
+
+	StartHealthCheck()
 	return ""
 }
 
+// httpTimeout returns the timeout in seconds used by the HTTP server.
+// If HTTP only serves ACME challenges and HTTPS redirects, it uses it's own timeouts.
+func httpTimeout() int {
+	if conf().Le.Run && conf().HSTS && conf().Le.Timeout > 0 {
+		return conf().Le.Timeout
+	}
+	return conf().DatTime
+}
+
 func main() {
 	flag.Parse()
 	if *vers {
@@ -98,6 +373,10 @@ func main() {
 		Print("[Warn] : Unable to change working directory!")
 	}
 
+	if *testc {
+		os.Exit(TestConfig(*confl))
+	}
+
 	if !*noup {
 		go func() {
 			up, vers, err := CheckUpdate(currentVersion)
@@ -122,35 +401,57 @@ func main() {
 		}()
 	}
 
-	if errt := ParseConfig("conf.json"); errt != "" {
+	if errt := ParseConfig(*confl); errt != "" {
 		Print("[Fatal] : " + errt)
 		os.Exit(1)
 	}
 
+	if LoadCert("ssl/server.crt", "ssl/server.key") != nil {
+		Print("[Fatal] : Unable to load TLS keypair!")
+		os.Exit(1)
+	}
+
+	if !loadALPN() {
+		Print("[Warn] : ALPN protocols must include h2 or http/1.1, using the default protocols.")
+	}
+
+	StartLog()
+	StartDiskCheck()
+	StartTraceExport()
 	debug.SetGCPercent(1250)
 
 	// srv handles all configuration for HTTPS.
 	srv := &http.Server{
-		Addr:              ":" + strconv.Itoa(conf.Adv.HTTPS),
-		Handler:           http.HandlerFunc(mainHandle),
-		TLSConfig:         tlsc,
-		ErrorLog:          Logger,
-		MaxHeaderBytes:    8192,
-		ReadTimeout:       time.Duration(conf.DatTime) * time.Second,
-		ReadHeaderTimeout: time.Duration(conf.DatTime/2) * time.Second,
-		WriteTimeout:      time.Duration(conf.DatTime) * time.Second,
-		IdleTimeout:       time.Duration(conf.DatTime*4) * time.Second,
+		Handler:                      limitConn(timeRequest(http.HandlerFunc(mainHandle))),
+		TLSConfig:                    tlsc,
+		ConnState:                    connState,
+		ConnContext:                  connContext,
+		ErrorLog:                     Logger,
+		MaxHeaderBytes:               8192,
+		ReadTimeout:                  time.Duration(conf().DatTime) * time.Second,
+		ReadHeaderTimeout:            time.Duration(conf().DatTime/2) * time.Second,
+		WriteTimeout:                 time.Duration(conf().DatTime) * time.Second,
+		IdleTimeout:                  time.Duration(conf().DatTime*4) * time.Second,
+		DisableGeneralOptionsHandler: true,
 	}
+	htime := httpTimeout()
 	// srvh handles all configuration for HTTP.
 	srvh := &http.Server{
-		Addr:              ":" + strconv.Itoa(conf.Adv.HTTP),
-		Handler:           wrapLoad(mainHandle),
-		ErrorLog:          Logger,
-		MaxHeaderBytes:    8192,
-		ReadTimeout:       time.Duration(conf.DatTime) * time.Second,
-		ReadHeaderTimeout: time.Duration(conf.DatTime/2) * time.Second,
-		WriteTimeout:      time.Duration(conf.DatTime) * time.Second,
-		IdleTimeout:       time.Duration(conf.DatTime*4) * time.Second,
+		Handler:                      limitConn(timeRequest(wrapLoad(mainHandle))),
+		ConnState:                    connState,
+		ConnContext:                  connContext,
+		ErrorLog:                     Logger,
+		MaxHeaderBytes:               8192,
+		ReadTimeout:                  time.Duration(htime) * time.Second,
+		ReadHeaderTimeout:            time.Duration(htime/2) * time.Second,
+		WriteTimeout:                 time.Duration(htime) * time.Second,
+		IdleTimeout:                  time.Duration(htime*4) * time.Second,
+		DisableGeneralOptionsHandler: true,
+	}
+
+	// Per-host TLS settings are loaded after wrapLoad, so they use the correct certificate source.
+	if err := LoadHostTLS(); err != nil {
+		Print("[Warn] : Unable to load per-host TLS settings, " + err.Error() + "!")
 	}
 
 	// Handle graceful shutdown from crtl+c
@@ -159,32 +460,56 @@ func main() {
 	go func() {
 		<-c
 		Print("\n[Info] : Shutting down KatWeb...")
+		drain()
+		flushSpans()
 		if srvh.Shutdown(context.Background()) != nil {
 			Print("[Warn] : Unable to shutdown server!")
 		}
 		if srv.Shutdown(context.Background()) != nil {
 			Print("[Warn] : Unable to shutdown server!")
 		}
+		FlushLog()
 		os.Exit(0)
 	}()
 
-	// Reload config when a SIGHUP is received
+	// Reload config and keypair when a SIGHUP is received
 	cr := make(chan os.Signal, 1)
 	signal.Notify(cr, syscall.SIGHUP)
 	go func() {
 		for {
 			<-cr
 			Print("[Info] : Reloading config...")
-			if errt := ParseConfig("conf.json"); errt != "" {
+			errt := ReloadConfig(*confl)
+			if errt != "" {
 				Print("[Error] : " + errt)
 			}
-			Print("[Info] : Config reloaded.")
+			if LoadCert("ssl/server.crt", "ssl/server.key") != nil {
+				Print("[Error] : Unable to reload TLS keypair!")
+			}
+			if err := LoadHostTLS(); err != nil {
+				Print("[Error] : Unable to reload per-host TLS settings, " + err.Error() + "!")
+			}
+			if errt == "" {
+				Print("[Info] : Config reloaded.")
+			}
 		}
 	}()
 
 	Print("[Info] : KatWeb Started.")
 
-	go srvh.ListenAndServe()
-	Print("[Fatal] : " + srv.ListenAndServeTLS("ssl/server.crt", "ssl/server.key").Error())
+	errh, errs := make(chan error, len(conf().Adv.Bind)+1), make(chan error, len(conf().Adv.Bind)+1)
+	go func() {
+		for err := range errh {
+			if err != http.ErrServerClosed {
+				Print("[Warn] : Unable to serve HTTP, " + err.Error() + "!")
+			}
+		}
+	}()
+	serveAll(srvh, listenAddrs(conf().Adv.HTTP), false, errh)
+	serveAll(srv, listenAddrs(conf().Adv.HTTPS), true, errs)
+	atomic.StoreInt32(&ready, 1)
+	err := <-errs
+	FlushLog()
+	Print("[Fatal] : " + err.Error())
 	os.Exit(1)
 }
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+func TestDecodeConfig(t *testing.T) {
+	tests := []struct {
+		name, file, data string
+		want             map[string]interface{}
+		err              bool
+	}{
+		{"json", "conf.json", `{"documentRoot":"html","hsts":true}`, map[string]interface{}{"documentRoot": "html", "hsts": true}, false},
+		{"yaml", "conf.yaml", "documentRoot: html\nhsts: true\n", map[string]interface{}{"documentRoot": "html", "hsts": true}, false},
+		{"yml", "conf.YML", "documentRoot: site\n", map[string]interface{}{"documentRoot": "site"}, false},
+		{"toml", "conf.toml", "documentRoot = \"html\"\nhsts = true\n", map[string]interface{}{"documentRoot": "html", "hsts": true}, false},
+		{"nested toml", "conf.toml", "[advanced]\nhttpPort = 8080\n", map[string]interface{}{"advanced": map[string]interface{}{"httpPort": float64(8080)}}, false},
+		{"bad yaml", "conf.yaml", "documentRoot: [html\n", nil, true},
+		{"bad toml", "conf.toml", "documentRoot = \n", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := decodeConfig(tt.file, []byte(tt.data))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("decodeConfig(%q) succeeded, want error", tt.file)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeConfig(%q): %v", tt.file, err)
+			}
+
+			var got map[string]interface{}
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("decodeConfig(%q) returned invalid JSON: %v", tt.file, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeConfig(%q) = %v, want %v", tt.file, got, tt.want)
+			}
+		})
+	}
+}
+
+// setTestConf puts a config into use for the duration of a test.
+func setTestConf(t *testing.T, c *Conf) {
+	t.Helper()
+	prev := conf()
+	if c.routes == nil {
+		c.routes = MakeProxyMap(c, nil)
+	}
+	setConf(c)
+	t.Cleanup(func() { setConf(prev) })
+}
+
+// captureOutput returns the messages printed to the console while running f.
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = prev }()
+
+	out := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		out <- string(data)
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+// loadTestConf decodes a JSON config, and puts it into use for the duration of a test.
+func loadTestConf(t *testing.T, data string) *Conf {
+	t.Helper()
+	c := new(Conf)
+	if err := json.Unmarshal([]byte(data), c); err != nil {
+		t.Fatal(err)
+	}
+	setTestConf(t, c)
+	return c
+}
+
+func TestReloadConfig(t *testing.T) {
+	good, err := ioutil.ReadFile("conf.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, data string
+		ok         bool
+	}{
+		{"unparseable", `{"documentRoot": `, false},
+		{"invalid value", `{"documentRoot": "html", "advanced": {"httpPort": 0, "sslPort": 443}}`, false},
+		{"missing root", strings.Replace(string(good), `"documentRoot": "html"`, `"documentRoot": "missing-folder"`, 1), false},
+		{"valid", string(good), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := &Conf{Root: "html"}
+			old.Adv.HTTP, old.Adv.HTTPS = 8080, 8443
+			setTestConf(t, old)
+
+			file := filepath.Join(t.TempDir(), "conf.json")
+			if err := ioutil.WriteFile(file, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			errt := ReloadConfig(file)
+			if tt.ok {
+				if errt != "" {
+					t.Fatalf("ReloadConfig() = %q, want no error", errt)
+				}
+				if conf() == old || conf().Adv.HTTP != 80 {
+					t.Errorf("ReloadConfig() did not apply the new config")
+				}
+				return
+			}
+
+			if errt == "" {
+				t.Fatalf("ReloadConfig() succeeded, want error")
+			}
+			if conf() != old {
+				t.Errorf("ReloadConfig() replaced the config after a failed reload")
+			}
+
+			// The server keeps serving with the old config.
+			w := httptest.NewRecorder()
+			mainHandle(w, httptest.NewRequest("GET", "http://localhost/", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("request after failed reload returned %d, want 200", w.Code)
+			}
+		})
+	}
+}
+
+func TestReloadRoutes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxied"))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name, host string
+		kept       bool
+	}{
+		{"unchanged location", backend.URL, true},
+		{"changed location", backend.URL + "/v2", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "conf.json")
+			write := func(host string) {
+				data := `{"documentRoot":"html","streamTimeout":5,"advanced":{"httpPort":80,"sslPort":443},"proxy":[{"location":"api","host":"` + host + `"}]}`
+				if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			setTestConf(t, &Conf{})
+			write(backend.URL)
+			if errt := ReloadConfig(file); errt != "" {
+				t.Fatal(errt)
+			}
+			old := route().proxies["api"]
+			atomic.StoreInt32(&old.backends[0].dead, 1)
+
+			// Requests made during reloads always see a complete routing table.
+			stop := make(chan struct{})
+			errs := make(chan string, 1)
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						w := httptest.NewRecorder()
+						mainHandle(w, httptest.NewRequest("GET", "/api/", nil))
+						if w.Body.String() != "proxied" {
+							select {
+							case errs <- w.Body.String():
+							default:
+							}
+							return
+						}
+					}
+				}()
+			}
+			for i := 0; i < 20; i++ {
+				write(tt.host)
+				if errt := ReloadConfig(file); errt != "" {
+					t.Fatal(errt)
+				}
+			}
+			close(stop)
+			wg.Wait()
+			select {
+			case body := <-errs:
+				t.Fatalf("request during reload returned %q, want the proxied response", body)
+			default:
+			}
+
+			u := route().proxies["api"]
+			if kept := u == old && atomic.LoadInt32(&u.backends[0].dead) == 1; kept != tt.kept {
+				t.Errorf("backend health kept across reload = %v, want %v", kept, tt.kept)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRoot(t *testing.T) {
+	tests := []struct {
+		root, want string
+	}{
+		{"", "html"},
+		{".", "html"},
+		{"site/", "site"},
+		{"./site", "site"},
+		{"/srv/www/", "/srv/www"},
+		{"/srv/www/../site", "/srv/site"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.root, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "conf.json")
+			data, _ := json.Marshal(map[string]string{"documentRoot": tt.root})
+			if err := ioutil.WriteFile(file, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			c, errt := loadConfig(file)
+			if errt != "" {
+				t.Fatal(errt)
+			}
+			if c.Root != tt.want {
+				t.Errorf("Root = %q, want %q", c.Root, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPTimeout(t *testing.T) {
+	tests := []struct {
+		name      string
+		le, hsts  bool
+		challenge int
+		want      int
+	}{
+		{"default", false, false, 30, 10},
+		{"challenge and redirect only", true, true, 30, 30},
+		{"challenge timeout unset", true, true, 0, 10},
+		{"serves content", true, false, 30, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{DatTime: 10}
+			c.Le.Run, c.HSTS, c.Le.Timeout = tt.le, tt.hsts, tt.challenge
+			setTestConf(t, c)
+			if got := httpTimeout(); got != tt.want {
+				t.Errorf("httpTimeout() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigGzip(t *testing.T) {
+	zip := func(data string) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write([]byte(data))
+		gz.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name, file string
+		data       []byte
+		want       string
+		errt       string
+	}{
+		{"plain json", "conf.json", []byte(`{"documentRoot":"plain"}`), "plain", ""},
+		{"gzip extension", "conf.json.gz", zip(`{"documentRoot":"zipped"}`), "zipped", ""},
+		{"uppercase extension", "conf.json.GZ", zip(`{"documentRoot":"upper"}`), "upper", ""},
+		{"gzip magic bytes", "conf.json", zip(`{"documentRoot":"magic"}`), "magic", ""},
+		{"gzipped yaml", "conf.yaml.gz", zip("documentRoot: yaml\n"), "yaml", ""},
+		{"not gzipped", "conf.json.gz", []byte(`{"documentRoot":"plain"}`), "", "Unable to decompress config file!"},
+		{"gzipped invalid json", "conf.json.gz", zip(`{"documentRoot":`), "", "Unable to parse config file!"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := writeFile(t, t.TempDir(), tt.file, tt.data)
+			c, errt := loadConfig(file)
+			if errt != tt.errt {
+				t.Fatalf("loadConfig() error = %q, want %q", errt, tt.errt)
+			}
+			if tt.errt == "" && c.Root != tt.want {
+				t.Errorf("documentRoot = %q, want %q", c.Root, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConfigGzip(t *testing.T) {
+	data, err := ioutil.ReadFile("conf.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	gz.Close()
+
+	// The gzipped file has a .json extension, so it would be rewritten if it wasn't detected by it's magic bytes.
+	file := writeFile(t, t.TempDir(), "conf.json", buf.Bytes())
+	setTestConf(t, conf())
+	if errt := ParseConfig(file); errt != "" {
+		t.Fatalf("ParseConfig() = %q", errt)
+	}
+	after, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, buf.Bytes()) {
+		t.Error("gzipped config file was rewritten")
+	}
+}
@@ -0,0 +1,64 @@
+// KatWeb by kittyhacker101 - Static Folder Mounts
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// mountKey is the context key for the index of the mount serving a request.
+type mountKey struct{}
+
+// findMount returns the index of the first mount whose location matches a path, or -1 if none match.
+// Locations match whole path segments, so a mount at /api is used for /api and /api/docs, but not /apiary.
+func findMount(url string) int {
+	for i, m := range conf().Mounts {
+		if loc := strings.TrimSuffix(m.Loc, "/"); url == loc || strings.HasPrefix(url, loc+"/") {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// wellKnown is the path prefix served from the shared .well-known folder.
+const wellKnown = "/.well-known/"
+
+// applyMount checks if a request is inside a mount, and returns the folder and path it should be served from.
+// The mount is added to the request's context, so it's options can be used while serving the request.
+// If no mount matches, requests for /.well-known/ are served from the shared wellKnownRoot folder for every host.
+func applyMount(r *http.Request, path, url string) (*http.Request, string, string, bool) {
+	i := findMount(url)
+	if i == -1 {
+		if conf().Adv.WellKnown != "" && strings.HasPrefix(url, wellKnown) {
+			return r, strings.TrimSuffix(conf().Adv.WellKnown, "/") + "/", url[len(wellKnown)-1:], true
+		}
+		return r, path, url, false
+	}
+
+	m := conf().Mounts[i]
+	url = "/" + strings.TrimPrefix(strings.TrimPrefix(url, strings.TrimSuffix(m.Loc, "/")), "/")
+	return r.WithContext(context.WithValue(r.Context(), mountKey{}, i)), strings.TrimSuffix(m.Root, "/") + "/", url, true
+}
+
+// mountCache returns the caching timeout of the mount serving a request, if it has one.
+func mountCache(r *http.Request) (int, bool) {
+	if i, ok := r.Context().Value(mountKey{}).(int); ok && i < len(conf().Mounts) && conf().Mounts[i].Cache >= 0 {
+		return conf().Mounts[i].Cache, true
+	}
+
+	return 0, false
+}
+
+// mountNoZip checks if compression is disabled for the mount serving a request.
+func mountNoZip(r *http.Request) bool {
+	i, ok := r.Context().Value(mountKey{}).(int)
+	return ok && i < len(conf().Mounts) && conf().Mounts[i].NoZip
+}
+
+// mountNoList checks if directory listings are disabled for the mount serving a request.
+func mountNoList(r *http.Request) bool {
+	i, ok := r.Context().Value(mountKey{}).(int)
+	return ok && i < len(conf().Mounts) && conf().Mounts[i].NoList
+}
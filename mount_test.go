@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyMount(t *testing.T) {
+	tests := []struct {
+		name, url   string
+		mount, path string
+		ok          bool
+	}{
+		{"exact", "/api", "mnt/api/", "/", true},
+		{"subpath", "/api/docs/x.html", "mnt/api/", "/docs/x.html", true},
+		{"sibling prefix", "/apiary", "html/", "/apiary", false},
+		{"trailing slash location", "/static/app.js", "mnt/static/", "/app.js", true},
+		{"trailing slash location exact", "/static", "mnt/static/", "/", true},
+		{"trailing slash sibling", "/staticfiles", "html/", "/staticfiles", false},
+		{"no mount", "/index.html", "html/", "/index.html", false},
+		{"well-known", "/.well-known/security.txt", "shared/", "/security.txt", true},
+		{"well-known subfolder", "/.well-known/acme-challenge/token", "shared/", "/acme-challenge/token", true},
+		{"well-known without slash", "/.well-known", "html/", "/.well-known", false},
+		{"mount before well-known", "/api/.well-known/x", "mnt/api/", "/.well-known/x", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestConf(t, `{"mounts":[{"location":"/api","root":"mnt/api"},{"location":"/static/","root":"mnt/static/"}],"advanced":{"wellKnownRoot":"shared"}}`)
+
+			_, path, url, ok := applyMount(httptest.NewRequest("GET", tt.url, nil), "html/", tt.url)
+			if ok != tt.ok || path != tt.mount || url != tt.path {
+				t.Errorf("applyMount(%q) = %q, %q, %v, want %q, %q, %v", tt.url, path, url, ok, tt.mount, tt.path, tt.ok)
+			}
+		})
+	}
+}
+
+func TestWellKnownRoot(t *testing.T) {
+	shared := t.TempDir()
+	if err := os.Mkdir(filepath.Join(shared, "acme-challenge"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(shared, "acme-challenge"), "token", []byte("challenge"))
+
+	tests := []struct {
+		name, host, path string
+		code             int
+		body             string
+	}{
+		{"default host", "localhost", "/.well-known/acme-challenge/token", 200, "challenge"},
+		{"other host", "example.com", "/.well-known/acme-challenge/token", 200, "challenge"},
+		{"missing file", "example.com", "/.well-known/acme-challenge/missing", 404, "404 Not Found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Adv.WellKnown = shared
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			mainHandle(w, r)
+			if w.Code != tt.code || !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("response = %d %q, want %d %q", w.Code, w.Body.String(), tt.code, tt.body)
+			}
+		})
+	}
+}
+
+func TestMountRequestPath(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, root, "index.html", []byte("mounted index"))
+	writeFile(t, filepath.Join(root, "sub"), "a.txt", []byte("mounted file"))
+
+	tests := []struct {
+		name, path     string
+		code           int
+		location, body string
+		preload        string
+		logged         string
+	}{
+		{"bare mount", "/docs", 301, "/docs/", "", "", ""},
+		{"mount root", "/docs/", 200, "", "mounted index", "</docs/app.css>; rel=preload; as=style", "[Web][localhost/docs/] :"},
+		{"redirect for unmounted path", "/sub/a.txt", 301, "/moved.txt", "", "", ""},
+		{"redirect not applied inside mount", "/docs/sub/a.txt", 200, "", "mounted file", "", "[Web][localhost/docs/sub/a.txt] :"},
+		{"missing file", "/docs/missing.txt", 404, "", "404 Not Found", "", "[WebNotFound][localhost/docs/missing.txt] :"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestProxies(t, `{"documentRoot":"html","mounts":[{"location":"/docs","root":"`+root+`","caching":-1}],
+				"redir":[{"location":"localhost/sub/a.txt","dest":"/moved.txt"}],
+				"preload":[{"location":"/","files":["/home.css"]},{"location":"/docs/","files":["/docs/app.css"]}]}`)
+
+			sink, err := os.Create(filepath.Join(t.TempDir(), "access.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sink.Close()
+			logSinks = []logSink{{sink, "simple"}}
+			defer func() { logSinks = nil }()
+
+			w := httptest.NewRecorder()
+			mainHandle(w, httptest.NewRequest("GET", "http://localhost"+tt.path, nil))
+			if w.Code != tt.code || w.Header().Get("Location") != tt.location || !strings.Contains(w.Body.String(), tt.body) {
+				t.Fatalf("response = %d %q %q, want %d %q %q", w.Code, w.Header().Get("Location"), w.Body.String(), tt.code, tt.location, tt.body)
+			}
+			if link := w.Header().Get("Link"); link != tt.preload {
+				t.Errorf("Link = %q, want %q", link, tt.preload)
+			}
+			logged, err := ioutil.ReadFile(sink.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(logged), tt.logged) {
+				t.Errorf("access log = %q, want %q", logged, tt.logged)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// KatWeb by kittyhacker101 - Content Negotiation
+package main
+
+import (
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// qualityValue is a value from a header using quality values, such as Accept-Language.
+type qualityValue struct {
+	val string
+	q   float64
+}
+
+// parseQuality parses a header using quality values, and sorts the values by preference.
+// Values with a quality of 0 are kept, so they can be used to refuse a value.
+func parseQuality(header string) []qualityValue {
+	var vals []qualityValue
+	for _, p := range strings.Split(header, ",") {
+		v := qualityValue{q: 1}
+		parts := strings.Split(p, ";")
+		v.val = strings.ToLower(strings.TrimSpace(parts[0]))
+		if v.val == "" {
+			continue
+		}
+
+		for _, param := range parts[1:] {
+			param = strings.ToLower(strings.TrimSpace(param))
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q >= 0 && q <= 1 {
+					v.q = q
+				}
+			}
+		}
+		vals = append(vals, v)
+	}
+
+	sort.SliceStable(vals, func(i, j int) bool {
+		return vals[i].q > vals[j].q
+	})
+	return vals
+}
+
+// validTag checks if a language tag only contains letters, numbers, and dashes.
+func validTag(tag string) bool {
+	for _, c := range tag {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+
+	return tag != ""
+}
+
+// findIndex chooses the index file for a folder.
+// If language negotiation is enabled, an index file matching the client's Accept-Language header (such as index.en.html) will be preferred.
+func findIndex(loc string, r *http.Request) string {
+	if !conf().Adv.LangIdx {
+		return loc + IndexFile
+	}
+
+	for _, l := range parseQuality(r.Header.Get("Accept-Language")) {
+		if l.q == 0 || !validTag(l.val) {
+			continue
+		}
+
+		tags := []string{l.val}
+		if i := strings.IndexByte(l.val, '-'); i > 0 {
+			tags = append(tags, l.val[:i])
+		}
+		for _, t := range tags {
+			if _, err := os.Stat(loc + "index." + t + ".html"); err == nil {
+				return loc + "index." + t + ".html"
+			}
+		}
+	}
+
+	return loc + IndexFile
+}
+
+// encExt contains the file extension used for each supported encoding.
+var encExt = map[string]string{
+	"br":   ".br",
+	"zstd": ".zst",
+	"gzip": ".gz",
+}
+
+// encodingQuality finds the quality value for an encoding in a parsed Accept-Encoding header.
+func encodingQuality(vals []qualityValue, enc string) float64 {
+	star := -1.0
+	for _, v := range vals {
+		if v.val == enc || (enc == "gzip" && v.val == "x-gzip") {
+			return v.q
+		}
+		if v.val == "*" {
+			star = v.q
+		}
+	}
+
+	if star >= 0 {
+		return star
+	}
+	if enc == "identity" {
+		return 1
+	}
+	return 0
+}
+
+// preferEncodings sorts the supported encodings by the client's preference, using the Accept-Encoding header.
+// Encodings which the client does not accept are removed. When the client has no preference, br is chosen over gzip.
+func preferEncodings(header string) []string {
+	var (
+		vals = parseQuality(header)
+		encs []qualityValue
+	)
+	for _, enc := range []string{"br", "zstd", "gzip", "identity"} {
+		if q := encodingQuality(vals, enc); q > 0 {
+			encs = append(encs, qualityValue{enc, q})
+		}
+	}
+
+	sort.SliceStable(encs, func(i, j int) bool {
+		return encs[i].q > encs[j].q
+	})
+	prefs := make([]string, len(encs))
+	for i, e := range encs {
+		prefs[i] = e.val
+	}
+	return prefs
+}
+
+// acceptsIdentity checks if the client accepts uncompressed responses.
+// Clients can refuse them with identity;q=0, or with *;q=0 when identity is not listed.
+// Clients which compression is disabled for always accept them.
+func acceptsIdentity(r *http.Request) bool {
+	return noCompress(r) || encodingQuality(parseQuality(r.Header.Get("Accept-Encoding")), "identity") > 0
+}
+
+// acceptsGzip checks if the client accepts gzip compressed responses.
+// Clients which compression is disabled for never accept them.
+func acceptsGzip(r *http.Request) bool {
+	return !noCompress(r) && encodingQuality(parseQuality(r.Header.Get("Accept-Encoding")), "gzip") > 0
+}
+
+// compileNoZip compiles the User-Agent patterns which compression is disabled for.
+// Invalid patterns are skipped, and reported by the config test.
+func compileNoZip(patterns []string) []*regexp.Regexp {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		if re, err := regexp.Compile(p); err == nil {
+			res = append(res, re)
+		}
+	}
+	return res
+}
+
+// noCompress checks if compression is disabled for a client, because it's User-Agent is known to mishandle compressed responses.
+func noCompress(r *http.Request) bool {
+	ua := r.Header.Get("User-Agent")
+	for _, re := range route().noZip {
+		if re.MatchString(ua) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requestEncodings returns the encodings a response to a request can use, sorted by the client's preference.
+func requestEncodings(r *http.Request) []string {
+	if noCompress(r) {
+		return []string{"identity"}
+	}
+
+	return preferEncodings(r.Header.Get("Accept-Encoding"))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestFindIndex(t *testing.T) {
+	dir := t.TempDir() + "/"
+	writeFile(t, dir, IndexFile, []byte("default"))
+	writeFile(t, dir, "index.en.html", []byte("english"))
+	writeFile(t, dir, "index.fr.html", []byte("french"))
+	writeFile(t, dir, "index.pt-br.html", []byte("brazilian portuguese"))
+
+	tests := []struct {
+		name, lang string
+		negotiate  bool
+		want       string
+	}{
+		{"no header", "", true, "default"},
+		{"exact match", "fr", true, "french"},
+		{"region falls back to language", "en-GB", true, "english"},
+		{"region match", "pt-BR", true, "brazilian portuguese"},
+		{"preferred order", "de, fr;q=0.9, en;q=0.8", true, "french"},
+		{"quality order", "en;q=0.5, fr", true, "french"},
+		{"refused language", "fr;q=0, de", true, "default"},
+		{"no variant", "de, ja", true, "default"},
+		{"invalid tag", "../fr", true, "default"},
+		{"disabled", "fr", false, "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.LangIdx = tt.negotiate
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.lang != "" {
+				r.Header.Set("Accept-Language", tt.lang)
+			}
+			w := httptest.NewRecorder()
+			if err := ServeFile(w, r, dir, "/"); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+			if vary := w.Header().Values("Vary"); tt.negotiate != contains(vary, "Accept-Language") {
+				t.Errorf("Vary = %q, want Accept-Language only when negotiating", vary)
+			}
+		})
+	}
+}
+
+func TestPreferEncodings(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", []string{"identity"}},
+		{"gzip, br", []string{"br", "gzip", "identity"}},
+		{"br;q=1, gzip;q=0", []string{"br", "identity"}},
+		{"gzip;q=1, br;q=0.5", []string{"gzip", "identity", "br"}},
+		{"br;q=0.5, gzip;q=0.8, identity;q=0.1", []string{"gzip", "br", "identity"}},
+		{"x-gzip", []string{"gzip", "identity"}},
+		{"*", []string{"br", "zstd", "gzip", "identity"}},
+		{"*;q=0, gzip", []string{"gzip"}},
+		{"identity;q=0, br", []string{"br"}},
+		{"GZIP;Q=0.5, br;q=bad", []string{"br", "identity", "gzip"}},
+	}
+
+	for _, tt := range tests {
+		if got := preferEncodings(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("preferEncodings(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestAcceptsIdentity(t *testing.T) {
+	tests := []struct {
+		header, agent string
+		want          bool
+	}{
+		{"", "", true},
+		{"gzip, br", "", true},
+		{"identity", "", true},
+		{"identity;q=0, gzip", "", false},
+		{"IDENTITY;Q=0", "", false},
+		{"*;q=0", "", false},
+		{"*;q=0, identity", "", true},
+		{"*, identity;q=0", "", false},
+		{"gzip;q=0", "", true},
+		{"identity;q=0, gzip", "OldBrowser/1.0", true},
+	}
+
+	c := &Conf{}
+	c.Adv.NoZipUA = []string{"^OldBrowser/"}
+	setTestConf(t, c)
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tt.header)
+		r.Header.Set("User-Agent", tt.agent)
+		if got := acceptsIdentity(r); got != tt.want {
+			t.Errorf("acceptsIdentity(%q, %q) = %v, want %v", tt.header, tt.agent, got, tt.want)
+		}
+	}
+}
+
+func TestRequestEncodings(t *testing.T) {
+	tests := []struct {
+		name, agent, accept string
+		want                []string
+	}{
+		{"no patterns match", "Mozilla/5.0", "gzip, br", []string{"br", "gzip", "identity"}},
+		{"prefix pattern", "OldBrowser/1.0", "gzip, br", []string{"identity"}},
+		{"substring pattern", "Mozilla/4.0 (compatible; BrokenProxy)", "gzip", []string{"identity"}},
+		{"anchored pattern", "NewOldBrowser/1.0", "gzip", []string{"gzip", "identity"}},
+		{"no user agent", "", "gzip", []string{"gzip", "identity"}},
+	}
+
+	c := &Conf{}
+	c.Adv.NoZipUA = []string{"^OldBrowser/", "BrokenProxy", "[invalid"}
+	setTestConf(t, c)
+	if len(route().noZip) != 2 {
+		t.Fatalf("compiled %d patterns, want invalid patterns skipped", len(route().noZip))
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("User-Agent", tt.agent)
+			r.Header.Set("Accept-Encoding", tt.accept)
+			if got := requestEncodings(r); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("requestEncodings() = %q, want %q", got, tt.want)
+			}
+			if got := noCompress(r); got != (len(tt.want) == 1) {
+				t.Errorf("noCompress() = %v, want %v", got, len(tt.want) == 1)
+			}
+		})
+	}
+}
+
+func TestNoCompressReload(t *testing.T) {
+	tests := []struct {
+		name  string
+		agent string
+	}{
+		{"matching agent", "OldBrowser/1.0"},
+		{"other agent", "Mozilla/5.0"},
+	}
+
+	setTestConf(t, &Conf{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Requests made during reloads see the patterns of either the old or the new config.
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					c := &Conf{}
+					if i%2 == 0 {
+						c.Adv.NoZipUA = []string{"^OldBrowser/"}
+					}
+					c.routes = MakeProxyMap(c, route())
+					setConf(c)
+				}
+			}()
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("User-Agent", tt.agent)
+			r.Header.Set("Accept-Encoding", "gzip")
+			for i := 0; i < 1000; i++ {
+				if got := requestEncodings(r); len(got) == 0 || got[len(got)-1] != "identity" {
+					t.Fatalf("requestEncodings() = %q during a reload", got)
+				}
+			}
+			close(stop)
+			<-done
+		})
+	}
+}
+
+// contains checks if a list of strings contains a value.
+func contains(list []string, val string) bool {
+	for _, v := range list {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
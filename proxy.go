@@ -2,22 +2,26 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
 	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/yhat/wsutil"
+	"github.com/klauspost/compress/gzip"
 )
 
 // UpdateData contains a struct for parsing returned json from the request
@@ -42,156 +46,476 @@ var (
 			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
 			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
 		},
-		InsecureSkipVerify: true,
 	}
 
-	proxy = &httputil.ReverseProxy{
+	// updateClient is the http.Client used for checking the latest version of KatWeb
+	updateClient = &http.Client{
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig:   tlsp,
+		},
+		Timeout: 2 * time.Second,
+	}
+
+	// emptyRoutes is used before a config has been loaded.
+	emptyRoutes = &routes{}
+
+	// proxyTransport holds the *http.Transport used by the reverse proxies.
+	proxyTransport atomic.Value
+)
+
+// newProxy creates the reverse proxy used for proxied requests.
+// A negative flush interval streams proxied responses immediately, and zero only flushes server-sent events.
+func newProxy(flush time.Duration) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		FlushInterval: flush,
 		Director: func(r *http.Request) {
+			if t, ok := r.Context().Value(upstreamKey{}).(*upstreamTime); ok {
+				t.start = time.Now()
+			}
+			setProxyHeaders(r)
 			prox, loc := GetProxy(r)
-			u, err := url.Parse(prox + strings.TrimPrefix(r.URL.String(), "/"+loc))
+			prefix := proxyPrefix(r, loc)
+			u, err := url.Parse(prox + strings.TrimPrefix(r.URL.String(), prefix))
 			if err == nil {
 				r.URL = u
 				return
 			}
-			r.URL = fixProxy(r.URL, loc)
+			r.URL = fixProxy(r.URL, prefix)
 			r.Host = r.URL.Host
 		},
-		ErrorLog: Logger,
-		Transport: &http.Transport{
-			Proxy:               http.ProxyFromEnvironment,
-			TLSClientConfig:     tlsp,
-			MaxIdleConns:        4096,
-			MaxIdleConnsPerHost: 256,
-			IdleConnTimeout:     time.Duration(conf.DatTime*8) * time.Second,
+		ModifyResponse: func(resp *http.Response) error {
+			// Server-sent event streams stay open, so they aren't limited by the write timeout.
+			if rc, ok := resp.Request.Context().Value(sseKey{}).(*http.ResponseController); ok && isEventStream(resp.Header) {
+				rc.SetWriteDeadline(time.Time{})
+			}
+			if b := requestBackend(resp.Request); b != nil {
+				b.succeed()
+			}
+			if t, ok := resp.Request.Context().Value(upstreamKey{}).(*upstreamTime); ok {
+				t.dur = time.Since(t.start)
+			}
+			if b := requestBackend(resp.Request); b != nil && b.pool.rewrite != nil {
+				return rewriteBody(resp, b.pool.rewrite)
+			}
+			return nil
 		},
+		ErrorLog:  Logger,
+		Transport: retryTransport{},
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, e error) {
-			StyledError(w, "502 Bad Gateway", "The server was acting as a proxy and received an invalid response from the upstream server.", http.StatusBadGateway)
-		},
-	}
-
-	wsproxy = &wsutil.ReverseProxy{
-		Director: func(r *http.Request) {
-			prox, loc := GetProxy(r)
-			u, err := url.Parse(prox + strings.TrimPrefix(r.URL.String(), "/"+loc))
-			if err != nil {
-				r.URL = fixProxy(r.URL, loc)
+			// If the client disconnected, no response can be sent.
+			if errors.Is(e, context.Canceled) {
+				logDisconnect(r, getFormattedURL(r))
 				return
 			}
-
-			if r.URL.Scheme == "https" {
-				u.Scheme = "wss://"
-			} else {
-				u.Scheme = "ws://"
+			if b := failedBackend(r, e); b != nil {
+				b.fail()
 			}
-
-			r.URL = u
+			// The error can contain request data, such as the Host header, so it is escaped like the rest of the request.
+			Logger.Print("Unable to proxy " + cleanLog(trimPort(r.Host)+r.URL.EscapedPath()) + ", " + cleanLog(e.Error()) + ".")
+			var ne net.Error
+			if (errors.As(e, &ne) && ne.Timeout()) || errors.Is(e, context.DeadlineExceeded) {
+				setProxyResult(r, "WebProxyTimeout")
+				StyledError(w, r, "504 Gateway Timeout", "The server was acting as a proxy and did not receive a timely response from the upstream server.", http.StatusGatewayTimeout)
+				return
+			}
+			var me *http.MaxBytesError
+			if errors.As(e, &me) {
+				setProxyResult(r, "WebProxyTooLarge")
+				StyledError(w, r, "413 Payload Too Large", "The request body is larger than the server is willing to process.", http.StatusRequestEntityTooLarge)
+				return
+			}
+			setProxyResult(r, "WebProxyError")
+			StyledError(w, r, "502 Bad Gateway", "The server was acting as a proxy and received an invalid response from the upstream server.", http.StatusBadGateway)
 		},
-		ErrorLog:        Logger,
-		TLSClientConfig: tlsp,
 	}
+}
 
-	// updateClient is the http.Client used for checking the latest version of KatWeb
-	updateClient = &http.Client{
-		Transport: &http.Transport{
-			DisableKeepAlives: true,
-			TLSClientConfig:   tlsp,
-		},
-		Timeout: 2 * time.Second,
+// proxyResultKey is the context key for the log type of a proxied request, which is changed when proxying fails.
+type proxyResultKey struct{}
+
+// setProxyResult sets the log type of a proxied request.
+func setProxyResult(r *http.Request, head string) {
+	if h, ok := r.Context().Value(proxyResultKey{}).(*string); ok {
+		*h = head
 	}
+}
 
-	proxyMap, redirMap   sync.Map
-	proxySort, redirSort []string
-	redirRegex           []*regexp.Regexp
-)
+// upstreamKey is the context key for the upstream response time of a proxied request.
+type upstreamKey struct{}
+
+// upstreamTime contains the time taken for an upstream server to respond to a proxied request.
+type upstreamTime struct {
+	start time.Time
+	dur   time.Duration
+}
+
+// withUpstream adds an upstream response timer to a request, for use in the access log.
+func withUpstream(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), upstreamKey{}, new(upstreamTime)))
+}
+
+// upstreamInfo returns the upstream response time of a proxied request in milliseconds, for use in the access log.
+func upstreamInfo(r *http.Request) string {
+	if t, ok := r.Context().Value(upstreamKey{}).(*upstreamTime); ok && t.dur > 0 {
+		return strconv.FormatFloat(float64(t.dur)/float64(time.Millisecond), 'f', 3, 64) + "ms"
+	}
+	return "-"
+}
+
+// sseKey is the context key for the http.ResponseController of a request which accepts server-sent events.
+type sseKey struct{}
+
+// isEventStream checks if a response is a stream of server-sent events.
+func isEventStream(h http.Header) bool {
+	ct := strings.Split(h.Get("Content-Type"), ";")
+	return strings.TrimSpace(strings.ToLower(ct[0])) == "text/event-stream"
+}
 
 // fixProxy proxies requests to the local server if the proxy's URL cannot be parsed
-func fixProxy(u *url.URL, loc string) *url.URL {
+func fixProxy(u *url.URL, prefix string) *url.URL {
 	u = &url.URL{
 		Scheme: "http",
 		Host:   "localhost",
-		Path:   strings.TrimPrefix(u.String(), "/"+loc),
+		Path:   strings.TrimPrefix(u.String(), prefix),
 	}
-	if conf.HSTS {
+	if conf().HSTS {
 		u.Scheme = "https"
-		if conf.Adv.HTTPS != 443 {
-			u.Host = u.Host + ":" + strconv.Itoa(conf.Adv.HTTPS)
+		if conf().Adv.HTTPS != 443 {
+			u.Host = u.Host + ":" + strconv.Itoa(conf().Adv.HTTPS)
 		}
-	} else if conf.Adv.HTTP != 80 {
-		u.Host = u.Host + ":" + strconv.Itoa(conf.Adv.HTTP)
+	} else if conf().Adv.HTTP != 80 {
+		u.Host = u.Host + ":" + strconv.Itoa(conf().Adv.HTTP)
 	}
 
 	return u
 }
 
-// GetProxy finds the correct proxy index to use from the conf.Proxy struct
-func GetProxy(r *http.Request) (string, string) {
-	urlp := strings.Split(getFormattedURL(r), "/")
+// LoadProxyTransport creates the transport used by the reverse proxies, using the upstream TLS verification and connection pool settings.
+// Transports can't be changed while requests are using them, so a new transport replaces the old one, and the old one's idle connections are closed.
+func LoadProxyTransport() error {
+	cfg := tlsp.Clone()
+	cfg.InsecureSkipVerify = !conf().ProxyTLS.Verify
 
-	if i := sort.SearchStrings(proxySort, r.Host); i < len(proxySort) && proxySort[i] == r.Host {
-		if val, ok := proxyMap.Load(r.Host); ok {
-			return val.(string), r.Host
+	if conf().ProxyTLS.CA != "" {
+		data, err := ioutil.ReadFile(conf().ProxyTLS.CA)
+		if err != nil {
+			return err
 		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.New("no certificates found in CA bundle")
+		}
+		cfg.RootCAs = pool
+	}
+
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSClientConfig:       cfg,
+		ResponseHeaderTimeout: time.Duration(conf().DatTime) * time.Second,
+	}
+	loadProxyConns(t)
+
+	if old, ok := proxyTransport.Swap(t).(*http.Transport); ok {
+		old.CloseIdleConnections()
+	}
+	return nil
+}
+
+// currentTransport returns the transport used by the reverse proxies.
+func currentTransport() *http.Transport {
+	if t, ok := proxyTransport.Load().(*http.Transport); ok {
+		return t
 	}
+	return http.DefaultTransport.(*http.Transport)
+}
 
-	if len(urlp) == 0 {
+// loadProxyConns applies the connection pool settings to the transport shared by all proxied requests.
+// Settings which are zero use the defaults, so idle connections to backends are always reused.
+func loadProxyConns(t *http.Transport) {
+	t.MaxIdleConns, t.MaxIdleConnsPerHost = 4096, 256
+	t.IdleConnTimeout = time.Duration(conf().DatTime*8) * time.Second
+	if conf().ProxyConns.MaxIdle > 0 {
+		t.MaxIdleConns = conf().ProxyConns.MaxIdle
+	}
+	if conf().ProxyConns.MaxIdleHost > 0 {
+		t.MaxIdleConnsPerHost = conf().ProxyConns.MaxIdleHost
+	}
+	if conf().ProxyConns.IdleTime > 0 {
+		t.IdleConnTimeout = time.Duration(conf().ProxyConns.IdleTime) * time.Second
+	}
+}
+
+// findProxy finds the backends and location to use from the conf().Proxy struct
+func findProxy(r *http.Request) (*upstreams, string) {
+	rt := route()
+	urlp := strings.Split(getFormattedURL(r), "/")
+
+	if u, ok := rt.proxies[r.Host]; ok {
+		return u, r.Host
+	}
+
+	if len(urlp) < 2 {
+		return nil, ""
+	}
+
+	if u, ok := rt.proxies[urlp[1]]; ok {
+		return u, urlp[1]
+	}
+
+	return nil, ""
+}
+
+// GetProxy finds the correct proxy URL and location to use from the conf().Proxy struct
+// If a backend has been chosen for the request, its URL is returned.
+func GetProxy(r *http.Request) (string, string) {
+	u, loc := findProxy(r)
+	if u == nil {
 		return "", ""
 	}
+	if b := requestBackend(r); b != nil {
+		return b.url, loc
+	}
+
+	return u.backends[0].url, loc
+}
+
+// proxyPrefix returns the prefix which is removed from the path of a proxied request.
+// The proxy location is removed, unless the proxy is configured to keep it.
+func proxyPrefix(r *http.Request, loc string) string {
+	if u, _ := findProxy(r); u != nil && u.keep {
+		return ""
+	}
+	return "/" + loc
+}
+
+// setProxyHeaders adds the configured extra headers to a proxied request.
+// The placeholders {ip}, {host} and {subject} are replaced with the client's IP address, the requested host, and the subject of the client's verified certificate.
+func setProxyHeaders(r *http.Request) {
+	u, _ := findProxy(r)
+	if u == nil || (len(u.headers) == 0 && u.rewrite == nil) {
+		return
+	}
+
+	// Rewritten responses must use an encoding which can be decoded, whatever the client accepts.
+	// Responses which aren't HTML are sent as is, so gzip is only requested from the backend when the client accepts it.
+	if u.rewrite != nil {
+		if acceptsGzip(r) {
+			r.Header.Set("Accept-Encoding", "gzip")
+		} else {
+			r.Header.Set("Accept-Encoding", "identity")
+		}
+	}
+	rep := strings.NewReplacer("{ip}", strings.Trim(trimPort(r.RemoteAddr), "[]"), "{host}", trimPort(r.Host), "{subject}", clientSubject(r))
+	for k, v := range u.headers {
+		r.Header.Set(k, rep.Replace(v))
+	}
+}
+
+// maxRewrite is the largest response body which will be rewritten.
+const maxRewrite = 10 << 20
+
+// rewriteBody replaces strings in the body of a proxied HTML response.
+// Compressed bodies are decompressed first, and bodies which are too large are sent without being rewritten.
+func rewriteBody(resp *http.Response, rep *strings.Replacer) error {
+	ct := strings.Split(resp.Header.Get("Content-Type"), ";")
+	if strings.TrimSpace(strings.ToLower(ct[0])) != "text/html" || resp.ContentLength > maxRewrite {
+		return nil
+	}
 
-	if i := sort.SearchStrings(proxySort, urlp[1]); i < len(proxySort) && proxySort[i] == urlp[1] {
-		if val, ok := proxyMap.Load(urlp[1]); ok {
-			return val.(string), urlp[1]
+	var body io.Reader = resp.Body
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "":
+	case "gzip":
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
 		}
+		body = gz
+	default:
+		return nil
 	}
 
-	return "", ""
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxRewrite+1))
+	if err != nil {
+		return err
+	}
+	resp.Header.Del("Content-Encoding")
+	if len(data) > maxRewrite {
+		resp.Body = gzipBody{io.MultiReader(bytes.NewReader(data), body), resp.Body}
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		return nil
+	}
+	resp.Body.Close()
+
+	data = []byte(rep.Replace(string(data)))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	return nil
+}
+
+// redirDest contains the destination of a redirect.
+type redirDest struct {
+	url  string
+	keep bool
 }
 
 // GetRedir returns the location a url should redirect to.
-func GetRedir(r *http.Request, url string) string {
-	if val, ok := redirMap.Load(r.Host + url); ok {
-		return val.(string)
+// If the redirect should keep the request method, true will also be returned.
+func GetRedir(r *http.Request, url string) (string, bool) {
+	rt := route()
+	if d, ok := rt.redirs[r.Host+url]; ok {
+		return d.url, d.keep
 	}
 
-	for _, re := range redirRegex {
+	for _, re := range rt.redirRegex {
 		if re.FindString(r.Host+url) == r.Host+url {
-			if val, ok := redirMap.Load(re.String()); ok {
-				return val.(string)
+			if d, ok := rt.redirs[re.String()]; ok {
+				return d.url, d.keep
 			}
 		}
 	}
 
-	return ""
+	return "", false
+}
+
+// routes contains the proxy locations, redirects, and other lookup tables built from a config.
+// The routes are built before the config is put into use, and are never modified afterwards,
+// so requests see either the old or the new routing state during a reload, and never a partially built one.
+type routes struct {
+	proxies    map[string]*upstreams
+	redirs     map[string]redirDest
+	redirRegex []*regexp.Regexp
+	noZip      []*regexp.Regexp
+	proxy      *httputil.ReverseProxy
+}
+
+func init() {
+	// The empty routes' proxy looks up the routes of each request, so it can't be created in their declaration.
+	emptyRoutes.proxy = newProxy(0)
+}
+
+// route returns the routing state of the config currently in use.
+func route() *routes {
+	if rt := conf().routes; rt != nil {
+		return rt
+	}
+	return emptyRoutes
 }
 
-// MakeProxyMap converts conf.Proxy and conf.Redir into a map, sorts them, and then compiles any regex used.
-func MakeProxyMap() {
-	proxySort, redirSort = []string{}, []string{}
-	redirRegex = []*regexp.Regexp{}
-	for i := range conf.Proxy {
-		proxyMap.Store(conf.Proxy[i].Loc, conf.Proxy[i].URL)
-		proxySort = append(proxySort, conf.Proxy[i].Loc)
+// MakeProxyMap converts c.Proxy and c.Redir into maps, and then compiles any regex used.
+// Proxy locations whose settings are unchanged from the previous routes keep their backends, so their health state survives a reload.
+func MakeProxyMap(c *Conf, prev *routes) *routes {
+	if prev == nil {
+		prev = emptyRoutes
+	}
+	rt := &routes{
+		proxies: make(map[string]*upstreams, len(c.Proxy)),
+		redirs:  make(map[string]redirDest, len(c.Redir)),
+		noZip:   compileNoZip(c.Adv.NoZipUA),
+		proxy:   newProxy(time.Duration(c.Adv.ProxyFlush) * time.Millisecond),
+	}
+	for i := range c.Proxy {
+		key, _ := json.Marshal(c.Proxy[i])
+		if old, ok := prev.proxies[c.Proxy[i].Loc]; ok && old.key == string(key) {
+			rt.proxies[c.Proxy[i].Loc] = old
+			continue
+		}
+
+		u := newUpstreams(append([]string{c.Proxy[i].URL}, c.Proxy[i].Hosts...))
+		u.key = string(key)
+		u.mode, u.sticky, u.keep, u.headers = c.Proxy[i].Mode, c.Proxy[i].Sticky, c.Proxy[i].Keep, c.Proxy[i].Headers
+		if len(c.Proxy[i].Rewrite) > 0 {
+			var pairs []string
+			for k, v := range c.Proxy[i].Rewrite {
+				pairs = append(pairs, k, v)
+			}
+			u.rewrite = strings.NewReplacer(pairs...)
+			Print("[Warn] : HTML rewriting is enabled for proxy " + c.Proxy[i].Loc + ", responses will be buffered in memory.")
+		}
+		rt.proxies[c.Proxy[i].Loc] = u
 	}
-	for i := range conf.Redir {
-		redirMap.Store(conf.Redir[i].Loc, conf.Redir[i].URL)
-		redirSort = append(redirSort, conf.Redir[i].Loc)
+	for i := range c.Redir {
+		rt.redirs[c.Redir[i].Loc] = redirDest{c.Redir[i].URL, c.Redir[i].Keep}
 
-		regex, err := regexp.Compile(conf.Redir[i].Loc)
-		if err == nil && (strings.Contains(conf.Redir[i].Loc, `\/`) || !strings.ContainsAny(conf.Redir[i].Loc, "/")) {
-			redirRegex = append(redirRegex, regex)
+		regex, err := regexp.Compile(c.Redir[i].Loc)
+		if err == nil && (strings.Contains(c.Redir[i].Loc, `\/`) || !strings.ContainsAny(c.Redir[i].Loc, "/")) {
+			rt.redirRegex = append(rt.redirRegex, regex)
 		}
 	}
-	sort.Strings(proxySort)
-	sort.Strings(redirSort)
-	sort.Strings(conf.No)
+	return rt
 }
 
-// ProxyRequest reverse-proxies a request, or websocket
-func ProxyRequest(w http.ResponseWriter, r *http.Request) {
-	if strings.Contains(r.Header.Get("Connection"), "Upgrade") && strings.Contains(r.Header.Get("Upgrade"), "websocket") {
-		wsproxy.ServeHTTP(w, r)
-	} else {
-		proxy.ServeHTTP(w, r)
+// gzipBody is a body which is read through another reader, such as a decompressor, and closes the original body.
+type gzipBody struct {
+	io.Reader
+	body io.Closer
+}
+
+func (g gzipBody) Close() error {
+	return g.body.Close()
+}
+
+// ProxyRequest reverse-proxies a request, or websocket.
+// The log type of the request is returned, so failed requests are logged with the status sent to the client.
+func ProxyRequest(w http.ResponseWriter, r *http.Request) string {
+	p := route().proxy
+	head := "WebProxy"
+	r = r.WithContext(context.WithValue(r.Context(), proxyResultKey{}, &head))
+	r, b := withBackend(w, r)
+	if b != nil {
+		atomic.AddInt64(&b.conns, 1)
+		defer atomic.AddInt64(&b.conns, -1)
+	}
+
+	// httputil.ReverseProxy tunnels websocket upgrades itself, and removes hop-by-hop headers other than Upgrade.
+	// Upgraded connections are long-lived, so they aren't limited by the server's timeouts.
+	if strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") && strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+		p.ServeHTTP(w, r)
+		return head
+	}
+
+	if conf().Adv.Inflate && strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			StyledError(w, r, "400 Bad Request", "The server cannot process the request due to an apparent client error", http.StatusBadRequest)
+			return "WebBad"
+		}
+		r.Body = gzipBody{gz, r.Body}
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+	}
+	// The body size limit is applied after decompression, to prevent zip bombs.
+	if conf().Adv.MaxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(conf().Adv.MaxBody)*1000000)
+	}
+
+	// Requests for server-sent events are only limited by the time taken for the backend to respond.
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		r = r.WithContext(context.WithValue(r.Context(), sseKey{}, http.NewResponseController(w)))
+		p.ServeHTTP(w, r)
+		return head
+	}
+
+	// The backend request uses the client's context, so it is cancelled if the client disconnects.
+	// The deadline is measured from when the request started, so the time spent before proxying is included.
+	if conf().DatTime > 0 {
+		deadline := time.Now().Add(time.Duration(conf().DatTime) * time.Second)
+		if start, ok := r.Context().Value(timingKey{}).(time.Time); ok {
+			deadline = start.Add(time.Duration(conf().DatTime) * time.Second)
+		}
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		r = r.WithContext(ctx)
 	}
+	p.ServeHTTP(w, r)
+	return head
 }
 
 // CheckUpdate checks if you are using the latest version of KatWeb.
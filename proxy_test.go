@@ -0,0 +1,878 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+func TestLoadProxyTransport(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// Rejected handshakes are expected, so they aren't logged.
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	ca := writeFile(t, dir, "ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	junk := writeFile(t, dir, "junk.pem", []byte("not a certificate"))
+
+	tests := []struct {
+		name   string
+		verify bool
+		ca     string
+		err    bool // if loading the transport fails
+		ok     bool // if a request to the TLS backend succeeds
+	}{
+		{"no verify", false, "", false, true},
+		{"verify unknown CA", true, "", false, false},
+		{"verify with CA bundle", true, ca, false, true},
+		{"missing CA bundle", true, filepath.Join(dir, "missing.pem"), true, false},
+		{"empty CA bundle", true, junk, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{DatTime: 5}
+			c.ProxyTLS.Verify, c.ProxyTLS.CA = tt.verify, tt.ca
+			setTestConf(t, c)
+
+			prev := currentTransport()
+			if err := LoadProxyTransport(); (err != nil) != tt.err {
+				t.Fatalf("LoadProxyTransport() error = %v, want error %v", err, tt.err)
+			}
+			if tt.err {
+				if currentTransport() != prev {
+					t.Error("failed LoadProxyTransport() replaced the transport")
+				}
+				return
+			}
+			if currentTransport() == prev {
+				t.Fatal("LoadProxyTransport() did not replace the transport")
+			}
+
+			resp, err := (&http.Client{Transport: retryTransport{}}).Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err == nil) != tt.ok {
+				t.Errorf("request to TLS backend error = %v, want success %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestLoadProxyConns(t *testing.T) {
+	tests := []struct {
+		name                   string
+		maxIdle, perHost, idle int
+		wantIdle, wantPerHost  int
+		wantTimeout            time.Duration
+	}{
+		{"defaults", 0, 0, 0, 4096, 256, 40 * time.Second},
+		{"custom", 100, 10, 30, 100, 10, 30 * time.Second},
+		{"custom timeout only", 0, 0, 5, 4096, 256, 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{DatTime: 5}
+			c.ProxyConns.MaxIdle, c.ProxyConns.MaxIdleHost, c.ProxyConns.IdleTime = tt.maxIdle, tt.perHost, tt.idle
+			setTestConf(t, c)
+
+			if err := LoadProxyTransport(); err != nil {
+				t.Fatal(err)
+			}
+			tr := currentTransport()
+			if tr.MaxIdleConns != tt.wantIdle || tr.MaxIdleConnsPerHost != tt.wantPerHost || tr.IdleConnTimeout != tt.wantTimeout {
+				t.Errorf("pool = %d, %d, %v, want %d, %d, %v", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout, tt.wantIdle, tt.wantPerHost, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestLoadProxyTransportConcurrent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	setTestConf(t, &Conf{DatTime: 5})
+	if err := LoadProxyTransport(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reloading while requests are in flight must not race with them, which is checked by go test -race.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			resp, err := (&http.Client{Transport: retryTransport{}}).Get(srv.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if err := LoadProxyTransport(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+// loadTestProxies loads a JSON config and builds the proxy map from it, for the duration of a test.
+func loadTestProxies(t *testing.T, data string) {
+	t.Helper()
+	loadTestConf(t, data)
+}
+
+func TestSetProxyHeaders(t *testing.T) {
+	tests := []struct {
+		name, path, remote, host, cn string
+		want                         http.Header
+	}{
+		{"placeholders", "/api/", "192.0.2.1:1234", "example.com:8080", "", http.Header{"X-Real-Ip": {"192.0.2.1"}, "X-Site": {"site example.com"}, "X-Static": {"1"}, "X-Client": {""}}},
+		{"ipv6 client", "/api/", "[2001:db8::1]:1234", "example.com", "", http.Header{"X-Real-Ip": {"2001:db8::1"}, "X-Site": {"site example.com"}, "X-Static": {"1"}, "X-Client": {""}}},
+		{"client certificate", "/api/", "192.0.2.1:1234", "example.com", "alice", http.Header{"X-Real-Ip": {"192.0.2.1"}, "X-Site": {"site example.com"}, "X-Static": {"1"}, "X-Client": {"CN=alice"}}},
+		{"other location", "/plain/", "192.0.2.1:1234", "example.com", "alice", http.Header{"X-Static": {"client"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestProxies(t, `{"proxy":[
+				{"location":"api","host":"http://127.0.0.1:8080","headers":{"X-Real-IP":"{ip}","X-Site":"site {host}","X-Static":"1","X-Client":"{subject}"}},
+				{"location":"plain","host":"http://127.0.0.1:8081"}
+			]}`)
+
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.RemoteAddr, r.Host = tt.remote, tt.host
+			r.Header = http.Header{"X-Static": {"client"}}
+			if tt.cn != "" {
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: tt.cn}}}}}
+			}
+			setProxyHeaders(r)
+			if !reflect.DeepEqual(r.Header, tt.want) {
+				t.Errorf("headers = %v, want %v", r.Header, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetProxyHeadersEncoding(t *testing.T) {
+	tests := []struct {
+		name, path, accept, want string
+	}{
+		{"accepts gzip", "/rewrite/", "gzip, br", "gzip"},
+		{"accepts any", "/rewrite/", "*", "gzip"},
+		{"refuses gzip", "/rewrite/", "gzip;q=0, br", "identity"},
+		{"only brotli", "/rewrite/", "br", "identity"},
+		{"only zstd", "/rewrite/", "zstd", "identity"},
+		{"no header", "/rewrite/", "", "identity"},
+		{"not rewritten", "/plain/", "gzip, br", "gzip, br"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestProxies(t, `{"proxy":[
+				{"location":"rewrite","host":"http://127.0.0.1:8080","rewrite":{"a":"b"}},
+				{"location":"plain","host":"http://127.0.0.1:8081","headers":{"X-Test":"1"}}
+			]}`)
+
+			r := httptest.NewRequest("GET", tt.path, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+			setProxyHeaders(r)
+			if got := r.Header.Get("Accept-Encoding"); got != tt.want {
+				t.Errorf("Accept-Encoding = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteBody(t *testing.T) {
+	gzipped := func(s string) string {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write([]byte(s))
+		gz.Close()
+		return buf.String()
+	}
+
+	tests := []struct {
+		name, ctype, encoding, body string
+		want, wantEncoding          string
+	}{
+		{"html", "text/html; charset=utf-8", "", "<a href=http://old>", "<a href=http://new>", ""},
+		{"gzip html", "text/html", "gzip", gzipped("<a href=http://old>"), "<a href=http://new>", ""},
+		{"not html", "text/plain", "", "http://old", "http://old", ""},
+		{"gzip not html", "application/json", "gzip", gzipped("http://old"), gzipped("http://old"), "gzip"},
+		{"unknown encoding", "text/html", "br", "http://old", "http://old", "br"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				Header:        http.Header{"Content-Type": {tt.ctype}},
+				Body:          ioutil.NopCloser(strings.NewReader(tt.body)),
+				ContentLength: int64(len(tt.body)),
+			}
+			if tt.encoding != "" {
+				resp.Header.Set("Content-Encoding", tt.encoding)
+			}
+			if err := rewriteBody(resp, strings.NewReplacer("http://old", "http://new")); err != nil {
+				t.Fatal(err)
+			}
+
+			data, _ := ioutil.ReadAll(resp.Body)
+			if string(data) != tt.want {
+				t.Errorf("body = %q, want %q", data, tt.want)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+		})
+	}
+}
+
+func TestProxyErrorPages(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "http://" + l.Addr().String()
+	l.Close()
+
+	dir := t.TempDir()
+	page502 := writeFile(t, dir, "502.html", []byte("custom bad gateway"))
+	page504 := writeFile(t, dir, "504.html", []byte("custom gateway timeout"))
+
+	tests := []struct {
+		name, backend string
+		pages         bool
+		code          int
+		body, head    string
+	}{
+		{"down backend", down, true, 502, "custom bad gateway", "WebProxyError"},
+		{"slow backend", slow.URL, true, 504, "custom gateway timeout", "WebProxyTimeout"},
+		{"down backend default page", down, false, 502, "502 Bad Gateway", "WebProxyError"},
+		{"slow backend default page", slow.URL, false, 504, "504 Gateway Timeout", "WebProxyTimeout"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pages := "{}"
+			if tt.pages {
+				pages = `{"502":"` + page502 + `","504":"` + page504 + `"}`
+			}
+			loadTestProxies(t, `{"streamTimeout":1,"errorPages":`+pages+`,"proxy":[{"location":"site","host":"`+tt.backend+`/"}]}`)
+			if err := LoadProxyTransport(); err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			head := ProxyRequest(w, httptest.NewRequest("GET", "/site/page", nil))
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if head != tt.head {
+				t.Errorf("log type = %s, want %s", head, tt.head)
+			}
+			if !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("body = %q, want it to contain %q", w.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+func TestProxyErrorLog(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "http://" + l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		name, host, want string
+	}{
+		{"host", "example.com", "example.com/page"},
+		{"host with newline", "example.com\r\n[Error] : forged", `example.com\x0d\x0a[Error] : forged/page`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestProxies(t, `{"proxy":[{"location":"site","host":"`+down+`"}]}`)
+			if err := LoadProxyTransport(); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			Logger.SetOutput(&buf)
+			t.Cleanup(func() { Logger.SetOutput(cleanWriter{os.Stderr}) })
+
+			r := httptest.NewRequest("GET", "/site/page", nil)
+			r.Host = tt.host
+			ProxyRequest(httptest.NewRecorder(), r)
+
+			out := buf.String()
+			if strings.Count(out, "\n") != 1 || strings.Contains(out, "\r") || !strings.Contains(out, tt.want) {
+				t.Errorf("error log = %q, want one entry containing %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyErrorAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxied"))
+	}))
+	defer backend.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "http://" + l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		name, backend, format, want string
+	}{
+		{"proxied", backend.URL, "common", `"GET /site/page HTTP/1.1" 200 -`},
+		{"down backend", down, "common", `"GET /site/page HTTP/1.1" 502 -`},
+		{"down backend simple", down, "simple", "[WebProxyError][example.com/site/page]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestProxies(t, `{"documentRoot":"html","proxy":[{"location":"site","host":"`+tt.backend+`"}]}`)
+			if err := LoadProxyTransport(); err != nil {
+				t.Fatal(err)
+			}
+			sink, err := os.Create(filepath.Join(t.TempDir(), "access.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sink.Close()
+			logSinks = []logSink{{sink, tt.format}}
+			defer func() { logSinks = nil }()
+
+			mainHandle(httptest.NewRecorder(), httptest.NewRequest("GET", "/site/page", nil))
+			data, err := ioutil.ReadFile(sink.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Count(string(data), "\n") != 1 || !strings.Contains(string(data), tt.want) {
+				t.Errorf("access log = %q, want one entry containing %q", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyMethodOverride(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method + " " + r.Header.Get("X-HTTP-Method-Override")))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		override string
+		want     string
+	}{
+		{"enabled", true, "PUT", "PUT "},
+		{"disabled", false, "PUT", "POST PUT"},
+		{"not allowed", true, "PATCH", "POST "},
+		{"refused method", true, "TRACE", "POST "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestProxies(t, `{"documentRoot":"html","streamTimeout":5,"methodOverride":{"enabled":`+strconv.FormatBool(tt.enabled)+`,"methods":["PUT","DELETE"]},
+				"proxy":[{"location":"api","host":"`+backend.URL+`/"}]}`)
+			if err := LoadProxyTransport(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest("POST", "/api/items", nil)
+			r.Header.Set("X-HTTP-Method-Override", tt.override)
+			w := httptest.NewRecorder()
+			mainHandle(w, r)
+			if w.Body.String() != tt.want {
+				t.Errorf("backend received %q, want %q", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyDecompressRequest(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		w.Header().Set("X-Request-Encoding", r.Header.Get("Content-Encoding"))
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	zip := func(data []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(data)
+		gz.Close()
+		return buf.Bytes()
+	}
+	var (
+		hello = []byte("hello world")
+		bomb  = bytes.Repeat([]byte{0}, 2000001)
+	)
+
+	tests := []struct {
+		name    string
+		inflate bool
+		maxBody int
+		enc     string
+		body    []byte
+		code    int
+		head    string
+		wantEnc string
+		want    []byte
+	}{
+		{"gzip body", true, 0, "gzip", zip(hello), 200, "WebProxy", "", hello},
+		{"gzip body uppercase", true, 0, "GZIP", zip(hello), 200, "WebProxy", "", hello},
+		{"decompression disabled", false, 0, "gzip", zip(hello), 200, "WebProxy", "gzip", zip(hello)},
+		{"plain body", true, 0, "", hello, 200, "WebProxy", "", hello},
+		{"invalid gzip", true, 0, "gzip", hello, 400, "WebBad", "", nil},
+		{"under size limit", true, 1, "gzip", zip(hello), 200, "WebProxy", "", hello},
+		{"zip bomb", true, 1, "gzip", zip(bomb), 413, "WebProxyTooLarge", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestProxies(t, `{"advanced":{"decompressRequests":`+strconv.FormatBool(tt.inflate)+`,"maxBodySize":`+strconv.Itoa(tt.maxBody)+`},`+
+				`"proxy":[{"location":"api","host":"`+backend.URL+`/"}]}`)
+			if err := LoadProxyTransport(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest("POST", "/api/upload", bytes.NewReader(tt.body))
+			if tt.enc != "" {
+				r.Header.Set("Content-Encoding", tt.enc)
+			}
+			w := httptest.NewRecorder()
+			head := ProxyRequest(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if head != tt.head {
+				t.Errorf("log type = %s, want %s", head, tt.head)
+			}
+			if tt.code != 200 {
+				return
+			}
+			if got := w.Header().Get("X-Request-Encoding"); got != tt.wantEnc {
+				t.Errorf("backend Content-Encoding = %q, want %q", got, tt.wantEnc)
+			}
+			if !bytes.Equal(w.Body.Bytes(), tt.want) {
+				t.Errorf("backend received %q, want %q", w.Body.Bytes(), tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyDeadline(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(300 * time.Millisecond):
+			w.Write([]byte("done"))
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name    string
+		started time.Duration
+		timed   bool
+		code    int
+	}{
+		{"started now", 0, true, 200},
+		{"most of the deadline used", 900 * time.Millisecond, true, 504},
+		{"no start time", 0, false, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestProxies(t, `{"streamTimeout":1,"proxy":[{"location":"site","host":"`+backend.URL+`/"}]}`)
+			if err := LoadProxyTransport(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest("GET", "/site/page", nil)
+			if tt.timed {
+				r = r.WithContext(context.WithValue(r.Context(), timingKey{}, time.Now().Add(-tt.started)))
+			}
+			start := time.Now()
+			w := httptest.NewRecorder()
+			ProxyRequest(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if tt.code == 504 && time.Since(start) > 250*time.Millisecond {
+				t.Errorf("request took %v, want the deadline to include the time before proxying", time.Since(start))
+			}
+		})
+	}
+}
+
+func TestLogUpstream(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer backend.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := "http://" + l.Addr().String()
+	l.Close()
+
+	tests := []struct {
+		name, backend, head string
+		enabled             bool
+		want                string
+	}{
+		{"proxied", backend.URL, "WebProxy", true, "ms"},
+		{"backend down", down, "WebProxyError", true, "-"},
+		{"not proxied", backend.URL, "Web", true, ""},
+		{"disabled", backend.URL, "WebProxy", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestProxies(t, `{"streamTimeout":5,"advanced":{"logUpstream":`+strconv.FormatBool(tt.enabled)+`},"proxy":[{"location":"site","host":"`+tt.backend+`"}]}`)
+			if err := LoadProxyTransport(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest("GET", "/site/page", nil)
+			if tt.enabled {
+				r = withUpstream(r)
+			}
+			if head := ProxyRequest(httptest.NewRecorder(), r); tt.head != "Web" && head != tt.head {
+				t.Errorf("ProxyRequest = %s, want %s", head, tt.head)
+			}
+
+			simple, common := logLine(r, tt.head, "", "/site/page", "simple"), logLine(r, tt.head, "", "/site/page", "common")
+			if tt.want == "" {
+				if strings.Contains(simple, "upstream") || strings.HasSuffix(common, "ms") {
+					t.Errorf("log lines = %q, %q, want no upstream time", simple, common)
+				}
+				return
+			}
+
+			info := upstreamInfo(r)
+			if tt.want == "ms" {
+				d, err := strconv.ParseFloat(strings.TrimSuffix(info, "ms"), 64)
+				if err != nil || d < 20 {
+					t.Errorf("upstream time = %q, want at least 20ms", info)
+				}
+			} else if info != tt.want {
+				t.Errorf("upstream time = %q, want %q", info, tt.want)
+			}
+			if !strings.HasSuffix(simple, " (upstream "+info+")") {
+				t.Errorf("simple log = %q, want the upstream time %s", simple, info)
+			}
+			if !strings.HasSuffix(common, " "+info) {
+				t.Errorf("common log = %q, want the upstream time %s", common, info)
+			}
+		})
+	}
+}
+
+func TestProxyFlushInterval(t *testing.T) {
+	release := make(chan struct{})
+	// The response has a length, as responses of unknown length are always streamed immediately.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	tests := []struct {
+		name     string
+		interval int
+		want     time.Duration
+		streams  bool
+	}{
+		{"default", 0, 0, false},
+		{"immediate", -1, -time.Millisecond, true},
+		{"interval", 50, 50 * time.Millisecond, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Reloads create a new proxy, so requests being served by the old one are unaffected.
+			prev := route().proxy
+			prevFlush := prev.FlushInterval
+			loadTestProxies(t, `{"documentRoot":"html","streamTimeout":5,"advanced":{"proxyFlushInterval":`+strconv.Itoa(tt.interval)+`},"proxy":[{"location":"stream","host":"`+backend.URL+`"}]}`)
+			if err := LoadProxyTransport(); err != nil {
+				t.Fatal(err)
+			}
+			if got := route().proxy.FlushInterval; got != tt.want {
+				t.Fatalf("FlushInterval = %v, want %v", got, tt.want)
+			}
+			if route().proxy == prev || prev.FlushInterval != prevFlush {
+				t.Error("reload changed the proxy in use instead of replacing it")
+			}
+
+			srv := httptest.NewServer(http.HandlerFunc(mainHandle))
+			defer srv.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/stream/events", nil)
+
+			// Without flushing, not even the headers are sent until the backend finishes.
+			read := make(chan string, 1)
+			go func() {
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					return
+				}
+				defer resp.Body.Close()
+				buf := make([]byte, 5)
+				n, _ := io.ReadFull(resp.Body, buf)
+				read <- string(buf[:n])
+			}()
+			select {
+			case got := <-read:
+				if !tt.streams || got != "first" {
+					t.Errorf("client read %q before the backend finished, want streaming %v", got, tt.streams)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if tt.streams {
+					t.Error("the first chunk was not flushed to the client")
+				}
+			}
+		})
+	}
+}
+
+func TestIsEventStream(t *testing.T) {
+	tests := []struct {
+		ctype string
+		want  bool
+	}{
+		{"text/event-stream", true},
+		{"text/event-stream; charset=utf-8", true},
+		{"Text/Event-Stream", true},
+		{"text/html", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		h := http.Header{}
+		h.Set("Content-Type", tt.ctype)
+		if got := isEventStream(h); got != tt.want {
+			t.Errorf("isEventStream(%q) = %v, want %v", tt.ctype, got, tt.want)
+		}
+	}
+}
+
+func TestProxyEventStream(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			w.Header().Set("Content-Type", "text/event-stream")
+		}
+		for i := 0; i < 5; i++ {
+			io.WriteString(w, "data: "+strconv.Itoa(i)+"\n\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(60 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name, path, accept string
+		complete           bool
+	}{
+		{"event stream", "/events", "text/event-stream", true},
+		{"not an event stream", "/page", "text/event-stream", false},
+		{"not requested", "/events", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loadTestProxies(t, `{"documentRoot":"html","streamTimeout":5,"proxy":[{"location":"live","host":"`+backend.URL+`"}]}`)
+			if err := LoadProxyTransport(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The stream takes longer than the write timeout, so it is only completed if the timeout is lifted.
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(mainHandle))
+			srv.Config.WriteTimeout = 150 * time.Millisecond
+			srv.Start()
+			defer srv.Close()
+
+			req, _ := http.NewRequest("GET", srv.URL+"/live"+tt.path, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				if tt.complete {
+					t.Fatal(err)
+				}
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if got := strings.Contains(string(body), "data: 4"); got != tt.complete {
+				t.Errorf("body = %q, want the whole stream %v", body, tt.complete)
+			}
+		})
+	}
+}
+
+func TestProxyWebsocketHeaders(t *testing.T) {
+	got := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header.Clone()
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		brw.Flush()
+		line, _ := brw.ReadString('\n')
+		conn.Write([]byte("echo " + line))
+	}))
+	defer backend.Close()
+
+	loadTestProxies(t, `{"documentRoot":"html","streamTimeout":5,"proxy":[{"location":"ws","host":"`+backend.URL+`"}]}`)
+	if err := LoadProxyTransport(); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(mainHandle))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /ws/socket HTTP/1.1\r\nHost: example.com\r\nConnection: keep-alive, Upgrade, X-Custom\r\nUpgrade: websocket\r\n"+
+		"X-Custom: 1\r\nX-Kept: 1\r\nKeep-Alive: timeout=5\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\nTe: deflate\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+
+	h := <-got
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"Upgrade", true},
+		{"Connection", true},
+		{"X-Kept", true},
+		{"X-Custom", false},
+		{"Keep-Alive", false},
+		{"Proxy-Authorization", false},
+		{"Te", false},
+	}
+	for _, tt := range tests {
+		if sent := h.Get(tt.header) != ""; sent != tt.want {
+			t.Errorf("backend received %s = %q, want it sent %v", tt.header, h.Get(tt.header), tt.want)
+		}
+	}
+	if !strings.EqualFold(h.Get("Connection"), "Upgrade") {
+		t.Errorf("backend received Connection = %q, want only Upgrade", h.Get("Connection"))
+	}
+
+	io.WriteString(conn, "hello\n")
+	if line, err := br.ReadString('\n'); err != nil || line != "echo hello\n" {
+		t.Errorf("tunnel read %q, %v, want echo hello", line, err)
+	}
+}
+
+func TestProxyKeepPrefix(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name, host, path string
+		keep             bool
+		want             string
+	}{
+		{"prefix removed", "example.com", "/api/items?page=2", false, "/items?page=2"},
+		{"prefix kept", "example.com", "/api/items?page=2", true, "/api/items?page=2"},
+		{"location root kept", "example.com", "/api/", true, "/api/"},
+		{"host location", "api.example.com", "/items", false, "/items"},
+		{"host location kept", "api.example.com", "/items", true, "/items"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep := strconv.FormatBool(tt.keep)
+			loadTestProxies(t, `{"documentRoot":"html","streamTimeout":5,"proxy":[
+				{"location":"api","host":"`+backend.URL+`","keepPrefix":`+keep+`},
+				{"location":"api.example.com","host":"`+backend.URL+`","keepPrefix":`+keep+`}]}`)
+			if err := LoadProxyTransport(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			mainHandle(w, r)
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("backend received %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
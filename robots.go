@@ -0,0 +1,67 @@
+// KatWeb by kittyhacker101 - Generated robots.txt and sitemap.xml
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+var (
+	robotsTmpl = template.Must(template.New("robots").Parse(`User-agent: *
+{{range .Allow}}Allow: {{.}}
+{{end}}{{range .Disallow}}Disallow: {{.}}
+{{end}}{{if .Pages}}
+Sitemap: {{.Site}}/sitemap.xml
+{{end}}`))
+
+	sitemapTmpl = template.Must(template.New("sitemap").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+{{range .Pages}}<url><loc>{{xml $.Site}}{{xml .}}</loc></url>
+{{end}}</urlset>
+`))
+)
+
+// xmlEscape escapes a string for use in XML text.
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// robotsData contains the values used to render robots.txt and sitemap.xml.
+type robotsData struct {
+	Site     string
+	Allow    []string
+	Disallow []string
+	Pages    []string
+}
+
+// RobotsHandle serves a generated robots.txt or sitemap.xml, and returns false if the request is not for either of them.
+func RobotsHandle(w http.ResponseWriter, r *http.Request, url string) bool {
+	var (
+		tmpl  *template.Template
+		ctype string
+	)
+	switch url {
+	case "/robots.txt":
+		tmpl, ctype = robotsTmpl, "text/plain; charset=utf-8"
+	case "/sitemap.xml":
+		if len(conf().Robots.Pages) == 0 {
+			return false
+		}
+		tmpl, ctype = sitemapTmpl, "application/xml; charset=utf-8"
+	default:
+		return false
+	}
+
+	var buf bytes.Buffer
+	if tmpl.Execute(&buf, robotsData{strings.TrimSuffix(conf().Robots.Site, "/"), conf().Robots.Allow, conf().Robots.Disallow, conf().Robots.Pages}) != nil {
+		return false
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Write(buf.Bytes())
+	return true
+}
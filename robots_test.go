@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRobotsHandle(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "index.html", []byte("index"))
+
+	tests := []struct {
+		name, path string
+		enabled    bool
+		pages      []string
+		onDisk     bool
+		code       int
+		ctype      string
+		body       string
+	}{
+		{"robots.txt", "/robots.txt", true, []string{"/", "/about.html"}, false, 200, "text/plain; charset=utf-8",
+			"User-agent: *\nAllow: /public/\nDisallow: /private/\nDisallow: /tmp/\n\nSitemap: https://example.com/sitemap.xml\n"},
+		{"robots.txt without sitemap", "/robots.txt", true, nil, false, 200, "text/plain; charset=utf-8",
+			"User-agent: *\nAllow: /public/\nDisallow: /private/\nDisallow: /tmp/\n"},
+		{"sitemap.xml", "/sitemap.xml", true, []string{"/", "/search?a=1&b=2"}, false, 200, "application/xml; charset=utf-8",
+			"<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<urlset xmlns=\"http://www.sitemaps.org/schemas/sitemap/0.9\">\n" +
+				"<url><loc>https://example.com/</loc></url>\n<url><loc>https://example.com/search?a=1&amp;b=2</loc></url>\n</urlset>\n"},
+		{"sitemap.xml without pages", "/sitemap.xml", true, nil, false, 404, "", ""},
+		{"file on disk", "/robots.txt", true, nil, true, 200, "text/plain; charset=utf-8", "User-agent: *\nDisallow: /\n"},
+		{"disabled", "/robots.txt", false, nil, false, 404, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := root
+			if tt.onDisk {
+				dir = t.TempDir()
+				writeFile(t, dir, "robots.txt", []byte(tt.body))
+			}
+			c := baseConf()
+			c.Root = dir
+			c.Robots.Run, c.Robots.Site, c.Robots.Pages = tt.enabled, "https://example.com/", tt.pages
+			c.Robots.Allow, c.Robots.Disallow = []string{"/public/"}, []string{"/private/", "/tmp/"}
+			setTestConf(t, c)
+
+			w := httptest.NewRecorder()
+			mainHandle(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if tt.code != 200 {
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tt.ctype {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.ctype)
+			}
+			if w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.body)
+			}
+		})
+	}
+}
@@ -2,23 +2,41 @@
 package main
 
 import (
+	"bytes"
+	"container/list"
+	"errors"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sync/singleflight"
 )
 
 // IndexFile is the file name for directory index files
 const IndexFile = "index.html"
 
+// maxListings is the number of directory listings kept by the listing cache.
+const maxListings = 1024
+
+// errNoIndex is returned by ServeFile when a folder has no index file, and directory listings are disabled.
+var errNoIndex = errors.New("no index file present")
+
+// errNotAcceptable is returned by ServeFile when the client refuses uncompressed responses, and no compressed version of the file is available.
+var errNotAcceptable = errors.New("no acceptable encoding available")
+
 var (
 	zippers = sync.Pool{New: func() interface{} {
 		gz, err := gzip.NewWriterLevel(nil, gzip.BestCompression)
@@ -27,7 +45,11 @@ var (
 		}
 		return gz
 	}}
-	gztypes = []string{"application/javascript", "application/json", "application/x-javascript", "image/svg+xml", "text/css", "text/csv", "text/html", "text/plain", "text/xml"}
+	zipGroup  singleflight.Group
+	compress  = zipFile
+	copyBufs  sync.Pool
+	listCache = &listingCache{order: list.New(), items: make(map[string]*list.Element)}
+	gztypes   = []string{"application/javascript", "application/json", "application/x-javascript", "image/svg+xml", "text/css", "text/csv", "text/html", "text/plain", "text/xml"}
 )
 
 // ServeFile writes the contents of a file or directory into the HTTP response
@@ -35,6 +57,7 @@ func ServeFile(w http.ResponseWriter, r *http.Request, loc string, folder string
 	var (
 		location = loc
 		filen    *os.File
+		start    = time.Now()
 	)
 
 	finfo, err := os.Stat(loc)
@@ -43,15 +66,21 @@ func ServeFile(w http.ResponseWriter, r *http.Request, loc string, folder string
 	}
 
 	if finfo.IsDir() {
-		location = loc + IndexFile
+		location = findIndex(loc, r)
+		if conf().Adv.LangIdx {
+			w.Header().Add("Vary", "Accept-Language")
+		}
 	}
 
 	file, err := os.Open(location)
 	if err != nil {
 		if strings.HasSuffix(location, IndexFile) {
+			if conf().Index.NoList || mountNoList(r) {
+				return errNoIndex
+			}
 			// If the index file is not present, send a list of files in the directory
 			if file, err = os.Open(loc); err == nil {
-				return dirList(w, *file, folder)
+				return dirList(w, r, *file, conf().Adv.Base+folder)
 			}
 		}
 		return err
@@ -62,96 +91,578 @@ func ServeFile(w http.ResponseWriter, r *http.Request, loc string, folder string
 	}
 
 	w.Header().Set("Content-Type", getMime(file, finfo))
+	// The filename comes from the request path, so it matches the name the client asked for.
+	if name := downloadName(r, finfo); isDownload(name) {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	}
 
-	if !conf.Adv.Dev && r.Header.Get("Accept-Encoding") != "" {
-		if _, err = os.Stat(location + ".br"); err == nil && strings.Contains(r.Header.Get("Accept-Encoding"), "br") {
-			if filen, err = os.Open(location + ".br"); err == nil {
-				file.Close()
-				file = filen
-				w.Header().Set("Content-Encoding", "br")
+	// Vary is sent whether or not a compressed file is chosen, so caches never serve one representation of the file in place of another.
+	if !conf().Adv.Dev && !mountNoZip(r) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if len(route().noZip) > 0 {
+			w.Header().Add("Vary", "User-Agent")
+		}
+
+		// Use the most preferred encoding which has a compressed file available.
+		for _, enc := range requestEncodings(r) {
+			if enc == "identity" {
+				break
+			}
+			if (enc == "gzip" || enc == "zstd") && !isZipped(w, finfo, location, enc) {
+				continue
 			}
-		} else if isZipped(w, finfo, file, location) && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-			if filen, err = os.Open(location + ".gz"); err == nil {
+			if filen, err = os.Open(location + encExt[enc]); err == nil {
 				file.Close()
 				file = filen
-				w.Header().Set("Content-Encoding", "gzip")
+				w.Header().Set("Content-Encoding", enc)
+				break
 			}
 		}
 	}
+	if w.Header().Get("Content-Encoding") == "" && !acceptsIdentity(r) {
+		w.Header().Del("Content-Disposition")
+		file.Close()
+		return errNotAcceptable
+	}
+	w.Header().Set("ETag", fileEtag(file, finfo, w.Header().Get("Content-Encoding")))
+
+	// http.ServeContent doesn't send a Content-Length for compressed files, so it is added for files which fit in the buffer.
+	if w.Header().Get("Content-Encoding") != "" {
+		if zinfo, err := file.Stat(); err == nil && zinfo.Size() <= int64(conf().Adv.ZipLength)*1024 {
+			w = zipLengthWriter{w, zinfo.Size()}
+		}
+	}
+
+	if conf().Adv.NoRanges {
+		r.Header.Del("Range")
+		w = noRangeWriter{w}
+	}
+	if conf().Adv.Flush > 0 && finfo.Size() > int64(conf().Adv.Flush)*1024 {
+		w = flushWriter{w}
+	}
+
+	// Plain HTTP responses are sent with sendfile, which doesn't use a buffer, so only TLS responses are buffered.
+	if conf().Adv.CopyBuf > 0 && r.TLS != nil {
+		w = bufWriter{w}
+	}
+
+	addTiming(w, r, "read", time.Since(start))
+	if rstart, ok := r.Context().Value(timingKey{}).(time.Time); ok {
+		addTiming(w, r, "total", time.Since(rstart))
+	}
 
 	http.ServeContent(w, r, finfo.Name(), finfo.ModTime(), file)
 	return file.Close()
 }
 
+// flushWriter is a http.ResponseWriter which flushes after every write, so clients receive large files progressively.
+type flushWriter struct {
+	http.ResponseWriter
+}
+
+func (f flushWriter) Write(b []byte) (int, error) {
+	n, err := f.ResponseWriter.Write(b)
+	f.Flush()
+	return n, err
+}
+
+// Flush passes the flush through to the underlying http.ResponseWriter, if it supports flushing.
+func (f flushWriter) Flush() {
+	if fl, ok := f.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// ReadFrom allows http.ResponseWriter's use of sendfile to be kept, which sends data to the client without buffering it.
+func (f flushWriter) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := f.ResponseWriter.(io.ReaderFrom); ok {
+		n, err := rf.ReadFrom(src)
+		f.Flush()
+		return n, err
+	}
+
+	return io.Copy(struct{ io.Writer }{f}, src)
+}
+
+// Unwrap returns the underlying http.ResponseWriter, for use by http.ResponseController.
+func (f flushWriter) Unwrap() http.ResponseWriter {
+	return f.ResponseWriter
+}
+
+// zipLengthWriter is a http.ResponseWriter which sends the size of a compressed file as the Content-Length of a full response.
+type zipLengthWriter struct {
+	http.ResponseWriter
+	size int64
+}
+
+func (z zipLengthWriter) WriteHeader(status int) {
+	if status == http.StatusOK {
+		z.Header().Set("Content-Length", strconv.FormatInt(z.size, 10))
+	}
+	z.ResponseWriter.WriteHeader(status)
+}
+
+// ReadFrom allows http.ResponseWriter's use of sendfile to be kept, which sends data to the client without buffering it.
+func (z zipLengthWriter) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := z.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+
+	return io.Copy(struct{ io.Writer }{z.ResponseWriter}, src)
+}
+
+// Flush passes the flush through to the underlying http.ResponseWriter, if it supports flushing.
+func (z zipLengthWriter) Flush() {
+	if fl, ok := z.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// noRangeWriter is a http.ResponseWriter which tells clients that range requests are not supported.
+// http.ServeContent always sets the Accept-Ranges header, so it is replaced when the status is written.
+type noRangeWriter struct {
+	http.ResponseWriter
+}
+
+func (n noRangeWriter) WriteHeader(status int) {
+	n.Header().Set("Accept-Ranges", "none")
+	n.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes the flush through to the underlying http.ResponseWriter, if it supports flushing.
+func (n noRangeWriter) Flush() {
+	if fl, ok := n.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// bufWriter is a http.ResponseWriter which copies files using pooled buffers of the configured size.
+type bufWriter struct {
+	http.ResponseWriter
+}
+
+func (b bufWriter) ReadFrom(src io.Reader) (int64, error) {
+	size := conf().Adv.CopyBuf * 1024
+	// Pointers are pooled, so putting a buffer back doesn't allocate.
+	buf, ok := copyBufs.Get().(*[]byte)
+	if !ok || len(*buf) != size {
+		b := make([]byte, size)
+		buf = &b
+	}
+	defer copyBufs.Put(buf)
+
+	// The writer is wrapped, so io.CopyBuffer doesn't call ReadFrom again.
+	return io.CopyBuffer(struct{ io.Writer }{b.ResponseWriter}, src, *buf)
+}
+
+// Flush passes the flush through to the underlying http.ResponseWriter, if it supports flushing.
+func (b bufWriter) Flush() {
+	if fl, ok := b.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// downloadName returns the name of the file requested, using the index file's name for directory requests.
+func downloadName(r *http.Request, finfo os.FileInfo) string {
+	if strings.HasSuffix(r.URL.Path, "/") || r.URL.Path == "" {
+		return finfo.Name()
+	}
+	return path.Base(r.URL.Path)
+}
+
+// isDownload checks if a file should be served as an attachment, instead of being displayed inline.
+func isDownload(name string) bool {
+	for _, p := range conf().Download {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fileEtag creates the ETag for the representation of a file being served.
+// Precompressed files get a strong ETag from their own size and modification time, as they are served byte-for-byte.
+// zipFile gives files compressed in real time the original file's modification time, and they get a weak ETag from the original file.
+// The ETag only depends on the files on disk and the encoding, so it stays the same across restarts.
+func fileEtag(file *os.File, finfo os.FileInfo, enc string) string {
+	if enc == "" {
+		return makeEtag(finfo, "")
+	}
+	zinfo, err := file.Stat()
+	if err != nil || zinfo.ModTime().Equal(finfo.ModTime()) {
+		return "W/" + makeEtag(finfo, enc)
+	}
+
+	return makeEtag(zinfo, enc)
+}
+
+// makeEtag creates a strong ETag from a file's size and modification time.
+// The ETag is used by http.ServeContent to validate If-Range, If-Match, and If-None-Match headers.
+// http.ServeContent evaluates If-None-Match before If-Modified-Since, so a changed ETag is never hidden by an unchanged modification time.
+// If the content is compressed, the encoding is appended to the ETag, so caches don't mix the different representations.
+func makeEtag(fi os.FileInfo, enc string) string {
+	if enc != "" {
+		enc = "-" + enc
+	}
+	return `"` + strconv.FormatInt(fi.ModTime().UnixNano(), 36) + "-" + strconv.FormatInt(fi.Size(), 36) + enc + `"`
+}
+
+// notModified checks if a client's cached copy of a response is still valid, using the precedence from RFC 7232.
+// If-None-Match is evaluated first, and If-Modified-Since is ignored when the client sent If-None-Match.
+func notModified(r *http.Request, etag string, mod time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			// If-None-Match uses the weak comparison, so weak and strong tags with the same value match.
+			if t == "*" || strings.TrimPrefix(t, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !mod.Truncate(time.Second).After(ims)
+}
+
+// rootResponse serves the configured page or redirect for the root folder, when it has no index file.
+// It returns false if no root response is configured.
+func rootResponse(w http.ResponseWriter) bool {
+	if conf().Index.Redir != "" {
+		redir(w, conf().Index.Redir)
+		return true
+	}
+	if conf().Index.Page == "" {
+		return false
+	}
+
+	data, err := ioutil.ReadFile(conf().Index.Page)
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(data)
+	return true
+}
+
 // getMime detects the correct value for the "Content-Type" header.
+// If the type can't be detected from the extension or the file contents, defaultMime is used.
+// When sniffing is disabled, files with unknown extensions always use defaultMime.
 func getMime(f io.ReadSeeker, fi os.FileInfo) string {
 	mime := mime.TypeByExtension(filepath.Ext(fi.Name()))
 	if mime != "" {
 		return mime
 	}
+	if conf().Adv.NoSniff {
+		if conf().Adv.MimeDef != "" {
+			return conf().Adv.MimeDef
+		}
+		return "application/octet-stream"
+	}
 
 	var buf [512]byte
 	n, _ := io.ReadFull(f, buf[:])
 	mime = http.DetectContentType(buf[:n])
 	f.Seek(0, io.SeekStart)
+	if mime == "application/octet-stream" && conf().Adv.MimeDef != "" {
+		return conf().Adv.MimeDef
+	}
 	return mime
 }
 
-func dirList(w http.ResponseWriter, f os.File, urln string) error {
+// listing is a cached directory listing.
+type listing struct {
+	mod     time.Time
+	created time.Time
+	page    []byte
+}
+
+// listingCache is a least recently used cache of directory listings.
+// It holds at most maxListings listings, so crawling many directories can't use an unbounded amount of memory.
+type listingCache struct {
+	mu    sync.Mutex
+	order *list.List // of *listEntry, with the most recently used first
+	items map[string]*list.Element
+}
+
+// listEntry is the listing of a directory in the listing cache.
+type listEntry struct {
+	name string
+	l    listing
+}
+
+// get returns the cached listing of a directory, and marks it as recently used.
+func (c *listingCache) get(name string) (listing, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[name]
+	if !ok {
+		return listing{}, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*listEntry).l, true
+}
+
+// put caches the listing of a directory, removing the least recently used listing if the cache is full.
+func (c *listingCache) put(name string, l listing) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[name]; ok {
+		e.Value.(*listEntry).l = l
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.items[name] = c.order.PushFront(&listEntry{name, l})
+	if c.order.Len() > maxListings {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*listEntry).name)
+	}
+}
+
+// dirList writes a list of the files in a directory.
+// If listingCache is set, listings are cached until they expire, or the directory is modified.
+// Listings are validated with the directory's modification time, so clients can revalidate them like files.
+func dirList(w http.ResponseWriter, r *http.Request, f os.File, urln string) error {
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	etag := "W/" + makeEtag(fi, "list")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	if notModified(r, etag, fi.ModTime()) {
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	if conf().Adv.ListCache > 0 {
+		if l, ok := listCache.get(f.Name()); ok {
+			if l.mod.Equal(fi.ModTime()) && time.Since(l.created) < time.Duration(conf().Adv.ListCache)*time.Second {
+				w.Write(l.page)
+				return nil
+			}
+		}
+	}
+
 	dirs, err := f.Readdirnames(0)
 	if err != nil {
 		return err
 	}
 	sort.Strings(dirs)
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Write([]byte(`<!DOCTYPE html><meta content="width=device-width,initial-scale=1,minimum-scale=1,maximum-scale=1" name=viewport><title>` + urln + `</title><style>body{margin:0;font:16px/1.5 sans-serif}h1,h3{font-weight:400;margin:10px 0}h1{font-size:48px}h3{font-size:24px;padding-top:16px}a,header{color:#fff}a{width:98.5%;display:inline-block;text-decoration:none;background-color:#333e42;padding:8px 16px}a,h3{text-align:center}header{background-color:#222d32;padding:80px 32px}div{max-width:800px;margin:auto;padding:.01em 64px}</style><header><h1>` + urln + `</h1></header><h3>Contents of directory</h3><div>`))
+	var buf bytes.Buffer
+	buf.WriteString(`<!DOCTYPE html><meta content="width=device-width,initial-scale=1,minimum-scale=1,maximum-scale=1" name=viewport><title>` + template.HTMLEscapeString(urln) + `</title><style>body{margin:0;font:16px/1.5 sans-serif}h1,h3{font-weight:400;margin:10px 0}h1{font-size:48px}h3{font-size:24px;padding-top:16px}a,header{color:#fff}a{width:98.5%;display:inline-block;text-decoration:none;background-color:#333e42;padding:8px 16px}a,h3{text-align:center}header{background-color:#222d32;padding:80px 32px}div{max-width:800px;margin:auto;padding:.01em 64px}</style><header><h1>` + template.HTMLEscapeString(urln) + `</h1></header><h3>Contents of directory</h3><div>`)
 	for _, d := range dirs {
 		// Escape special characters from the url path
-		if strings.HasSuffix(d, ".br") || (strings.HasSuffix(d, ".gz") && !strings.HasSuffix(d, ".tar.gz")) {
+		if strings.HasSuffix(d, ".br") || strings.HasSuffix(d, ".zst") || (strings.HasSuffix(d, ".gz") && !strings.HasSuffix(d, ".tar.gz")) {
 			continue
 		}
 		url := url.URL{Path: d}
-		w.Write([]byte("<p><a href=" + template.HTMLEscapeString(url.String()) + ">" + template.HTMLEscapeString(d) + "</a>"))
+		buf.WriteString("<p><a href=" + template.HTMLEscapeString(url.String()) + ">" + template.HTMLEscapeString(d) + "</a>")
+	}
+	buf.WriteString("</div>")
+
+	if conf().Adv.ListCache > 0 {
+		listCache.put(f.Name(), listing{fi.ModTime(), time.Now(), buf.Bytes()})
 	}
-	w.Write([]byte("</div>"))
+	w.Write(buf.Bytes())
 	return nil
 }
 
 // StyledError serves an styled error page
-func StyledError(w http.ResponseWriter, title string, content string, status int) {
-	w.WriteHeader(status)
+// If a custom error page is configured for the status code, it will be served instead.
+func StyledError(w http.ResponseWriter, r *http.Request, title string, content string, status int) {
+	if page, ok := conf().ErrPage[status]; ok {
+		if data, err := ioutil.ReadFile(page); err == nil {
+			writeError(w, r, data, status)
+			return
+		}
+	}
+
+	writeError(w, r, []byte(`<!DOCTYPE html><title>`+title+`</title><meta content="width=device-width,initial-scale=1,minimum-scale=1,maximum-scale=1" name=viewport><style>body{margin:0;font:16px/1.5 sans-serif}h1,h3{font-weight:400;margin:10px 0}h1{font-size:48px}h3{font-size:24px;padding:16px}header{color:#fff;background-color:#222d32;padding:80px 32px}</style><header><h1>`+title+`</h1></header><h3>`+content+`</h3>`), status)
+}
+
+// Forbidden serves the error page for a request which has been denied access.
+// It is used for every denial, so a custom 403 page in errorPages is shown for hidden files, IP allowlists, and passwd files alike.
+func Forbidden(w http.ResponseWriter, r *http.Request) {
+	StyledError(w, r, "403 Forbidden", "You do not have permission to access this resource.", http.StatusForbidden)
+}
+
+// writeError writes an error page, compressing it with gzip if the client prefers it.
+// All headers are set before the status code is written, so they are sent to the client.
+func writeError(w http.ResponseWriter, r *http.Request, data []byte, status int) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Write([]byte(`<!DOCTYPE html><title>` + title + `</title><meta content="width=device-width,initial-scale=1,minimum-scale=1,maximum-scale=1" name=viewport><style>body{margin:0;font:16px/1.5 sans-serif}h1,h3{font-weight:400;margin:10px 0}h1{font-size:48px}h3{font-size:24px;padding:16px}header{color:#fff;background-color:#222d32;padding:80px 32px}</style><header><h1>` + title + `</h1></header><h3>` + content + `</h3>`))
+	if conf().Adv.Dev || len(data) <= 400 {
+		w.WriteHeader(status)
+		w.Write(data)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	for _, enc := range requestEncodings(r) {
+		if enc == "identity" {
+			break
+		}
+		if enc == "gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Del("Content-Length")
+			lw := &lengthWriter{w: w, status: status, limit: conf().Adv.ZipLength * 1024}
+
+			gz := zippers.Get().(*gzip.Writer)
+			gz.Reset(lw)
+			gz.Write(data)
+			gz.Close()
+			zippers.Put(gz)
+			lw.Close()
+			return
+		}
+	}
+
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// lengthWriter buffers a response which is compressed on the fly, so responses which fit in the buffer are sent with a Content-Length.
+// Once the buffer is full, the response is streamed with chunked encoding instead.
+type lengthWriter struct {
+	w      http.ResponseWriter
+	status int
+	limit  int
+	buf    []byte
+	stream bool
+}
+
+func (l *lengthWriter) Write(b []byte) (int, error) {
+	if !l.stream {
+		if len(l.buf)+len(b) <= l.limit {
+			l.buf = append(l.buf, b...)
+			return len(b), nil
+		}
+
+		l.stream = true
+		l.w.WriteHeader(l.status)
+		if _, err := l.w.Write(l.buf); err != nil {
+			return 0, err
+		}
+		l.buf = nil
+	}
+
+	return l.w.Write(b)
+}
+
+// Close sends the buffered response, if it was small enough to be buffered.
+func (l *lengthWriter) Close() error {
+	if l.stream {
+		return nil
+	}
+
+	l.w.Header().Set("Content-Length", strconv.Itoa(len(l.buf)))
+	l.w.WriteHeader(l.status)
+	_, err := l.w.Write(l.buf)
+	return err
 }
 
-// isZipped returns true if a gzipped version of the file exists.
-// If a gzipped version of the file does not exist, it will attempt
+// isZipped returns true if a compressed version of the file exists.
+// If a compressed version of the file does not exist, it will attempt
 // to compress the file in real time, and return true if the
-// attempt is successful.
-func isZipped(w http.ResponseWriter, finfo os.FileInfo, file io.ReadCloser, filePath string) bool {
-	if _, err := os.Stat(filePath + ".gz"); err == nil {
+// attempt is successful. Concurrent requests for the same file
+// share a single compression.
+func isZipped(w http.ResponseWriter, finfo os.FileInfo, filePath string, enc string) bool {
+	if _, err := os.Stat(filePath + encExt[enc]); err == nil {
 		return true
 	}
+	if enc == "zstd" && conf().Adv.Zstd <= 0 {
+		return false
+	}
 
-	if finfo.Size() < 100000 && finfo.Size() > 400 && w.Header().Get("Content-Type") != "application/gzip" {
-		ct := strings.Split(w.Header().Get("Content-Type"), ";")
-		i := sort.SearchStrings(gztypes, ct[0])
-		if i < len(gztypes) && gztypes[i] == ct[0] {
-			if filen, err := os.Create(filePath + ".gz"); err == nil {
-				gz := zippers.Get().(*gzip.Writer)
-				gz.Reset(filen)
-
-				io.Copy(gz, file)
+	if finfo.Size() < 100000 && finfo.Size() > 400 && canZip(finfo.Name(), w.Header().Get("Content-Type")) {
+		_, err, _ := zipGroup.Do(filePath+encExt[enc], func() (interface{}, error) {
+			return nil, compress(filePath, enc)
+		})
+		return err == nil
+	}
 
-				gz.Close()
-				zippers.Put(gz)
-				file.Close()
+	return false
+}
 
+// canZip checks if a file should be compressed in real time.
+// If compressExtensions is set, only files with those extensions are compressed, otherwise the content type is checked.
+func canZip(name string, ctype string) bool {
+	if len(conf().Adv.ZipExt) > 0 {
+		ext := filepath.Ext(name)
+		for _, e := range conf().Adv.ZipExt {
+			if strings.EqualFold(ext, e) {
 				return true
 			}
 		}
+		return false
 	}
 
-	return false
+	ct := strings.Split(ctype, ";")
+	i := sort.SearchStrings(gztypes, ct[0])
+	return i < len(gztypes) && gztypes[i] == ct[0]
+}
+
+// zipFile creates a compressed version of a file.
+// The file is compressed into a temporary file first, so a partially compressed file is never served.
+func zipFile(filePath string, enc string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	tmp := filePath + encExt[enc] + ".tmp"
+	filen, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if enc == "zstd" {
+		err = zstdCopy(filen, file)
+	} else {
+		gz := zippers.Get().(*gzip.Writer)
+		gz.Reset(filen)
+		_, err = io.Copy(gz, file)
+		if errc := gz.Close(); err == nil {
+			err = errc
+		}
+		zippers.Put(gz)
+	}
+	if errc := filen.Close(); err == nil {
+		err = errc
+	}
+
+	// The compressed file keeps the original's modification time, which marks it as compressed in real time.
+	if finfo, errs := file.Stat(); err == nil && errs == nil {
+		err = os.Chtimes(tmp, finfo.ModTime(), finfo.ModTime())
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filePath+encExt[enc])
+}
+
+// zstdCopy compresses a file with zstd, using the configured compression level.
+func zstdCopy(dst io.Writer, src io.Reader) error {
+	zw, err := zstd.NewWriter(dst, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(conf().Adv.Zstd)))
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(zw, src); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
 }
@@ -0,0 +1,1284 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// recordWriter is a http.ResponseWriter which records whether the response was written with ReadFrom.
+type recordWriter struct {
+	*httptest.ResponseRecorder
+	readFroms int
+}
+
+func (w *recordWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.readFroms++
+	return io.Copy(w.ResponseRecorder, src)
+}
+
+// writeFile creates a file in a folder, returning it's path.
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFlushWriter(t *testing.T) {
+	tests := []struct {
+		name      string
+		readFrom  bool
+		readFroms int
+	}{
+		{"write", false, 0},
+		{"read from", true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := &recordWriter{ResponseRecorder: httptest.NewRecorder()}
+			fw := flushWriter{rw}
+			if tt.readFrom {
+				fw.ReadFrom(strings.NewReader("data"))
+			} else {
+				fw.Write([]byte("data"))
+			}
+
+			if rw.Body.String() != "data" {
+				t.Errorf("body = %q, want %q", rw.Body.String(), "data")
+			}
+			if !rw.Flushed {
+				t.Errorf("response was not flushed")
+			}
+			if rw.readFroms != tt.readFroms {
+				t.Errorf("ReadFrom called %d times, want %d", rw.readFroms, tt.readFroms)
+			}
+			if fw.Unwrap() != rw {
+				t.Errorf("Unwrap() did not return the underlying writer")
+			}
+		})
+	}
+}
+
+func TestServeFileFlush(t *testing.T) {
+	dir := t.TempDir()
+	small := writeFile(t, dir, "small.txt", bytes.Repeat([]byte("a"), 100))
+	large := writeFile(t, dir, "large.txt", bytes.Repeat([]byte("a"), 4096))
+
+	tests := []struct {
+		name    string
+		flush   int
+		file    string
+		flushed bool
+	}{
+		{"disabled", 0, large, false},
+		{"small file", 1, small, false},
+		{"large file", 1, large, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.Dev, c.Adv.Flush = true, tt.flush
+			setTestConf(t, c)
+
+			rw := &recordWriter{ResponseRecorder: httptest.NewRecorder()}
+			if err := ServeFile(rw, httptest.NewRequest("GET", "/"+filepath.Base(tt.file), nil), tt.file, "/"+filepath.Base(tt.file)); err != nil {
+				t.Fatal(err)
+			}
+
+			if rw.Flushed != tt.flushed {
+				t.Errorf("flushed = %v, want %v", rw.Flushed, tt.flushed)
+			}
+			// The file is always sent with ReadFrom, so sendfile can be used.
+			if rw.readFroms != 1 {
+				t.Errorf("ReadFrom called %d times, want 1", rw.readFroms)
+			}
+		})
+	}
+}
+
+func TestServeFileVary(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "page.html", bytes.Repeat([]byte("<p>hello</p>"), 100))
+	writeFile(t, dir, "page.html.gz", []byte("compressed"))
+	writeFile(t, dir, "page.html.br", []byte("compressed"))
+
+	serve := func(t *testing.T, accept string) *httptest.ResponseRecorder {
+		c := baseConf()
+		c.Root, c.CachTime = dir, 4
+		setTestConf(t, c)
+
+		r := httptest.NewRequest("GET", "/page.html", nil)
+		if accept != "" {
+			r.Header.Set("Accept-Encoding", accept)
+		}
+		w := httptest.NewRecorder()
+		mainHandle(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+		return w
+	}
+	plain := serve(t, "identity").Header()
+
+	tests := []struct {
+		name, accept, encoding string
+	}{
+		{"uncompressed", "", ""},
+		{"gzip", "gzip", "gzip"},
+		{"brotli", "br", "br"},
+		{"unsupported encoding", "deflate", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := serve(t, tt.accept).Header()
+
+			if got := h.Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			if got := h.Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+
+			// Compressed responses are the same resource, so they are cached in the same way as the uncompressed response.
+			for _, k := range []string{"Cache-Control", "Last-Modified"} {
+				if got, want := h.Get(k), plain.Get(k); got == "" || got != want {
+					t.Errorf("%s = %q, want %q", k, got, want)
+				}
+			}
+			// Expires is relative to the time of the request, so it can be a second later than the uncompressed response.
+			exp, err := http.ParseTime(h.Get("Expires"))
+			want, errw := http.ParseTime(plain.Get("Expires"))
+			if d := exp.Sub(want); err != nil || errw != nil || d < 0 || d > time.Second {
+				t.Errorf("Expires = %q, want %q", h.Get("Expires"), plain.Get("Expires"))
+			}
+
+			etag := h.Get("ETag")
+			switch {
+			case tt.encoding == "" && etag != plain.Get("ETag"):
+				t.Errorf("ETag = %s, want %s", etag, plain.Get("ETag"))
+			case tt.encoding != "" && (etag == plain.Get("ETag") || !strings.HasSuffix(etag, "-"+tt.encoding+`"`)):
+				t.Errorf("ETag = %s, want an ETag for the %s encoded file", etag, tt.encoding)
+			}
+		})
+	}
+}
+
+func TestServeFileCopyBuffer(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("a"), 300*1024)
+	file := writeFile(t, dir, "large.txt", data)
+
+	tests := []struct {
+		name      string
+		copyBuf   int
+		tls       bool
+		readFroms int
+	}{
+		{"disabled", 0, true, 1},
+		{"plain http keeps sendfile", 64, false, 1},
+		{"tls", 64, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.CopyBuf = tt.copyBuf
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/large.txt", nil)
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			rw := &recordWriter{ResponseRecorder: httptest.NewRecorder()}
+			if err := ServeFile(rw, r, file, "/large.txt"); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(rw.Body.Bytes(), data) {
+				t.Errorf("body has %d bytes, want %d", rw.Body.Len(), len(data))
+			}
+			if rw.readFroms != tt.readFroms {
+				t.Errorf("ReadFrom called %d times, want %d", rw.readFroms, tt.readFroms)
+			}
+		})
+	}
+}
+
+// discardWriter is a http.ResponseWriter which discards the response, so benchmarks only measure serving the file.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d discardWriter) Header() http.Header         { return d.header }
+func (d discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d discardWriter) WriteHeader(int)             {}
+
+func BenchmarkServeFileCopyBuffer(b *testing.B) {
+	dir := b.TempDir()
+	file := filepath.Join(dir, "large.bin")
+	if err := ioutil.WriteFile(file, bytes.Repeat([]byte("a"), 8<<20), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, size := range []int{0, 256} {
+		b.Run(strconv.Itoa(size)+"KiB", func(b *testing.B) {
+			c := &Conf{}
+			c.Adv.CopyBuf = size
+			prev := conf()
+			setConf(c)
+			defer setConf(prev)
+
+			r := httptest.NewRequest("GET", "/large.bin", nil)
+			r.TLS = &tls.ConnectionState{}
+			b.ReportAllocs()
+			b.SetBytes(8 << 20)
+			for i := 0; i < b.N; i++ {
+				if err := ServeFile(discardWriter{http.Header{}}, r, file, "/large.bin"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestListingCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		puts    int
+		touch   string // a listing used after all of the puts except the last
+		present []string
+		missing []string
+	}{
+		{"under limit", 3, "", []string{"0", "1", "2"}, nil},
+		{"evicts oldest", maxListings + 1, "", []string{"1", strconv.Itoa(maxListings)}, []string{"0"}},
+		{"keeps recently used", maxListings + 1, "0", []string{"0", strconv.Itoa(maxListings)}, []string{"1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &listingCache{order: list.New(), items: make(map[string]*list.Element)}
+			for i := 0; i < tt.puts; i++ {
+				if i == tt.puts-1 && tt.touch != "" {
+					c.get(tt.touch)
+				}
+				c.put(strconv.Itoa(i), listing{page: []byte(strconv.Itoa(i))})
+			}
+
+			if c.order.Len() > maxListings || len(c.items) != c.order.Len() {
+				t.Errorf("cache has %d listings and %d items, want at most %d", c.order.Len(), len(c.items), maxListings)
+			}
+			for _, name := range tt.present {
+				if l, ok := c.get(name); !ok || string(l.page) != name {
+					t.Errorf("listing %s = %q, %v, want it cached", name, l.page, ok)
+				}
+			}
+			for _, name := range tt.missing {
+				if _, ok := c.get(name); ok {
+					t.Errorf("listing %s is cached, want it evicted", name)
+				}
+			}
+		})
+	}
+}
+
+func TestDirListCache(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.txt", nil)
+
+	tests := []struct {
+		name, add string
+		cache     int
+		want      string
+	}{
+		{"cached", "b.txt", 60, "a.txt"},
+		{"not cached", "c.txt", 0, "c.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.ListCache = tt.cache
+			setTestConf(t, c)
+
+			serve := func() string {
+				f, err := os.Open(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				w := httptest.NewRecorder()
+				if err := dirList(w, httptest.NewRequest("GET", "/", nil), *f, "/"); err != nil {
+					t.Fatal(err)
+				}
+				return w.Body.String()
+			}
+
+			first := serve()
+			// The directory's modification time is kept, so only the cache decides if the new file is listed.
+			fi, err := os.Stat(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, dir, tt.add, nil)
+			if err := os.Chtimes(dir, fi.ModTime(), fi.ModTime()); err != nil {
+				t.Fatal(err)
+			}
+
+			second := serve()
+			if tt.cache > 0 && second != first {
+				t.Errorf("listing changed while cached")
+			}
+			if !strings.Contains(second, tt.want) {
+				t.Errorf("listing doesn't include %s", tt.want)
+			}
+		})
+	}
+}
+
+func TestServeFileEtag(t *testing.T) {
+	dir := t.TempDir()
+	page := writeFile(t, dir, "page.html", bytes.Repeat([]byte("<p>hello</p>"), 100))
+	setTestConf(t, &Conf{})
+
+	etag := func(accept string) string {
+		r := httptest.NewRequest("GET", "/page.html", nil)
+		r.Header.Set("Accept-Encoding", accept)
+		w := httptest.NewRecorder()
+		if err := ServeFile(w, r, page, "/page.html"); err != nil {
+			t.Fatal(err)
+		}
+		return w.Header().Get("ETag")
+	}
+
+	// The first gzip request compresses the file in real time, and later requests use the compressed file on disk.
+	// Brotli files are never compressed in real time, so the .br file is precompressed.
+	brotli := writeFile(t, dir, "page.html.br", []byte("brotli"))
+	old := mustStat(t, page).ModTime().Add(-time.Hour)
+	if err := os.Chtimes(brotli, old, old); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		plain    = etag("identity")
+		created  = etag("gzip")
+		existing = etag("gzip")
+		static   = etag("br")
+	)
+
+	tests := []struct {
+		name, got, want string
+	}{
+		{"uncompressed", plain, makeEtag(mustStat(t, page), "")},
+		{"compressed in real time", created, "W/" + makeEtag(mustStat(t, page), "gzip")},
+		{"already compressed", existing, created},
+		{"precompressed", static, makeEtag(mustStat(t, brotli), "br")},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s ETag = %s, want %s", tt.name, tt.got, tt.want)
+		}
+	}
+	if plain == created {
+		t.Error("compressed and uncompressed files have the same ETag")
+	}
+
+	// If-None-Match uses the weak comparison, so either form of the ETag matches.
+	for _, inm := range []string{created, strings.TrimPrefix(created, "W/")} {
+		r := httptest.NewRequest("GET", "/page.html", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		r.Header.Set("If-None-Match", inm)
+		w := httptest.NewRecorder()
+		if err := ServeFile(w, r, page, "/page.html"); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match %s: status = %d, want %d", inm, w.Code, http.StatusNotModified)
+		}
+	}
+}
+
+func TestMakeEtag(t *testing.T) {
+	fi := mustStat(t, writeFile(t, t.TempDir(), "page.html", []byte("<p>hello</p>")))
+	plain := makeEtag(fi, "")
+
+	tests := []struct {
+		enc, suffix string
+	}{
+		{"", `"`},
+		{"gzip", `-gzip"`},
+		{"br", `-br"`},
+		{"zstd", `-zstd"`},
+	}
+	for _, tt := range tests {
+		got := makeEtag(fi, tt.enc)
+		if !strings.HasSuffix(got, tt.suffix) {
+			t.Errorf("makeEtag(%q) = %s, want suffix %s", tt.enc, got, tt.suffix)
+		}
+		if tt.enc != "" && got == plain {
+			t.Errorf("makeEtag(%q) = %s, same as the uncompressed ETag", tt.enc, got)
+		}
+	}
+}
+
+func TestServeFileEtagPrecompressed(t *testing.T) {
+	dir := t.TempDir()
+	page := writeFile(t, dir, "page.html", []byte("<p>hello</p>"))
+	gz := writeFile(t, dir, "page.html.gz", []byte("<p>hello</p>"))
+	// A compressed file with the original's modification time is treated as compressed in real time.
+	old := mustStat(t, page).ModTime().Add(-time.Hour)
+	if err := os.Chtimes(gz, old, old); err != nil {
+		t.Fatal(err)
+	}
+	setTestConf(t, &Conf{})
+
+	tests := []struct {
+		accept, enc string
+		want        string
+	}{
+		{"identity", "", makeEtag(mustStat(t, page), "")},
+		{"gzip", "gzip", makeEtag(mustStat(t, page+".gz"), "gzip")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/page.html", nil)
+			r.Header.Set("Accept-Encoding", tt.accept)
+			w := httptest.NewRecorder()
+			if err := ServeFile(w, r, page, "/page.html"); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.enc {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.enc)
+			}
+			if got := w.Header().Get("ETag"); got != tt.want {
+				t.Errorf("ETag = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeFileCoalesce(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests int
+	}{
+		{"single request", 1},
+		{"concurrent requests", 50},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			page := writeFile(t, dir, "page.html", bytes.Repeat([]byte("<p>hello</p>"), 1000))
+			setTestConf(t, &Conf{})
+
+			var (
+				calls   int64
+				release = make(chan struct{})
+			)
+			t.Cleanup(func() { compress = zipFile })
+			compress = func(filePath, enc string) error {
+				atomic.AddInt64(&calls, 1)
+				<-release
+				return zipFile(filePath, enc)
+			}
+
+			var wg sync.WaitGroup
+			encs := make([]string, tt.requests)
+			for i := range encs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					r := httptest.NewRequest("GET", "/page.html", nil)
+					r.Header.Set("Accept-Encoding", "gzip")
+					w := httptest.NewRecorder()
+					if err := ServeFile(w, r, page, "/page.html"); err != nil {
+						t.Error(err)
+					}
+					encs[i] = w.Header().Get("Content-Encoding")
+				}(i)
+			}
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			if n := atomic.LoadInt64(&calls); n != 1 {
+				t.Errorf("file was compressed %d times, want 1", n)
+			}
+			for i, enc := range encs {
+				if enc != "gzip" {
+					t.Errorf("request %d Content-Encoding = %q, want gzip", i, enc)
+				}
+			}
+		})
+	}
+}
+
+func TestServeFilePrecompressed(t *testing.T) {
+	tests := []struct {
+		name, accept string
+		siblings     []string
+		enc          string
+		code         int
+	}{
+		{"prefers br", "gzip, br", []string{".br", ".gz"}, "br", 200},
+		{"br quality", "gzip;q=0, br;q=1", []string{".br", ".gz"}, "br", 200},
+		{"gzip quality", "gzip;q=1, br;q=0.5", []string{".br", ".gz"}, "gzip", 200},
+		{"missing br falls back to gzip", "gzip, br", []string{".gz"}, "gzip", 200},
+		{"missing gzip falls back to identity", "gzip", []string{".br"}, "", 200},
+		{"no siblings", "gzip, br", nil, "", 200},
+		{"identity preferred", "br;q=0.5, identity", []string{".br", ".gz"}, "", 200},
+		{"no header", "", []string{".br", ".gz"}, "", 200},
+		{"identity refused", "br, identity;q=0", []string{".gz"}, "", 406},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			page := writeFile(t, dir, "page.txt", []byte("identity"))
+			for _, ext := range tt.siblings {
+				writeFile(t, dir, "page.txt"+ext, []byte(ext))
+			}
+			setTestConf(t, &Conf{})
+
+			r := httptest.NewRequest("GET", "/page.txt", nil)
+			r.Header.Set("Accept-Encoding", tt.accept)
+			w := httptest.NewRecorder()
+			err := ServeFile(w, r, page, "/page.txt")
+			if tt.code == 406 {
+				if err != errNotAcceptable {
+					t.Fatalf("ServeFile() = %v, want errNotAcceptable", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := w.Header().Get("Content-Encoding"); got != tt.enc {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.enc)
+			}
+			want := "identity"
+			if tt.enc != "" {
+				want = encExt[tt.enc]
+			}
+			if w.Body.String() != want {
+				t.Errorf("body = %q, want %q", w.Body.String(), want)
+			}
+		})
+	}
+}
+
+func TestServeFileCompressExtensions(t *testing.T) {
+	tests := []struct {
+		name, file string
+		exts       []string
+		enc        string
+	}{
+		{"allowed svg", "image.svg", []string{".html", ".css", ".js", ".json", ".svg"}, "gzip"},
+		{"not allowed mp4", "video.mp4", []string{".html", ".css", ".js", ".json", ".svg"}, ""},
+		{"case insensitive", "IMAGE.SVG", []string{".svg"}, "gzip"},
+		{"type not in allowlist", "page.html", []string{".svg"}, ""},
+		{"content type without allowlist", "page.html", nil, "gzip"},
+		{"mp4 without allowlist", "video.mp4", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := writeFile(t, t.TempDir(), tt.file, bytes.Repeat([]byte("<svg></svg>"), 100))
+			c := &Conf{}
+			c.Adv.ZipExt = tt.exts
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/"+tt.file, nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			if err := ServeFile(w, r, file, "/"+tt.file); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.enc {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.enc)
+			}
+			if _, err := os.Stat(file + ".gz"); (err == nil) != (tt.enc != "") {
+				t.Errorf("compressed file created = %v, want %v", err == nil, tt.enc != "")
+			}
+		})
+	}
+}
+
+func TestGetMime(t *testing.T) {
+	dir := t.TempDir()
+	var (
+		text   = writeFile(t, dir, "README", []byte("plain text without an extension"))
+		binary = writeFile(t, dir, "blob", []byte{0, 1, 2, 3, 0xfe, 0xff})
+		css    = writeFile(t, dir, "style.css", []byte("body{}"))
+	)
+
+	tests := []struct {
+		name, file, def string
+		noSniff         bool
+		want            string
+	}{
+		{"sniffed text", text, "", false, "text/plain; charset=utf-8"},
+		{"sniffed text with default", text, "text/markdown", false, "text/plain; charset=utf-8"},
+		{"text without sniffing", text, "text/markdown", true, "text/markdown"},
+		{"text without sniffing or default", text, "", true, "application/octet-stream"},
+		{"undetectable", binary, "", false, "application/octet-stream"},
+		{"undetectable with default", binary, "text/plain", false, "text/plain"},
+		{"known extension", css, "text/markdown", true, "text/css; charset=utf-8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.MimeDef, c.Adv.NoSniff = tt.def, tt.noSniff
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/"+filepath.Base(tt.file), nil)
+			w := httptest.NewRecorder()
+			if err := ServeFile(w, r, tt.file, r.URL.Path); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.want {
+				t.Errorf("Content-Type = %q, want %q", got, tt.want)
+			}
+			if body, _ := ioutil.ReadFile(tt.file); w.Body.String() != string(body) {
+				t.Errorf("body = %q, want the whole file", w.Body.String())
+			}
+		})
+	}
+}
+
+// mustStat returns the FileInfo of a file.
+func mustStat(t *testing.T, path string) os.FileInfo {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi
+}
+
+func TestServeFileIfRange(t *testing.T) {
+	dir := t.TempDir()
+	file := writeFile(t, dir, "data.txt", []byte("0123456789"))
+	fi := mustStat(t, file)
+	var (
+		etag    = makeEtag(fi, "")
+		modTime = fi.ModTime().UTC().Format(http.TimeFormat)
+		oldTime = fi.ModTime().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	)
+
+	tests := []struct {
+		name, ifRange string
+		code          int
+		body          string
+	}{
+		{"no validator", "", 206, "234"},
+		{"matching etag", etag, 206, "234"},
+		{"changed etag", `"changed"`, 200, "0123456789"},
+		{"weak etag", "W/" + etag, 200, "0123456789"},
+		{"matching date", modTime, 206, "234"},
+		{"old date", oldTime, 200, "0123456789"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConf(t, &Conf{})
+			r := httptest.NewRequest("GET", "/data.txt", nil)
+			r.Header.Set("Range", "bytes=2-4")
+			if tt.ifRange != "" {
+				r.Header.Set("If-Range", tt.ifRange)
+			}
+			w := httptest.NewRecorder()
+			if err := ServeFile(w, r, file, "/data.txt"); err != nil {
+				t.Fatal(err)
+			}
+
+			if w.Code != tt.code || w.Body.String() != tt.body {
+				t.Errorf("response = %d %q, want %d %q", w.Code, w.Body.String(), tt.code, tt.body)
+			}
+		})
+	}
+}
+
+func TestServeFileDownload(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "archive.zip", []byte("zip"))
+	writeFile(t, dir, "page.txt", []byte("text"))
+	writeFile(t, dir, "résumé.zip", []byte("zip"))
+	writeFile(t, dir, IndexFile, []byte("<p>index</p>"))
+
+	tests := []struct {
+		name, file, path string
+		patterns         []string
+		want             string
+	}{
+		{"matching", "archive.zip", "/archive.zip", []string{"*.zip"}, `attachment; filename=archive.zip`},
+		{"not matching", "page.txt", "/page.txt", []string{"*.zip"}, ""},
+		{"no patterns", "archive.zip", "/archive.zip", nil, ""},
+		{"name from request path", "archive.zip", "/Archive.ZIP", []string{"*.ZIP"}, `attachment; filename=Archive.ZIP`},
+		{"non-ascii name", "résumé.zip", "/résumé.zip", []string{"*.zip"}, `attachment; filename*=utf-8''r%C3%A9sum%C3%A9.zip`},
+		{"directory index", "", "/", []string{"*.html"}, `attachment; filename=index.html`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Download = tt.patterns
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.URL.Path = tt.path
+			w := httptest.NewRecorder()
+			if err := ServeFile(w, r, dir+"/"+tt.file, tt.path); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Header().Get("Content-Disposition"); got != tt.want {
+				t.Errorf("Content-Disposition = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	page := bytes.Repeat([]byte("<p>The requested resource could not be found.</p>"), 20)
+	tests := []struct {
+		name, accept string
+		data         []byte
+		dev          bool
+		gzipped      bool
+	}{
+		{"gzip", "gzip", page, false, true},
+		{"no accept-encoding", "", page, false, false},
+		{"gzip refused", "gzip;q=0", page, false, false},
+		{"identity preferred", "identity, gzip;q=0.5", page, false, false},
+		{"small page", "gzip", []byte("<p>Not found</p>"), false, false},
+		{"dev mode", "gzip", page, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.Dev, c.Adv.ZipLength = tt.dev, 64
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/missing", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			writeError(w, r, tt.data, http.StatusNotFound)
+
+			// The recorder snapshots headers when the status is written, so late headers are not seen here.
+			resp := w.Result()
+			if resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("status = %d, want 404", resp.StatusCode)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+				t.Errorf("Content-Type = %q, want text/html", ct)
+			}
+			if enc := resp.Header.Get("Content-Encoding"); (enc == "gzip") != tt.gzipped {
+				t.Fatalf("Content-Encoding = %q, want gzip %v", enc, tt.gzipped)
+			}
+
+			body := w.Body.Bytes()
+			if tt.gzipped {
+				if resp.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+					t.Errorf("Content-Length = %q, want %d", resp.Header.Get("Content-Length"), len(body))
+				}
+				gz, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = ioutil.ReadAll(gz); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(body, tt.data) {
+				t.Errorf("body = %q, want the error page", body)
+			}
+		})
+	}
+}
+
+func TestCompressLengthBuffer(t *testing.T) {
+	big := &Conf{}
+	big.Adv.ZipLength = 64
+	setTestConf(t, big)
+	gzSize := func(data []byte) int {
+		r := httptest.NewRequest("GET", "/missing", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		writeError(w, r, data, http.StatusNotFound)
+		return w.Body.Len()
+	}
+
+	// Random data can't be compressed, so the compressed size grows with every byte of the page.
+	data := make([]byte, 2048)
+	rand.New(rand.NewSource(1)).Read(data)
+	n := 400
+	for gzSize(data[:n]) <= 1024 {
+		n++
+	}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		length bool
+	}{
+		{"just under the buffer", data[:n-1], true},
+		{"just over the buffer", data[:n], false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.ZipLength = 1
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/missing", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			writeError(w, r, tt.data, http.StatusNotFound)
+
+			resp := w.Result()
+			if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+				t.Fatalf("Content-Encoding = %q, want gzip", enc)
+			}
+			cl := resp.Header.Get("Content-Length")
+			if tt.length && cl != strconv.Itoa(w.Body.Len()) {
+				t.Errorf("Content-Length = %q, want %d", cl, w.Body.Len())
+			}
+			if !tt.length && cl != "" {
+				t.Errorf("Content-Length = %q, want a streamed response", cl)
+			}
+		})
+	}
+
+	// Compressed files use the same buffer size for their Content-Length.
+	dir := t.TempDir()
+	page := writeFile(t, dir, "page.html", bytes.Repeat([]byte("<p>hello</p>"), 100))
+	files := []struct {
+		name   string
+		size   int
+		length bool
+	}{
+		{"file just under the buffer", 1024, true},
+		{"file just over the buffer", 1025, false},
+	}
+	for _, tt := range files {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.ZipLength = 1
+			setTestConf(t, c)
+			writeFile(t, dir, "page.html.br", data[:tt.size])
+
+			r := httptest.NewRequest("GET", "/page.html", nil)
+			r.Header.Set("Accept-Encoding", "br")
+			w := httptest.NewRecorder()
+			if err := ServeFile(w, r, page, "/page.html"); err != nil {
+				t.Fatal(err)
+			}
+			cl := w.Header().Get("Content-Length")
+			if tt.length && cl != strconv.Itoa(tt.size) {
+				t.Errorf("Content-Length = %q, want %d", cl, tt.size)
+			}
+			if !tt.length && cl != "" {
+				t.Errorf("Content-Length = %q, want a streamed response", cl)
+			}
+			if w.Body.Len() != tt.size {
+				t.Errorf("body is %d bytes, want %d", w.Body.Len(), tt.size)
+			}
+		})
+	}
+}
+
+func TestLengthWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		writes []string
+		length string
+	}{
+		{"fits in buffer", 16, []string{"hello ", "world"}, "11"},
+		{"exactly fills buffer", 11, []string{"hello ", "world"}, "11"},
+		{"overflows buffer", 8, []string{"hello ", "world"}, ""},
+		{"buffering disabled", 0, []string{"hello ", "world"}, ""},
+		{"empty response", 0, nil, "0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			lw := &lengthWriter{w: w, status: http.StatusNotFound, limit: tt.limit}
+			for _, b := range tt.writes {
+				if n, err := lw.Write([]byte(b)); n != len(b) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", b, n, err)
+				}
+			}
+			if err := lw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("status = %d, want 404", resp.StatusCode)
+			}
+			if cl := resp.Header.Get("Content-Length"); cl != tt.length {
+				t.Errorf("Content-Length = %q, want %q", cl, tt.length)
+			}
+			if got, want := w.Body.String(), strings.Join(tt.writes, ""); got != want {
+				t.Errorf("body = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDisableRanges(t *testing.T) {
+	file := writeFile(t, t.TempDir(), "data.txt", []byte("0123456789"))
+
+	tests := []struct {
+		name, rng string
+		disabled  bool
+		code      int
+		body      string
+		accept    string
+	}{
+		{"range served", "bytes=2-4", false, 206, "234", "bytes"},
+		{"range ignored", "bytes=2-4", true, 200, "0123456789", "none"},
+		{"no range", "", true, 200, "0123456789", "none"},
+		{"ranges enabled", "", false, 200, "0123456789", "bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.Dev, c.Adv.NoRanges = true, tt.disabled
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/data.txt", nil)
+			if tt.rng != "" {
+				r.Header.Set("Range", tt.rng)
+			}
+			w := httptest.NewRecorder()
+			if err := ServeFile(w, r, file, "/data.txt"); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tt.code || w.Body.String() != tt.body {
+				t.Errorf("response = %d %q, want %d %q", w.Code, w.Body.String(), tt.code, tt.body)
+			}
+			if got := w.Result().Header.Get("Accept-Ranges"); got != tt.accept {
+				t.Errorf("Accept-Ranges = %q, want %q", got, tt.accept)
+			}
+		})
+	}
+}
+
+func TestForbidden(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	for _, d := range []string{"secret", "locked", "empty"} {
+		if err := os.Mkdir(filepath.Join(root, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(root, "secret"), "passwd", []byte("user:hash"))
+	writeFile(t, filepath.Join(root, "locked"), "passwd", nil)
+	writeFile(t, filepath.Join(root, "locked"), "page.html", []byte("page"))
+	if err := os.Symlink(writeFile(t, outside, "outside.txt", []byte("outside")), filepath.Join(root, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	page := writeFile(t, t.TempDir(), "403.html", []byte("custom forbidden page"))
+
+	tests := []struct {
+		name, path string
+		status     bool
+	}{
+		{"passwd file", "/secret/passwd", false},
+		{"empty passwd", "/locked/page.html", false},
+		{"empty folder", "/empty/", false},
+		{"symlink outside root", "/link.txt", false},
+		{"status allowlist", "/status", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Root, c.ErrPage = root, map[int]string{http.StatusForbidden: page}
+			c.Index.NoList, c.Index.Empty = true, "forbid"
+			c.Status.IPs = []string{"10.0.0.1"}
+			setTestConf(t, c)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", tt.path, nil)
+			if tt.status {
+				StatusHandle(w, r)
+			} else {
+				mainHandle(w, r)
+			}
+			if w.Code != http.StatusForbidden || w.Body.String() != "custom forbidden page" {
+				t.Errorf("response = %d %q, want the custom 403 page", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestNoCompressAgents(t *testing.T) {
+	file := writeFile(t, t.TempDir(), "page.html", []byte("page"))
+	writeFile(t, filepath.Dir(file), "page.html.gz", []byte("zipped"))
+
+	tests := []struct {
+		name     string
+		patterns []string
+		agent    string
+		enc      string
+		vary     bool
+	}{
+		{"matching agent", []string{"^OldBrowser/"}, "OldBrowser/1.0", "", true},
+		{"other agent", []string{"^OldBrowser/"}, "Mozilla/5.0", "gzip", true},
+		{"no patterns", nil, "OldBrowser/1.0", "gzip", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Adv.NoZipUA = tt.patterns
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/page.html", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			r.Header.Set("User-Agent", tt.agent)
+			w := httptest.NewRecorder()
+			if err := ServeFile(w, r, file, "/page.html"); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.enc {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.enc)
+			}
+			if vary := w.Header().Values("Vary"); contains(vary, "User-Agent") != tt.vary {
+				t.Errorf("Vary = %q, want User-Agent %v", vary, tt.vary)
+			}
+		})
+	}
+}
+
+func TestServeFileZstd(t *testing.T) {
+	data := bytes.Repeat([]byte("<p>compressible page</p>"), 100)
+	tests := []struct {
+		name, accept string
+		level        int
+		precompress  bool
+		enc          string
+	}{
+		{"real time", "zstd", 3, false, "zstd"},
+		{"preferred over gzip", "gzip, zstd", 3, false, "zstd"},
+		{"missing br falls back to zstd", "zstd, br", 3, false, "zstd"},
+		{"gzip quality", "zstd;q=0.5, gzip", 3, false, "gzip"},
+		{"disabled", "zstd", 0, false, ""},
+		{"disabled falls back to gzip", "zstd, gzip", 0, false, "gzip"},
+		{"precompressed while disabled", "zstd", 0, true, "zstd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := writeFile(t, t.TempDir(), "page.html", data)
+			if tt.precompress {
+				var buf bytes.Buffer
+				if err := zstdCopy(&buf, bytes.NewReader(data)); err != nil {
+					t.Fatal(err)
+				}
+				writeFile(t, filepath.Dir(file), "page.html.zst", buf.Bytes())
+			}
+			c := &Conf{}
+			c.Adv.Zstd = tt.level
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/page.html", nil)
+			r.Header.Set("Accept-Encoding", tt.accept)
+			w := httptest.NewRecorder()
+			if err := ServeFile(w, r, file, "/page.html"); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.enc {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.enc)
+			}
+			if _, err := os.Stat(file + ".zst"); (err == nil) != (tt.enc == "zstd") {
+				t.Errorf("zstd file exists = %v, want %v", err == nil, tt.enc == "zstd")
+			}
+			if tt.enc != "zstd" {
+				return
+			}
+
+			zr, err := zstd.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zr.Close()
+			body, err := ioutil.ReadAll(zr)
+			if err != nil || !bytes.Equal(body, data) {
+				t.Errorf("decompressed body = %q, %v, want the original file", body, err)
+			}
+		})
+	}
+}
+
+func TestDirListHidesCompressed(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"page.html", "page.html.gz", "page.html.br", "page.html.zst", "archive.tar.gz"} {
+		writeFile(t, dir, name, []byte(name))
+	}
+	setTestConf(t, &Conf{})
+
+	w := httptest.NewRecorder()
+	if err := ServeFile(w, httptest.NewRequest("GET", "/", nil), dir+"/", "/"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"page.html.gz", "page.html.br", "page.html.zst"} {
+		if strings.Contains(w.Body.String(), name) {
+			t.Errorf("listing shows %s, want compressed files hidden", name)
+		}
+	}
+	for _, name := range []string{"page.html", "archive.tar.gz"} {
+		if !strings.Contains(w.Body.String(), name) {
+			t.Errorf("listing is missing %s", name)
+		}
+	}
+}
+
+func TestDirListEscapesName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"<script>alert(1)", "&lt;script&gt;alert(1)"},
+		{`"><img src=x onerror=alert(1)>`, "&#34;&gt;&lt;img src=x onerror=alert(1)&gt;"},
+		{"a&b", "a&amp;b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), tt.name)
+			if err := os.Mkdir(dir, 0755); err != nil {
+				t.Skip("unable to create the folder:", err)
+			}
+			writeFile(t, dir, "page.html", []byte("page"))
+			setTestConf(t, &Conf{})
+
+			w := httptest.NewRecorder()
+			if err := ServeFile(w, httptest.NewRequest("GET", "/", nil), dir+"/", "/"+tt.name+"/"); err != nil {
+				t.Fatal(err)
+			}
+			body := w.Body.String()
+			if strings.Contains(body, tt.name) {
+				t.Errorf("listing contains the unescaped folder name %q", tt.name)
+			}
+			for _, tag := range []string{"<title>/" + tt.want + "/</title>", "<h1>/" + tt.want + "/</h1>"} {
+				if !strings.Contains(body, tag) {
+					t.Errorf("listing is missing %s", tag)
+				}
+			}
+		})
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	mod := time.Date(2020, 1, 2, 3, 4, 5, 600, time.UTC)
+	etag := `W/"abc-1list"`
+	tests := []struct {
+		name, method, inm, ims string
+		want                   bool
+	}{
+		{"no validators", "GET", "", "", false},
+		{"matching etag", "GET", etag, "", true},
+		{"strong form of etag", "GET", `"abc-1list"`, "", true},
+		{"etag in list", "GET", `"other", ` + etag, "", true},
+		{"wildcard", "GET", "*", "", true},
+		{"changed etag", "GET", `"other"`, "", false},
+		{"changed etag hides modification time", "GET", `"other"`, mod.Add(time.Hour).Format(http.TimeFormat), false},
+		{"not modified since", "GET", "", mod.Format(http.TimeFormat), true},
+		{"modified since", "GET", "", mod.Add(-time.Hour).Format(http.TimeFormat), false},
+		{"invalid date", "GET", "", "yesterday", false},
+		{"head", "HEAD", etag, "", true},
+		{"post", "POST", etag, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/", nil)
+			if tt.inm != "" {
+				r.Header.Set("If-None-Match", tt.inm)
+			}
+			if tt.ims != "" {
+				r.Header.Set("If-Modified-Since", tt.ims)
+			}
+			if got := notModified(r, etag, mod); got != tt.want {
+				t.Errorf("notModified() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDirListValidation(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "page.html", []byte("page"))
+	setTestConf(t, &Conf{})
+
+	w := httptest.NewRecorder()
+	if err := ServeFile(w, httptest.NewRequest("GET", "/", nil), dir+"/", "/"); err != nil {
+		t.Fatal(err)
+	}
+	etag, lastMod := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	if !strings.HasPrefix(etag, `W/"`) || lastMod == "" {
+		t.Fatalf("ETag = %q, Last-Modified = %q, want a weak listing ETag and a modification time", etag, lastMod)
+	}
+
+	tests := []struct {
+		name, inm, ims string
+		code           int
+	}{
+		{"matching etag", etag, "", http.StatusNotModified},
+		{"not modified since", "", lastMod, http.StatusNotModified},
+		{"changed etag", `W/"stale"`, lastMod, http.StatusOK},
+		{"no validators", "", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.inm != "" {
+				r.Header.Set("If-None-Match", tt.inm)
+			}
+			if tt.ims != "" {
+				r.Header.Set("If-Modified-Since", tt.ims)
+			}
+			w := httptest.NewRecorder()
+			if err := ServeFile(w, r, dir+"/", "/"); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if listed := strings.Contains(w.Body.String(), "page.html"); listed != (tt.code == http.StatusOK) {
+				t.Errorf("body = %q, want a listing only with status 200", w.Body.String())
+			}
+		})
+	}
+}
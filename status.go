@@ -0,0 +1,279 @@
+// KatWeb by kittyhacker101 - Server Status Endpoint
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatusData contains the runtime info returned by the status endpoint.
+type StatusData struct {
+	Uptime     int64  `json:"uptime"`
+	Requests   uint64 `json:"requests"`
+	NotFound   uint64 `json:"notFound"`
+	Conns      int64  `json:"activeConnections"`
+	Goroutines int    `json:"goroutines"`
+	Mem        struct {
+		Alloc     uint64 `json:"alloc"`
+		Sys       uint64 `json:"sys"`
+		HeapAlloc uint64 `json:"heapAlloc"`
+		HeapInuse uint64 `json:"heapInuse"`
+		NumGC     uint32 `json:"numGC"`
+	} `json:"memory"`
+	Hosts map[string]HostBytes `json:"hosts"`
+}
+
+// HostBytes contains the amount of bytes received and sent for a host.
+type HostBytes struct {
+	In  uint64 `json:"bytesIn"`
+	Out uint64 `json:"bytesOut"`
+}
+
+// countWriter is a http.ResponseWriter which counts the bytes written to it.
+// It also removes the configured response headers before they are sent.
+type countWriter struct {
+	http.ResponseWriter
+	n      uint64
+	wrote  bool
+	status int
+	err    error
+}
+
+// stripHeaders removes the configured response headers, the first time the response is written to.
+func (c *countWriter) stripHeaders() {
+	if c.wrote {
+		return
+	}
+	c.wrote = true
+	for _, h := range conf().Headers.StripResp {
+		c.Header().Del(h)
+	}
+}
+
+func (c *countWriter) WriteHeader(status int) {
+	// Informational responses don't start the final response.
+	if status >= 200 {
+		if !c.wrote {
+			c.status = status
+		}
+		c.stripHeaders()
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	c.stripHeaders()
+	n, err := c.ResponseWriter.Write(b)
+	c.n += uint64(n)
+	c.fail(err)
+	return n, err
+}
+
+// fail records the first error from writing the response, which is usually caused by the client disconnecting.
+func (c *countWriter) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// ReadFrom allows http.ResponseWriter's use of sendfile to be kept.
+func (c *countWriter) ReadFrom(src io.Reader) (int64, error) {
+	c.stripHeaders()
+	if rf, ok := c.ResponseWriter.(io.ReaderFrom); ok {
+		n, err := rf.ReadFrom(src)
+		c.n += uint64(n)
+		c.fail(err)
+		return n, err
+	}
+
+	return io.Copy(struct{ io.Writer }{c}, src)
+}
+
+// code returns the status code of the response, which is 200 if it was written without setting one.
+func (c *countWriter) code() int {
+	if c.status == 0 {
+		return http.StatusOK
+	}
+	return c.status
+}
+
+// Flush passes the flush through to the underlying http.ResponseWriter, if it supports flushing.
+func (c *countWriter) Flush() {
+	if fl, ok := c.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// Hijack passes the hijack through to the underlying http.ResponseWriter, for use by websockets.
+func (c *countWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := c.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+
+	return nil, nil, errors.New("hijacking not supported")
+}
+
+// Unwrap returns the underlying http.ResponseWriter, for use by http.ResponseController.
+func (c *countWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// countReader is a io.ReadCloser which counts the bytes read from it.
+type countReader struct {
+	io.ReadCloser
+	n uint64
+}
+
+func (c *countReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.n += uint64(n)
+	return n, err
+}
+
+var (
+	startTime     = time.Now()
+	reqCount      uint64
+	notFoundCount uint64
+	connCount     int64
+	hostBytes     sync.Map
+)
+
+// hostLabel chooses the label used for counting a host's bytes.
+// Hosts which are not a virtual host or a proxied host are counted as "other", to limit the amount of labels.
+func hostLabel(host, path string) string {
+	h := trimPort(host)
+	if path == h+"/" {
+		return h
+	}
+	if _, ok := route().proxies[host]; ok {
+		return h
+	}
+
+	return "other"
+}
+
+// addHostBytes adds to the byte counters of a host.
+func addHostBytes(label string, in, out uint64) {
+	val, ok := hostBytes.Load(label)
+	if !ok {
+		val, _ = hostBytes.LoadOrStore(label, &HostBytes{})
+	}
+
+	atomic.AddUint64(&val.(*HostBytes).In, in)
+	atomic.AddUint64(&val.(*HostBytes).Out, out)
+}
+
+// trackConn keeps count of the connections currently open to the server.
+func trackConn(c net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&connCount, 1)
+	case http.StateHijacked, http.StateClosed:
+		atomic.AddInt64(&connCount, -1)
+	}
+}
+
+// statusAllowed checks if a client's IP is in the status endpoint's allowlist.
+func statusAllowed(r *http.Request) bool {
+	if len(conf().Status.IPs) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(strings.Trim(trimPort(r.RemoteAddr), "[]"))
+	if ip == nil {
+		return false
+	}
+	for _, a := range conf().Status.IPs {
+		if _, cidr, err := net.ParseCIDR(a); err == nil {
+			if cidr.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(a)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ProbeHandle serves the liveness and readiness endpoints, and returns false if the request is not for either of them.
+// The liveness endpoint always succeeds, while the readiness endpoint fails until the server is accepting connections, and while it is shutting down.
+// Like every other path, the endpoints are inside of the base path, if one is set.
+func ProbeHandle(w http.ResponseWriter, r *http.Request) bool {
+	switch {
+	case !conf().Probes.Run:
+		return false
+	case r.URL.Path == conf().Adv.Base+conf().Probes.Live:
+	case r.URL.Path == conf().Adv.Base+conf().Probes.Ready:
+		if atomic.LoadInt32(&ready) == 0 {
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("not ready\n"))
+			return true
+		}
+	default:
+		return false
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+	return true
+}
+
+// StatusHandle serves runtime info about the server as JSON.
+func StatusHandle(w http.ResponseWriter, r *http.Request) {
+	if !statusAllowed(r) {
+		Forbidden(w, r)
+		logr(r, "WebForbid", "", r.URL.EscapedPath())
+		return
+	}
+	if len(conf().Status.Login) > 0 && !RunAuth(w, r, conf().Status.Login) {
+		StyledError(w, r, "401 Unauthorized", "Correct authentication credentials are required to access this resource.", http.StatusUnauthorized)
+		logr(r, "WebUnAuth", "", r.URL.EscapedPath())
+		return
+	}
+
+	var (
+		stat StatusData
+		mem  runtime.MemStats
+	)
+	runtime.ReadMemStats(&mem)
+
+	stat.Uptime = int64(time.Since(startTime).Seconds())
+	stat.Requests = atomic.LoadUint64(&reqCount)
+	stat.NotFound = atomic.LoadUint64(&notFoundCount)
+	stat.Conns = atomic.LoadInt64(&connCount)
+	stat.Goroutines = runtime.NumGoroutine()
+	stat.Mem.Alloc = mem.Alloc
+	stat.Mem.Sys = mem.Sys
+	stat.Mem.HeapAlloc = mem.HeapAlloc
+	stat.Mem.HeapInuse = mem.HeapInuse
+	stat.Mem.NumGC = mem.NumGC
+	stat.Hosts = make(map[string]HostBytes)
+	hostBytes.Range(func(k, v interface{}) bool {
+		hb := v.(*HostBytes)
+		stat.Hosts[k.(string)] = HostBytes{atomic.LoadUint64(&hb.In), atomic.LoadUint64(&hb.Out)}
+		return true
+	})
+
+	data, err := json.Marshal(stat)
+	if err != nil {
+		StyledError(w, r, "500 Internal Server Error", "An unexpected condition was encountered, try again later", http.StatusInternalServerError)
+		logr(r, "WebError", "", r.URL.EscapedPath())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
+	logr(r, "Web", "", r.URL.EscapedPath())
+}
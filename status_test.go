@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBasePathEndpoints(t *testing.T) {
+	tests := []struct {
+		name, base, path string
+		ready            int32
+		code             int
+		body             string
+	}{
+		{"live", "", "/livez", 1, 200, "ok\n"},
+		{"ready", "", "/readyz", 1, 200, "ok\n"},
+		{"not ready", "", "/readyz", 0, 503, "not ready\n"},
+		{"status", "", "/status", 1, 200, `"uptime"`},
+		{"live under base", "/app", "/app/livez", 1, 200, "ok\n"},
+		{"ready under base", "/app", "/app/readyz", 1, 200, "ok\n"},
+		{"status under base", "/app", "/app/status", 1, 200, `"uptime"`},
+		{"live outside base", "/app", "/livez", 1, 404, ""},
+		{"status outside base", "/app", "/status", 1, 404, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Adv.Base = tt.base
+			c.Probes.Run, c.Probes.Live, c.Probes.Ready = true, "/livez", "/readyz"
+			c.Status.Run, c.Status.Loc = true, "/status"
+			setTestConf(t, c)
+			prev := atomic.SwapInt32(&ready, tt.ready)
+			defer atomic.StoreInt32(&ready, prev)
+
+			w := httptest.NewRecorder()
+			mainHandle(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("body = %q, want it to contain %q", w.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+func TestStatusHandle(t *testing.T) {
+	hash := sha512.Sum512([]byte("admin:secret"))
+
+	tests := []struct {
+		name, remote string
+		ips          []string
+		logins       []string
+		user, pass   string
+		code         int
+	}{
+		{"open", "192.0.2.1:1234", nil, nil, "", "", 200},
+		{"allowed ip", "192.0.2.1:1234", []string{"192.0.2.1"}, nil, "", "", 200},
+		{"allowed cidr", "[2001:db8::5]:1234", []string{"2001:db8::/32"}, nil, "", "", 200},
+		{"blocked ip", "198.51.100.1:1234", []string{"192.0.2.0/24"}, nil, "", "", 403},
+		{"no login", "192.0.2.1:1234", nil, []string{hex.EncodeToString(hash[:])}, "", "", 401},
+		{"wrong login", "192.0.2.1:1234", nil, []string{hex.EncodeToString(hash[:])}, "admin", "wrong", 401},
+		{"correct login", "192.0.2.1:1234", nil, []string{hex.EncodeToString(hash[:])}, "admin", "secret", 200},
+		{"blocked ip with login", "198.51.100.1:1234", []string{"192.0.2.1"}, []string{hex.EncodeToString(hash[:])}, "admin", "secret", 403},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Status.Run, c.Status.Loc, c.Status.IPs, c.Status.Login = true, "/status", tt.ips, tt.logins
+			setTestConf(t, c)
+
+			r := httptest.NewRequest("GET", "/status", nil)
+			r.RemoteAddr = tt.remote
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+			w := httptest.NewRecorder()
+			StatusHandle(w, r)
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if tt.code != 200 {
+				return
+			}
+
+			var stat StatusData
+			if err := json.Unmarshal(w.Body.Bytes(), &stat); err != nil {
+				t.Fatalf("status endpoint returned invalid JSON: %v", err)
+			}
+			if stat.Goroutines <= 0 || stat.Mem.Sys == 0 {
+				t.Errorf("status = %+v, want runtime info", stat)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+		})
+	}
+}
+
+func TestHostBytes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(append([]byte("echo "), body...))
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	for _, host := range []string{"html", "example.com"} {
+		if err := os.Mkdir(filepath.Join(dir, host), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filepath.Join(dir, host), "page.txt", []byte("page for "+host))
+	}
+	t.Chdir(dir)
+	loadTestProxies(t, `{"documentRoot":"html","advanced":{"httpPort":80,"sslPort":443},"proxy":[{"location":"proxy.test","host":"`+backend.URL+`/"}]}`)
+	if err := LoadProxyTransport(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, method, host, body string
+		label                    string
+		in, out                  uint64
+	}{
+		{"virtual host", "GET", "example.com", "", "example.com", 0, uint64(len("page for example.com"))},
+		{"virtual host with port", "GET", "example.com:8080", "", "example.com", 0, uint64(len("page for example.com"))},
+		{"proxied host", "POST", "proxy.test", "ping", "proxy.test", 4, uint64(len("echo ping"))},
+		{"unknown host", "GET", "unknown.test", "", "other", 0, uint64(len("page for html"))},
+		{"bare ip", "GET", "192.0.2.1", "", "other", 0, uint64(len("page for html"))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostBytes.Range(func(k, _ interface{}) bool {
+				hostBytes.Delete(k)
+				return true
+			})
+
+			r := httptest.NewRequest(tt.method, "/page.txt", strings.NewReader(tt.body))
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			mainHandle(w, r)
+			if w.Code != 200 {
+				t.Fatalf("status = %d, want 200", w.Code)
+			}
+
+			val, ok := hostBytes.Load(tt.label)
+			if !ok {
+				t.Fatalf("no byte counters for %s", tt.label)
+			}
+			if got := *val.(*HostBytes); got.In != tt.in || got.Out != tt.out {
+				t.Errorf("bytes = %+v, want in %d out %d", got, tt.in, tt.out)
+			}
+		})
+	}
+}
+
+func TestStripResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(c *countWriter)
+	}{
+		{"write", func(c *countWriter) { c.Write([]byte("body")) }},
+		{"write header", func(c *countWriter) { c.WriteHeader(http.StatusNoContent) }},
+		{"read from", func(c *countWriter) { c.ReadFrom(strings.NewReader("body")) }},
+	}
+
+	c := &Conf{}
+	c.Headers.StripResp = []string{"x-powered-by", "Server"}
+	setTestConf(t, c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			cw := &countWriter{ResponseWriter: w}
+			cw.Header().Set("X-Powered-By", "backend")
+			cw.Header().Set("Server", "backend")
+			cw.Header().Set("Content-Type", "text/plain")
+			tt.write(cw)
+
+			h := w.Result().Header
+			if h.Get("X-Powered-By") != "" || h.Get("Server") != "" {
+				t.Errorf("headers = %v, want X-Powered-By and Server removed", h)
+			}
+			if h.Get("Content-Type") != "text/plain" {
+				t.Errorf("Content-Type = %q, want other headers kept", h.Get("Content-Type"))
+			}
+		})
+	}
+
+	// Informational responses are sent before the final response, so the headers are only removed once it is written.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &countWriter{ResponseWriter: w}
+		cw.Header().Set("X-Powered-By", "backend")
+		cw.WriteHeader(http.StatusEarlyHints)
+		cw.Write([]byte("body"))
+	}))
+	defer backend.Close()
+
+	var early http.Header
+	req, _ := http.NewRequest("GET", backend.URL, nil)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, h textproto.MIMEHeader) error {
+			early = http.Header(h)
+			return nil
+		},
+	}))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if early.Get("X-Powered-By") != "backend" {
+		t.Errorf("informational headers = %v, want X-Powered-By kept", early)
+	}
+	if resp.Header.Get("X-Powered-By") != "" {
+		t.Errorf("final headers = %v, want X-Powered-By removed", resp.Header)
+	}
+}
+
+func TestProbeHandle(t *testing.T) {
+	tests := []struct {
+		name, path string
+		enabled    bool
+		ready      int32
+		draining   bool
+		code       int
+		body       string
+	}{
+		{"live", "/healthz", true, 0, false, 200, "ok\n"},
+		{"live while draining", "/healthz", true, 0, true, 200, "ok\n"},
+		{"ready", "/readyz", true, 1, false, 200, "ok\n"},
+		{"not ready", "/readyz", true, 0, false, 503, "not ready\n"},
+		{"other path", "/", true, 1, false, 200, ""},
+		{"disabled", "/healthz", false, 1, false, 404, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Probes.Run, c.Probes.Live, c.Probes.Ready = tt.enabled, "/healthz", "/readyz"
+			c.Adv.Drain = 1
+			setTestConf(t, c)
+			atomic.StoreInt32(&ready, tt.ready)
+			if tt.draining {
+				atomic.StoreInt32(&draining, 1)
+			}
+			t.Cleanup(func() {
+				atomic.StoreInt32(&ready, 0)
+				atomic.StoreInt32(&draining, 0)
+			})
+
+			w := httptest.NewRecorder()
+			mainHandle(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.code {
+				t.Fatalf("status = %d, want %d", w.Code, tt.code)
+			}
+			if tt.body != "" {
+				if w.Body.String() != tt.body || w.Header().Get("Cache-Control") != "no-store" {
+					t.Errorf("response = %q, Cache-Control %q, want %q and no-store", w.Body.String(), w.Header().Get("Cache-Control"), tt.body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+// KatWeb by kittyhacker101 - Syslog Support
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log/syslog"
+)
+
+var facilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// dialSyslog connects to the configured syslog server.
+// It returns a writer for access logs, and a writer for error logs.
+// If no network is configured, the local syslog server will be used.
+func dialSyslog() (io.Writer, io.Writer, error) {
+	fac := syslog.LOG_DAEMON
+	if conf().Syslog.Facility != "" {
+		f, ok := facilities[conf().Syslog.Facility]
+		if !ok {
+			return nil, nil, errors.New("unknown syslog facility")
+		}
+		fac = f
+	}
+
+	access, err := syslog.Dial(conf().Syslog.Net, conf().Syslog.Addr, fac|syslog.LOG_INFO, conf().Syslog.Tag)
+	if err != nil {
+		return nil, nil, err
+	}
+	errs, err := syslog.Dial(conf().Syslog.Net, conf().Syslog.Addr, fac|syslog.LOG_ERR, conf().Syslog.Tag)
+	if err != nil {
+		access.Close()
+		return nil, nil, err
+	}
+
+	return access, errs, nil
+}
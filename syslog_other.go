@@ -0,0 +1,16 @@
+// KatWeb by kittyhacker101 - Syslog Support (Unsupported Platforms)
+
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// dialSyslog is not supported on this platform, and always returns an error.
+func dialSyslog() (io.Writer, io.Writer, error) {
+	return nil, nil, errors.New("syslog is not supported on this platform")
+}
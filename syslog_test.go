@@ -0,0 +1,107 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// syslogListener starts a local UDP syslog server, returning it's address and a channel of the messages it receives.
+func syslogListener(t *testing.T) (string, chan string) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	msgs := make(chan string, 16)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msgs <- string(buf[:n])
+		}
+	}()
+	return pc.LocalAddr().String(), msgs
+}
+
+// readSyslog waits for a message from a syslog server.
+func readSyslog(t *testing.T, msgs chan string) string {
+	t.Helper()
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message was delivered to syslog")
+		return ""
+	}
+}
+
+func TestStartLogSyslog(t *testing.T) {
+	tests := []struct {
+		name, facility string
+		access, errs   string
+	}{
+		{"default facility", "", "<30>", "<27>"},
+		{"local facility", "local0", "<134>", "<131>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, msgs := syslogListener(t)
+			c := &Conf{}
+			c.Syslog.Run, c.Syslog.Net, c.Syslog.Addr = true, "udp", addr
+			c.Syslog.Facility, c.Syslog.Tag = tt.facility, "katweb-test"
+			setTestConf(t, c)
+			t.Cleanup(func() {
+				logW = nil
+				Logger.SetOutput(cleanWriter{os.Stderr})
+			})
+
+			StartLog()
+			PrintLog("access entry")
+			if msg := readSyslog(t, msgs); !strings.HasPrefix(msg, tt.access) || !strings.Contains(msg, "katweb-test") || !strings.Contains(msg, "access entry") {
+				t.Errorf("access log message = %q, want priority %s", msg, tt.access)
+			}
+			Logger.Print("error entry")
+			if msg := readSyslog(t, msgs); !strings.HasPrefix(msg, tt.errs) || !strings.Contains(msg, "error entry") {
+				t.Errorf("error log message = %q, want priority %s", msg, tt.errs)
+			}
+		})
+	}
+}
+
+func TestDialSyslogFallback(t *testing.T) {
+	tests := []struct {
+		name, network, addr, facility string
+	}{
+		{"unknown facility", "udp", "127.0.0.1:514", "printer"},
+		{"unavailable server", "unix", "/nonexistent/syslog.sock", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conf{}
+			c.Syslog.Run, c.Syslog.Net, c.Syslog.Addr, c.Syslog.Facility = true, tt.network, tt.addr, tt.facility
+			setTestConf(t, c)
+
+			if _, _, err := dialSyslog(); err == nil {
+				t.Fatal("dialSyslog() succeeded, want an error")
+			}
+			StartLog()
+			if logW != nil {
+				logW = nil
+				t.Error("access log was sent to syslog, want the console")
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+// KatWeb by kittyhacker101 - W3C Trace Context Propagation and OpenTelemetry Spans
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxSpanBatch = 512             // spans sent to the OTLP endpoint in a single request
+	spanInterval = 5 * time.Second // how often queued spans are exported
+)
+
+// traceKey is the context key for the span of a request.
+type traceKey struct{}
+
+// span is a server span covering the handling of a single request.
+type span struct {
+	trace, id, parent string
+	name              string
+	start, end        time.Time
+	attrs             map[string]string
+	status            int
+}
+
+// spanExporter sends finished spans to a tracing backend.
+type spanExporter interface {
+	export(spans []*span) error
+}
+
+var (
+	// spanQueue holds finished spans until they are exported. Spans are dropped if it is full, so tracing never slows down requests.
+	spanQueue = make(chan *span, 4*maxSpanBatch)
+
+	// exporter is the spanExporter used for finished spans.
+	exporter spanExporter = otlpExporter{client: &http.Client{Timeout: 10 * time.Second}}
+)
+
+// validTraceID checks if a string is a non-zero lowercase hex ID of the given length.
+func validTraceID(id string, n int) bool {
+	if len(id) != n || strings.Trim(id, "0") == "" {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil && strings.ToLower(id) == id
+}
+
+// randomID returns n random bytes encoded as hex.
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startTrace creates a span for a request, continuing the trace from the client's traceparent header if it has one.
+// The traceparent header is replaced with the new span, so it is propagated to proxied backends.
+func startTrace(r *http.Request) *http.Request {
+	var (
+		s     = &span{trace: randomID(16), id: randomID(8), name: r.Method, start: time.Now()}
+		flags = "01"
+	)
+
+	// traceparent is formatted as version-traceid-parentid-flags
+	if p := strings.Split(r.Header.Get("traceparent"), "-"); len(p) == 4 && p[0] == "00" && validTraceID(p[1], 32) && validTraceID(p[2], 16) && len(p[3]) == 2 {
+		s.trace, s.parent, flags = p[1], p[2], p[3]
+	}
+
+	s.attrs = map[string]string{
+		"http.request.method":      r.Method,
+		"url.path":                 r.URL.Path,
+		"server.address":           trimPort(r.Host),
+		"network.protocol.version": strings.TrimPrefix(r.Proto, "HTTP/"),
+		"user_agent.original":      r.UserAgent(),
+	}
+	if r.TLS != nil {
+		s.attrs["url.scheme"] = "https"
+	} else {
+		s.attrs["url.scheme"] = "http"
+	}
+
+	r.Header.Set("traceparent", "00-"+s.trace+"-"+s.id+"-"+flags)
+	return r.WithContext(context.WithValue(r.Context(), traceKey{}, s))
+}
+
+// finishTrace ends the span of a request, and queues it for export if an OTLP endpoint is set.
+func finishTrace(r *http.Request, status int) {
+	s, ok := r.Context().Value(traceKey{}).(*span)
+	if !ok || conf().Adv.OTLP == "" {
+		return
+	}
+	s.end, s.status = time.Now(), status
+
+	select {
+	case spanQueue <- s:
+	default:
+	}
+}
+
+// traceID returns the trace ID of a request, for use in the access log.
+func traceID(r *http.Request) string {
+	if s, ok := r.Context().Value(traceKey{}).(*span); ok {
+		return s.trace
+	}
+	return "-"
+}
+
+// flushSpans exports all queued spans, in batches of up to maxSpanBatch.
+func flushSpans() {
+	for {
+		batch := make([]*span, 0, maxSpanBatch)
+	fill:
+		for len(batch) < maxSpanBatch {
+			select {
+			case s := <-spanQueue:
+				batch = append(batch, s)
+			default:
+				break fill
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := exporter.export(batch); err != nil && conf().Adv.Dev {
+			Print("[Debug] : Unable to export " + strconv.Itoa(len(batch)) + " spans, " + err.Error() + ".")
+		}
+		if len(batch) < maxSpanBatch {
+			return
+		}
+	}
+}
+
+// StartTraceExport periodically exports queued spans to the OTLP endpoint.
+func StartTraceExport() {
+	go func() {
+		for range time.Tick(spanInterval) {
+			flushSpans()
+		}
+	}()
+}
+
+// otlpExporter is a spanExporter which sends spans to an OTLP/HTTP endpoint, using the JSON encoding.
+type otlpExporter struct {
+	client *http.Client
+}
+
+type (
+	otlpValue struct {
+		String string `json:"stringValue,omitempty"`
+		Int    string `json:"intValue,omitempty"`
+	}
+	otlpAttr struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpStatus struct {
+		Code int `json:"code,omitempty"`
+	}
+	otlpSpan struct {
+		Trace  string     `json:"traceId"`
+		ID     string     `json:"spanId"`
+		Parent string     `json:"parentSpanId,omitempty"`
+		Name   string     `json:"name"`
+		Kind   int        `json:"kind"`
+		Start  string     `json:"startTimeUnixNano"`
+		End    string     `json:"endTimeUnixNano"`
+		Attrs  []otlpAttr `json:"attributes"`
+		Status otlpStatus `json:"status"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpResource struct {
+		Attrs []otlpAttr `json:"attributes"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+)
+
+// otlpEncode converts spans to an OTLP export request.
+func otlpEncode(spans []*span) otlpRequest {
+	ss := otlpScopeSpans{Scope: otlpScope{"katweb", currentVersion}}
+	for _, s := range spans {
+		o := otlpSpan{
+			Trace:  s.trace,
+			ID:     s.id,
+			Parent: s.parent,
+			Name:   s.name,
+			Kind:   2, // SPAN_KIND_SERVER
+			Start:  strconv.FormatInt(s.start.UnixNano(), 10),
+			End:    strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		for k, v := range s.attrs {
+			o.Attrs = append(o.Attrs, otlpAttr{k, otlpValue{String: v}})
+		}
+		o.Attrs = append(o.Attrs, otlpAttr{"http.response.status_code", otlpValue{Int: strconv.Itoa(s.status)}})
+		// Only server errors mark a server span as failed.
+		if s.status >= 500 {
+			o.Status.Code = 2 // STATUS_CODE_ERROR
+		}
+		ss.Spans = append(ss.Spans, o)
+	}
+
+	return otlpRequest{[]otlpResourceSpans{{
+		Resource:   otlpResource{[]otlpAttr{{"service.name", otlpValue{String: "katweb"}}, {"service.version", otlpValue{String: currentVersion}}}},
+		ScopeSpans: []otlpScopeSpans{ss},
+	}}}
+}
+
+func (e otlpExporter) export(spans []*span) error {
+	data, err := json.Marshal(otlpEncode(spans))
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(strings.TrimSuffix(conf().Adv.OTLP, "/")+"/v1/traces", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("OTLP endpoint returned " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memExporter is a spanExporter which keeps spans in memory.
+type memExporter struct {
+	spans []*span
+}
+
+func (m *memExporter) export(spans []*span) error {
+	m.spans = append(m.spans, spans...)
+	return nil
+}
+
+// setMemExporter replaces the exporter with a memExporter for the duration of a test.
+func setMemExporter(t *testing.T) *memExporter {
+	t.Helper()
+	flushSpans()
+	prev, m := exporter, &memExporter{}
+	exporter = m
+	t.Cleanup(func() { exporter = prev })
+	return m
+}
+
+func TestStartTrace(t *testing.T) {
+	const (
+		trace  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parent = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name, header string
+		trace        string // empty if a new trace is started
+		parent       string
+		flags        string
+	}{
+		{"no header", "", "", "", "01"},
+		{"valid", "00-" + trace + "-" + parent + "-01", trace, parent, "01"},
+		{"unsampled", "00-" + trace + "-" + parent + "-00", trace, parent, "00"},
+		{"zero trace", "00-00000000000000000000000000000000-" + parent + "-01", "", "", "01"},
+		{"uppercase", "00-" + strings.ToUpper(trace) + "-" + parent + "-01", "", "", "01"},
+		{"bad version", "01-" + trace + "-" + parent + "-01", "", "", "01"},
+		{"short parent", "00-" + trace + "-00f067aa-01", "", "", "01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set("traceparent", tt.header)
+			}
+			s := startTrace(r).Context().Value(traceKey{}).(*span)
+
+			if tt.trace != "" && s.trace != tt.trace {
+				t.Errorf("trace = %q, want %q", s.trace, tt.trace)
+			}
+			if tt.trace == "" && (!validTraceID(s.trace, 32) || s.trace == trace) {
+				t.Errorf("trace = %q, want a new trace ID", s.trace)
+			}
+			if s.parent != tt.parent {
+				t.Errorf("parent = %q, want %q", s.parent, tt.parent)
+			}
+			if want := "00-" + s.trace + "-" + s.id + "-" + tt.flags; r.Header.Get("traceparent") != want {
+				t.Errorf("traceparent = %q, want %q", r.Header.Get("traceparent"), want)
+			}
+		})
+	}
+}
+
+func TestTraceSpans(t *testing.T) {
+	tests := []struct {
+		name, path string
+		otlp       string
+		status     int
+		spans      int
+	}{
+		{"found", "/", "http://collector:4318", 200, 1},
+		{"not found", "/missing", "http://collector:4318", 404, 1},
+		{"no endpoint", "/", "", 200, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := baseConf()
+			c.Adv.Trace, c.Adv.OTLP = true, tt.otlp
+			setTestConf(t, c)
+			m := setMemExporter(t)
+
+			r := httptest.NewRequest("GET", "http://example.com"+tt.path, nil)
+			r.Header.Set("User-Agent", "test")
+			mainHandle(httptest.NewRecorder(), r)
+			flushSpans()
+
+			if len(m.spans) != tt.spans {
+				t.Fatalf("exported %d spans, want %d", len(m.spans), tt.spans)
+			}
+			if tt.spans == 0 {
+				return
+			}
+			s := m.spans[0]
+			if s.name != "GET" || s.status != tt.status || s.end.Before(s.start) {
+				t.Errorf("span = %+v, want GET with status %d", s, tt.status)
+			}
+			want := map[string]string{
+				"http.request.method": "GET",
+				"url.path":            tt.path,
+				"url.scheme":          "http",
+				"server.address":      "example.com",
+				"user_agent.original": "test",
+			}
+			for k, v := range want {
+				if s.attrs[k] != v {
+					t.Errorf("attribute %s = %q, want %q", k, s.attrs[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var (
+		got  otlpRequest
+		path string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		data, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(data, &got)
+	}))
+	defer srv.Close()
+
+	c := baseConf()
+	c.Adv.OTLP = srv.URL + "/"
+	setTestConf(t, c)
+
+	start := time.Unix(1, 0)
+	spans := []*span{
+		{trace: "4bf92f3577b34da6a3ce929d0e0e4736", id: "00f067aa0ba902b7", name: "GET", start: start, end: start.Add(time.Second), status: 200, attrs: map[string]string{"url.path": "/"}},
+		{trace: "4bf92f3577b34da6a3ce929d0e0e4736", id: "00f067aa0ba902b8", parent: "00f067aa0ba902b7", name: "POST", start: start, end: start, status: 503},
+	}
+	if err := (otlpExporter{client: srv.Client()}).export(spans); err != nil {
+		t.Fatal(err)
+	}
+
+	if path != "/v1/traces" {
+		t.Errorf("exported to %q, want /v1/traces", path)
+	}
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("export request = %+v, want one resource and scope", got)
+	}
+	out := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(out) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(out))
+	}
+
+	tests := []struct {
+		parent, start, end string
+		code               int
+		status             string
+	}{
+		{"", "1000000000", "2000000000", 0, "200"},
+		{"00f067aa0ba902b7", "1000000000", "1000000000", 2, "503"},
+	}
+	for i, tt := range tests {
+		o := out[i]
+		if o.Parent != tt.parent || o.Start != tt.start || o.End != tt.end || o.Status.Code != tt.code || o.Kind != 2 {
+			t.Errorf("span %d = %+v, want parent %q, times %s-%s, status code %d", i, o, tt.parent, tt.start, tt.end, tt.code)
+		}
+		var status string
+		for _, a := range o.Attrs {
+			if a.Key == "http.response.status_code" {
+				status = a.Value.Int
+			}
+		}
+		if status != tt.status {
+			t.Errorf("span %d status attribute = %q, want %q", i, status, tt.status)
+		}
+	}
+}